@@ -0,0 +1,238 @@
+package spiffetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// ErrForeignID is returned when an SVID is requested for a SPIFFE ID outside
+// the CA's trust domain.
+var ErrForeignID = errors.New("SPIFFE ID not in trust domain")
+
+// CA is a local certificate authority for a single trust domain. It mints
+// X.509-SVIDs and JWT-SVIDs, and keeps previous authorities in its bundles
+// after a rotation so that SVIDs issued before the rotation remain valid.
+//
+// CreateX509SVID and CreateJWTSVID return errors rather than failing the test,
+// as the Workload API calls them from its server goroutines, where
+// testing.TB.Fatal must not be called.
+type CA struct {
+	tb          testing.TB
+	trustDomain spiffeid.TrustDomain
+
+	mu          sync.RWMutex
+	x509Cert    *x509.Certificate
+	x509Key     crypto.Signer
+	x509Bundle  *x509bundle.Bundle
+	jwtKeyID    string
+	jwtKey      crypto.Signer
+	jwtBundle   *jwtbundle.Bundle
+	serialCount int64
+}
+
+// NewCA creates a CA for the given trust domain with a fresh X.509 and JWT
+// signing authority.
+func NewCA(tb testing.TB, trustDomain spiffeid.TrustDomain) *CA {
+	tb.Helper()
+	ca := &CA{
+		tb:          tb,
+		trustDomain: trustDomain,
+		x509Bundle:  x509bundle.New(trustDomain),
+		jwtBundle:   jwtbundle.New(trustDomain),
+	}
+	ca.Rotate()
+	return ca
+}
+
+// TrustDomain returns the trust domain of the CA.
+func (ca *CA) TrustDomain() spiffeid.TrustDomain {
+	return ca.trustDomain
+}
+
+// Rotate replaces the X.509 and JWT signing authorities. The previous
+// authorities are retained in the bundles.
+func (ca *CA) Rotate() {
+	ca.tb.Helper()
+
+	x509Key, err := newKey()
+	if err != nil {
+		ca.tb.Fatal(err)
+	}
+	jwtKey, err := newKey()
+	if err != nil {
+		ca.tb.Fatal(err)
+	}
+	jwtKeyID, err := newKeyID()
+	if err != nil {
+		ca.tb.Fatal(err)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          ca.nextSerial(),
+		Subject:               pkix.Name{Organization: []string{"spiffetest"}, CommonName: ca.trustDomain.Name()},
+		URIs:                  []*url.URL{ca.trustDomain.ID().URL()},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := createCertificate(tmpl, tmpl, x509Key.Public(), x509Key)
+	if err != nil {
+		ca.tb.Fatal(err)
+	}
+
+	if err := ca.jwtBundle.AddJWTAuthority(jwtKeyID, jwtKey.Public()); err != nil {
+		ca.tb.Fatalf("failed to add JWT authority: %v", err)
+	}
+	ca.x509Bundle.AddX509Authority(cert)
+	ca.x509Cert = cert
+	ca.x509Key = x509Key
+	ca.jwtKeyID = jwtKeyID
+	ca.jwtKey = jwtKey
+}
+
+// X509Bundle returns a copy of the X.509 bundle of the trust domain.
+func (ca *CA) X509Bundle() *x509bundle.Bundle {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	return ca.x509Bundle.Clone()
+}
+
+// JWTBundle returns a copy of the JWT bundle of the trust domain.
+func (ca *CA) JWTBundle() *jwtbundle.Bundle {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	return ca.jwtBundle.Clone()
+}
+
+// CreateX509SVID mints an X.509-SVID for the given SPIFFE ID, valid for ttl.
+// It returns an error wrapping ErrForeignID if id is not in the CA's trust
+// domain.
+func (ca *CA) CreateX509SVID(id spiffeid.ID, ttl time.Duration) (*x509svid.SVID, error) {
+	if !id.MemberOf(ca.trustDomain) {
+		return nil, fmt.Errorf("%w: %q is not a member of trust domain %q", ErrForeignID, id, ca.trustDomain)
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: ca.nextSerial(),
+		URIs:         []*url.URL{id.URL()},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := createCertificate(tmpl, ca.x509Cert, key.Public(), ca.x509Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509svid.SVID{
+		ID:           id,
+		Certificates: []*x509.Certificate{cert},
+		PrivateKey:   key,
+	}, nil
+}
+
+// CreateJWTSVID mints a JWT-SVID for the given SPIFFE ID and audience, valid
+// for ttl. It returns an error wrapping ErrForeignID if id is not in the CA's
+// trust domain.
+func (ca *CA) CreateJWTSVID(id spiffeid.ID, audience []string, ttl time.Duration) (*jwtsvid.SVID, error) {
+	if !id.MemberOf(ca.trustDomain) {
+		return nil, fmt.Errorf("%w: %q is not a member of trust domain %q", ErrForeignID, id, ca.trustDomain)
+	}
+
+	ca.mu.RLock()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: ca.jwtKey, KeyID: ca.jwtKeyID}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	ca.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWT signer: %w", err)
+	}
+
+	now := time.Now()
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject:  id.String(),
+		Audience: audience,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+	}).Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign JWT-SVID: %w", err)
+	}
+
+	svid, err := jwtsvid.ParseInsecure(token, audience)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse minted JWT-SVID: %w", err)
+	}
+	return svid, nil
+}
+
+func createCertificate(tmpl, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) (*x509.Certificate, error) {
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// nextSerial returns a new certificate serial number. ca.mu must be held.
+func (ca *CA) nextSerial() *big.Int {
+	ca.serialCount++
+	return big.NewInt(ca.serialCount)
+}
+
+func newKey() (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+func newKeyID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate key ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
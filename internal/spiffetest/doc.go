@@ -0,0 +1,18 @@
+// Package spiffetest provides an in-process SPIFFE Workload API for hermetic
+// tests of the demo workloads.
+//
+// A CA mints X.509-SVIDs and JWT-SVIDs for a trust domain, and a WorkloadAPI
+// serves them over gRPC on a temporary unix socket. Point a workload at it by
+// setting SPIFFE_ENDPOINT_SOCKET to WorkloadAPI.Addr():
+//
+//	ca := spiffetest.NewCA(t, spiffeid.RequireTrustDomainFromString("example.org"))
+//	api := spiffetest.New(t, ca, spiffetest.WithIDs(spiffeid.RequireFromString("spiffe://example.org/client")))
+//	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+//
+// Rotation is driven explicitly: CA.Rotate replaces the signing authorities,
+// and WorkloadAPI.RotateSVIDs re-issues SVIDs and pushes updated bundles to
+// connected clients.
+//
+// StartWorkload runs a workload under test until the test completes, and
+// WaitReady waits for it to listen on an address from FreeAddr.
+package spiffetest
@@ -0,0 +1,261 @@
+package spiffetest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	otherOrg   = spiffeid.RequireTrustDomainFromString("other.org")
+	clientID   = spiffeid.RequireFromString("spiffe://example.org/client")
+	serverID   = spiffeid.RequireFromString("spiffe://example.org/server")
+)
+
+func newContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func newX509Source(t *testing.T, ctx context.Context, api *WorkloadAPI) *workloadapi.X509Source {
+	t.Helper()
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create X509Source: %v", err)
+	}
+	t.Cleanup(func() { _ = source.Close() })
+	return source
+}
+
+func newClient(t *testing.T, ctx context.Context, api *WorkloadAPI) *workloadapi.Client {
+	t.Helper()
+	client, err := workloadapi.New(ctx, workloadapi.WithAddr(api.Addr()))
+	if err != nil {
+		t.Fatalf("failed to create workload API client: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// waitForUpdate waits for source to receive an update from the Workload API.
+func waitForUpdate(t *testing.T, ctx context.Context, source *workloadapi.X509Source) {
+	t.Helper()
+	select {
+	case <-source.Updated():
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for X509Source update")
+	}
+}
+
+func TestX509SVID(t *testing.T) {
+	ctx := newContext(t)
+	ca := NewCA(t, exampleOrg)
+	source := newX509Source(t, ctx, New(t, ca, WithIDs(clientID)))
+
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("GetX509SVID() error = %v", err)
+	}
+	if svid.ID != clientID {
+		t.Errorf("SVID ID = %q, want %q", svid.ID, clientID)
+	}
+	if _, _, err := x509svid.Verify(svid.Certificates, source); err != nil {
+		t.Errorf("SVID does not verify against the served bundle: %v", err)
+	}
+}
+
+func TestJWTSVID(t *testing.T) {
+	ctx := newContext(t)
+	ca := NewCA(t, exampleOrg)
+	client := newClient(t, ctx, New(t, ca, WithIDs(clientID)))
+
+	svid, err := client.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "server"})
+	if err != nil {
+		t.Fatalf("FetchJWTSVID() error = %v", err)
+	}
+	if svid.ID != clientID {
+		t.Errorf("JWT-SVID ID = %q, want %q", svid.ID, clientID)
+	}
+	if _, err := jwtsvid.ParseAndValidate(svid.Marshal(), ca.JWTBundle(), []string{"server"}); err != nil {
+		t.Errorf("JWT-SVID does not validate against the CA's bundle: %v", err)
+	}
+
+	validated, err := client.ValidateJWTSVID(ctx, svid.Marshal(), "server")
+	if err != nil {
+		t.Fatalf("ValidateJWTSVID() error = %v", err)
+	}
+	if validated.ID != clientID {
+		t.Errorf("validated ID = %q, want %q", validated.ID, clientID)
+	}
+	if _, err := client.ValidateJWTSVID(ctx, svid.Marshal(), "other"); err == nil {
+		t.Error("ValidateJWTSVID() accepted a JWT-SVID for another audience")
+	}
+}
+
+func TestFetchJWTSVIDForUnissuedID(t *testing.T) {
+	ctx := newContext(t)
+	client := newClient(t, ctx, New(t, NewCA(t, exampleOrg), WithIDs(clientID)))
+
+	_, err := client.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "server", Subject: serverID})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("FetchJWTSVID() error = %v, want code %s", err, codes.PermissionDenied)
+	}
+}
+
+func TestCreateSVIDOutsideTrustDomain(t *testing.T) {
+	ca := NewCA(t, exampleOrg)
+	foreign := spiffeid.RequireFromString("spiffe://other.org/client")
+
+	if _, err := ca.CreateX509SVID(foreign, time.Hour); !errors.Is(err, ErrForeignID) {
+		t.Errorf("CreateX509SVID() error = %v, want ErrForeignID", err)
+	}
+	_, err := ca.CreateJWTSVID(foreign, []string{"server"}, time.Hour)
+	if !errors.Is(err, ErrForeignID) {
+		t.Errorf("CreateJWTSVID() error = %v, want ErrForeignID", err)
+	}
+	if code := status.Code(statusFromError(err)); code != codes.InvalidArgument {
+		t.Errorf("status code = %s, want %s", code, codes.InvalidArgument)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ctx := newContext(t)
+	ca := NewCA(t, exampleOrg)
+	api := New(t, ca, WithIDs(clientID))
+	source := newX509Source(t, ctx, api)
+	before, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("GetX509SVID() error = %v", err)
+	}
+
+	ca.Rotate()
+	api.RotateSVIDs()
+	waitForUpdate(t, ctx, source)
+
+	after, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("GetX509SVID() error = %v", err)
+	}
+	if after.Certificates[0].SerialNumber.Cmp(before.Certificates[0].SerialNumber) == 0 {
+		t.Error("SVID was not re-issued")
+	}
+	bundle, err := source.GetX509BundleForTrustDomain(exampleOrg)
+	if err != nil {
+		t.Fatalf("GetX509BundleForTrustDomain() error = %v", err)
+	}
+	if n := len(bundle.X509Authorities()); n != 2 {
+		t.Errorf("bundle has %d authorities after rotation, want 2", n)
+	}
+	for name, svid := range map[string]*x509svid.SVID{"old": before, "new": after} {
+		if _, _, err := x509svid.Verify(svid.Certificates, source); err != nil {
+			t.Errorf("%s SVID does not verify after rotation: %v", name, err)
+		}
+	}
+}
+
+func TestSetIDs(t *testing.T) {
+	ctx := newContext(t)
+	api := New(t, NewCA(t, exampleOrg), WithIDs(clientID))
+	source := newX509Source(t, ctx, api)
+
+	api.SetIDs(serverID)
+	waitForUpdate(t, ctx, source)
+
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("GetX509SVID() error = %v", err)
+	}
+	if svid.ID != serverID {
+		t.Errorf("SVID ID = %q, want %q", svid.ID, serverID)
+	}
+}
+
+func TestFederatedCAs(t *testing.T) {
+	ctx := newContext(t)
+	ca := NewCA(t, exampleOrg)
+	other := NewCA(t, otherOrg)
+	api := New(t, ca, WithIDs(clientID))
+	source := newX509Source(t, ctx, api)
+
+	if _, err := source.GetX509BundleForTrustDomain(otherOrg); err == nil {
+		t.Fatal("source has a bundle for other.org before federation")
+	}
+
+	api.SetFederatedCAs(other)
+	waitForUpdate(t, ctx, source)
+
+	if _, err := source.GetX509BundleForTrustDomain(otherOrg); err != nil {
+		t.Fatalf("source has no bundle for other.org after federation: %v", err)
+	}
+	otherSVID, err := other.CreateX509SVID(spiffeid.RequireFromString("spiffe://other.org/server"), time.Hour)
+	if err != nil {
+		t.Fatalf("CreateX509SVID() error = %v", err)
+	}
+	if _, _, err := x509svid.Verify(otherSVID.Certificates, source); err != nil {
+		t.Errorf("federated SVID does not verify: %v", err)
+	}
+
+	client := newClient(t, ctx, api)
+	jwtSVID, err := other.CreateJWTSVID(spiffeid.RequireFromString("spiffe://other.org/server"), []string{"client"}, time.Minute)
+	if err != nil {
+		t.Fatalf("CreateJWTSVID() error = %v", err)
+	}
+	if _, err := client.ValidateJWTSVID(ctx, jwtSVID.Marshal(), "client"); err != nil {
+		t.Errorf("federated JWT-SVID does not validate: %v", err)
+	}
+}
+
+func TestX509SVIDTTL(t *testing.T) {
+	ctx := newContext(t)
+	source := newX509Source(t, ctx, New(t, NewCA(t, exampleOrg), WithIDs(clientID), WithX509SVIDTTL(10*time.Minute)))
+
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("GetX509SVID() error = %v", err)
+	}
+	if remaining := time.Until(svid.Certificates[0].NotAfter); remaining > 10*time.Minute || remaining < 9*time.Minute {
+		t.Errorf("SVID expires in %s, want about 10m", remaining)
+	}
+}
+
+func TestStartWorkload(t *testing.T) {
+	addr := FreeAddr(t)
+	done := StartWorkload(t, func(ctx context.Context) error {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: http.NotFoundHandler()}
+		go func() {
+			<-ctx.Done()
+			_ = server.Close()
+		}()
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+	WaitReady(t, addr, done)
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,70 @@
+package spiffetest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// readyTimeout bounds how long WaitReady waits for a workload to listen.
+const readyTimeout = 10 * time.Second
+
+// FreeAddr returns a local TCP address that nothing is listening on, for a
+// workload under test to listen on.
+func FreeAddr(tb testing.TB) string {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+// StartWorkload calls run in a new goroutine with a context that is cancelled
+// when the test completes. The test fails if run returns an error. The
+// returned channel is closed when run returns.
+func StartWorkload(tb testing.TB, run func(ctx context.Context) error) <-chan struct{} {
+	tb.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		err = run(ctx)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		<-done
+		if err != nil {
+			tb.Errorf("workload exited with error: %v", err)
+		}
+	})
+	return done
+}
+
+// WaitReady waits until addr accepts TCP connections. It fails the test if
+// done, as returned by StartWorkload, is closed first or the address is not
+// listening within a few seconds.
+func WaitReady(tb testing.TB, addr string, done <-chan struct{}) {
+	tb.Helper()
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		select {
+		case <-done:
+			tb.Fatalf("workload exited before listening on %s", addr)
+		default:
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("workload did not start listening on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,424 @@
+package spiffetest
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	defaultX509SVIDTTL = time.Hour
+	defaultJWTSVIDTTL  = 5 * time.Minute
+)
+
+var errNoIdentity = status.Error(codes.PermissionDenied, "no identity issued")
+
+// WorkloadAPI is an in-process SPIFFE Workload API served over gRPC on a
+// temporary unix socket. It issues SVIDs from a CA for a configurable set of
+// SPIFFE IDs and streams updates to connected clients whenever the SVIDs or
+// bundles change.
+type WorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+
+	tb          testing.TB
+	ca          *CA
+	addr        string
+	dir         string
+	server      *grpc.Server
+	wg          sync.WaitGroup
+	x509SVIDTTL time.Duration
+	jwtSVIDTTL  time.Duration
+
+	mu             sync.Mutex
+	ids            []spiffeid.ID
+	federated      []*CA
+	x509SVIDs      []*x509svid.SVID
+	x509Subs       subscribers
+	x509BundleSubs subscribers
+	jwtBundleSubs  subscribers
+}
+
+// Option configures a WorkloadAPI.
+type Option func(*WorkloadAPI)
+
+// WithIDs sets the SPIFFE IDs the workload is entitled to. The first ID is
+// the default identity used by go-spiffe sources.
+func WithIDs(ids ...spiffeid.ID) Option {
+	return func(w *WorkloadAPI) {
+		w.ids = ids
+	}
+}
+
+// WithFederatedCAs includes the bundles of the given CAs as federated bundles.
+func WithFederatedCAs(cas ...*CA) Option {
+	return func(w *WorkloadAPI) {
+		w.federated = cas
+	}
+}
+
+// WithX509SVIDTTL sets the lifetime of issued X.509-SVIDs.
+func WithX509SVIDTTL(ttl time.Duration) Option {
+	return func(w *WorkloadAPI) {
+		w.x509SVIDTTL = ttl
+	}
+}
+
+// WithJWTSVIDTTL sets the lifetime of issued JWT-SVIDs.
+func WithJWTSVIDTTL(ttl time.Duration) Option {
+	return func(w *WorkloadAPI) {
+		w.jwtSVIDTTL = ttl
+	}
+}
+
+// New starts a Workload API backed by ca. The server is stopped when the test
+// completes.
+func New(tb testing.TB, ca *CA, opts ...Option) *WorkloadAPI {
+	tb.Helper()
+	w := &WorkloadAPI{
+		tb:          tb,
+		ca:          ca,
+		x509SVIDTTL: defaultX509SVIDTTL,
+		jwtSVIDTTL:  defaultJWTSVIDTTL,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.x509SVIDs = w.mintX509SVIDs(w.ids)
+
+	// Unix socket paths are limited in length, so avoid the potentially long
+	// per-test temporary directory.
+	dir, err := os.MkdirTemp("", "spiffetest")
+	if err != nil {
+		tb.Fatalf("failed to create socket directory: %v", err)
+	}
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		tb.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+
+	w.dir = dir
+	w.addr = "unix://" + socketPath
+	w.server = grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(w.server, w)
+
+	w.wg.Go(func() {
+		_ = w.server.Serve(listener)
+	})
+	tb.Cleanup(w.Stop)
+	return w
+}
+
+// Addr returns the address of the Workload API, suitable for use as
+// SPIFFE_ENDPOINT_SOCKET or with workloadapi.WithAddr.
+func (w *WorkloadAPI) Addr() string {
+	return w.addr
+}
+
+// Stop stops the server and removes the socket. It is safe to call more than
+// once.
+func (w *WorkloadAPI) Stop() {
+	w.server.Stop()
+	w.wg.Wait()
+	_ = os.RemoveAll(w.dir)
+}
+
+// SetIDs replaces the SPIFFE IDs the workload is entitled to and pushes newly
+// minted X.509-SVIDs to connected clients.
+func (w *WorkloadAPI) SetIDs(ids ...spiffeid.ID) {
+	w.tb.Helper()
+	svids := w.mintX509SVIDs(ids)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ids = ids
+	w.x509SVIDs = svids
+	w.x509Subs.notify()
+}
+
+// RotateSVIDs mints new X.509-SVIDs from the CA's current authority and pushes
+// them, together with the current bundles, to connected clients. Call it after
+// CA.Rotate to distribute the new authority.
+func (w *WorkloadAPI) RotateSVIDs() {
+	w.tb.Helper()
+	w.mu.Lock()
+	ids := w.ids
+	w.mu.Unlock()
+
+	svids := w.mintX509SVIDs(ids)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.x509SVIDs = svids
+	w.x509Subs.notify()
+	w.x509BundleSubs.notify()
+	w.jwtBundleSubs.notify()
+}
+
+// SetFederatedCAs replaces the set of federated trust domains and pushes the
+// updated bundles to connected clients.
+func (w *WorkloadAPI) SetFederatedCAs(cas ...*CA) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.federated = cas
+	w.x509Subs.notify()
+	w.x509BundleSubs.notify()
+	w.jwtBundleSubs.notify()
+}
+
+// FetchX509SVID implements the Workload API.
+func (w *WorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream grpc.ServerStreamingServer[workload.X509SVIDResponse]) error {
+	return serveStream(stream.Context(), &w.mu, &w.x509Subs, w.x509SVIDResponse, stream.Send)
+}
+
+// FetchX509Bundles implements the Workload API.
+func (w *WorkloadAPI) FetchX509Bundles(_ *workload.X509BundlesRequest, stream grpc.ServerStreamingServer[workload.X509BundlesResponse]) error {
+	return serveStream(stream.Context(), &w.mu, &w.x509BundleSubs, w.x509BundlesResponse, stream.Send)
+}
+
+// FetchJWTBundles implements the Workload API.
+func (w *WorkloadAPI) FetchJWTBundles(_ *workload.JWTBundlesRequest, stream grpc.ServerStreamingServer[workload.JWTBundlesResponse]) error {
+	return serveStream(stream.Context(), &w.mu, &w.jwtBundleSubs, w.jwtBundlesResponse, stream.Send)
+}
+
+// FetchJWTSVID implements the Workload API.
+func (w *WorkloadAPI) FetchJWTSVID(ctx context.Context, req *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
+	if err := checkHeader(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.Audience) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+
+	w.mu.Lock()
+	ids := w.ids
+	w.mu.Unlock()
+
+	resp := &workload.JWTSVIDResponse{}
+	for _, id := range ids {
+		if req.SpiffeId != "" && req.SpiffeId != id.String() {
+			continue
+		}
+		svid, err := w.ca.CreateJWTSVID(id, req.Audience, w.jwtSVIDTTL)
+		if err != nil {
+			return nil, statusFromError(err)
+		}
+		resp.Svids = append(resp.Svids, &workload.JWTSVID{
+			SpiffeId: id.String(),
+			Svid:     svid.Marshal(),
+		})
+	}
+	if len(resp.Svids) == 0 {
+		return nil, errNoIdentity
+	}
+	return resp, nil
+}
+
+// ValidateJWTSVID implements the Workload API, validating the JWT-SVID against
+// the bundles of the CA and any federated CAs.
+func (w *WorkloadAPI) ValidateJWTSVID(ctx context.Context, req *workload.ValidateJWTSVIDRequest) (*workload.ValidateJWTSVIDResponse, error) {
+	if err := checkHeader(ctx); err != nil {
+		return nil, err
+	}
+	if req.Audience == "" {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+	if req.Svid == "" {
+		return nil, status.Error(codes.InvalidArgument, "svid must be specified")
+	}
+
+	bundles := jwtbundle.NewSet(w.ca.JWTBundle())
+	w.mu.Lock()
+	for _, ca := range w.federated {
+		bundles.Add(ca.JWTBundle())
+	}
+	w.mu.Unlock()
+
+	svid, err := jwtsvid.ParseAndValidate(req.Svid, bundles, []string{req.Audience})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	claims, err := structpb.NewStruct(svid.Claims)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &workload.ValidateJWTSVIDResponse{
+		SpiffeId: svid.ID.String(),
+		Claims:   claims,
+	}, nil
+}
+
+// mintX509SVIDs mints an X.509-SVID for each of ids, failing the test if any
+// cannot be minted. It must be called from the test's goroutine.
+func (w *WorkloadAPI) mintX509SVIDs(ids []spiffeid.ID) []*x509svid.SVID {
+	w.tb.Helper()
+	svids := make([]*x509svid.SVID, 0, len(ids))
+	for _, id := range ids {
+		svid, err := w.ca.CreateX509SVID(id, w.x509SVIDTTL)
+		if err != nil {
+			w.tb.Fatalf("failed to mint X.509-SVID: %v", err)
+		}
+		svids = append(svids, svid)
+	}
+	return svids
+}
+
+// statusFromError converts an error minting an SVID into a gRPC status, so that
+// a request the CA cannot serve fails the RPC rather than the test.
+func statusFromError(err error) error {
+	if errors.Is(err, ErrForeignID) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// x509SVIDResponse builds the current X.509-SVID response. w.mu must be held.
+func (w *WorkloadAPI) x509SVIDResponse() (*workload.X509SVIDResponse, error) {
+	if len(w.x509SVIDs) == 0 {
+		return nil, errNoIdentity
+	}
+	bundle := concatRawCerts(w.ca.X509Bundle().X509Authorities())
+	resp := &workload.X509SVIDResponse{
+		FederatedBundles: make(map[string][]byte),
+	}
+	for _, svid := range w.x509SVIDs {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Svids = append(resp.Svids, &workload.X509SVID{
+			SpiffeId:    svid.ID.String(),
+			X509Svid:    concatRawCerts(svid.Certificates),
+			X509SvidKey: keyDER,
+			Bundle:      bundle,
+		})
+	}
+	for _, ca := range w.federated {
+		resp.FederatedBundles[ca.TrustDomain().IDString()] = concatRawCerts(ca.X509Bundle().X509Authorities())
+	}
+	return resp, nil
+}
+
+// x509BundlesResponse builds the current X.509 bundles response. w.mu must be
+// held.
+func (w *WorkloadAPI) x509BundlesResponse() (*workload.X509BundlesResponse, error) {
+	resp := &workload.X509BundlesResponse{
+		Bundles: make(map[string][]byte),
+	}
+	for _, ca := range append([]*CA{w.ca}, w.federated...) {
+		resp.Bundles[ca.TrustDomain().IDString()] = concatRawCerts(ca.X509Bundle().X509Authorities())
+	}
+	return resp, nil
+}
+
+// jwtBundlesResponse builds the current JWT bundles response. w.mu must be
+// held.
+func (w *WorkloadAPI) jwtBundlesResponse() (*workload.JWTBundlesResponse, error) {
+	resp := &workload.JWTBundlesResponse{
+		Bundles: make(map[string][]byte),
+	}
+	for _, ca := range append([]*CA{w.ca}, w.federated...) {
+		jwks, err := ca.JWTBundle().Marshal()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Bundles[ca.TrustDomain().IDString()] = jwks
+	}
+	return resp, nil
+}
+
+// serveStream sends the current response on a streaming RPC, then sends a new
+// response each time subs is notified until the client goes away.
+func serveStream[T any](ctx context.Context, mu *sync.Mutex, subs *subscribers, build func() (*T, error), send func(*T) error) error {
+	if err := checkHeader(ctx); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	ch := subs.add()
+	resp, err := build()
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		subs.remove(ch)
+		mu.Unlock()
+	}()
+
+	for {
+		if err != nil {
+			return err
+		}
+		if err := send(resp); err != nil {
+			return err
+		}
+		select {
+		case <-ch:
+			mu.Lock()
+			resp, err = build()
+			mu.Unlock()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// subscribers is a set of channels notified of updates. Notifications are
+// coalesced, so a slow subscriber only sees the latest state.
+type subscribers map[chan struct{}]struct{}
+
+func (s *subscribers) add() chan struct{} {
+	if *s == nil {
+		*s = make(subscribers)
+	}
+	ch := make(chan struct{}, 1)
+	(*s)[ch] = struct{}{}
+	return ch
+}
+
+func (s *subscribers) remove(ch chan struct{}) {
+	delete(*s, ch)
+}
+
+func (s *subscribers) notify() {
+	for ch := range *s {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// checkHeader enforces the security header required by the Workload API spec.
+func checkHeader(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md["workload.spiffe.io"]) != 1 || md["workload.spiffe.io"][0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	return nil
+}
+
+func concatRawCerts(certs []*x509.Certificate) []byte {
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	return raw
+}
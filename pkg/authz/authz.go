@@ -0,0 +1,121 @@
+// Package authz decides which peers a workload accepts by their SPIFFE ID.
+//
+// Peers are matched against SPIFFE ID patterns, each one of:
+//   - a SPIFFE ID, e.g. spiffe://example.org/client, matching that ID;
+//   - a SPIFFE ID ending in /*, e.g. spiffe://example.org/ns/demo/*, matching
+//     IDs below that path;
+//   - a trust domain ID, e.g. spiffe://example.org, matching any member of the
+//     trust domain.
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// ErrUnauthorized is wrapped by the errors of Policy.Match, so that callers
+// can tell a rejected peer apart from other handshake failures.
+var ErrUnauthorized = errors.New("SPIFFE ID not authorized")
+
+// SplitList splits a comma-separated list, as read from an environment
+// variable, ignoring surrounding spaces and empty entries.
+func SplitList(s string) []string {
+	var items []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// TrustDomainPatterns returns the patterns matching the members of the named
+// trust domains, such as "spiffe://example.org" for "example.org".
+func TrustDomainPatterns(names []string) ([]string, error) {
+	var patterns []string
+	for _, name := range names {
+		td, err := spiffeid.TrustDomainFromString(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust domain %q: %w", name, err)
+		}
+		patterns = append(patterns, td.IDString())
+	}
+	return patterns, nil
+}
+
+// ParsePatterns parses SPIFFE ID patterns into matchers.
+func ParsePatterns(patterns []string) ([]spiffeid.Matcher, error) {
+	var matchers []spiffeid.Matcher
+	for _, pattern := range patterns {
+		prefix, isPrefix := strings.CutSuffix(pattern, "/*")
+		id, err := spiffeid.FromString(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE ID pattern %q: %w", pattern, err)
+		}
+		switch {
+		case id.Path() == "":
+			matchers = append(matchers, spiffeid.MatchMemberOf(id.TrustDomain()))
+		case isPrefix:
+			matchers = append(matchers, matchPathPrefix(id))
+		default:
+			matchers = append(matchers, spiffeid.MatchID(id))
+		}
+	}
+	return matchers, nil
+}
+
+// matchPathPrefix matches IDs in the trust domain of prefix whose path lies
+// below the path of prefix.
+func matchPathPrefix(prefix spiffeid.ID) spiffeid.Matcher {
+	return func(id spiffeid.ID) error {
+		if id.TrustDomain() != prefix.TrustDomain() || !strings.HasPrefix(id.Path(), prefix.Path()+"/") {
+			return fmt.Errorf("unexpected ID %q", id)
+		}
+		return nil
+	}
+}
+
+// MatchesAny reports whether id matches any of matchers.
+func MatchesAny(matchers []spiffeid.Matcher, id spiffeid.ID) bool {
+	return slices.ContainsFunc(matchers, func(m spiffeid.Matcher) bool { return m(id) == nil })
+}
+
+// Policy authorizes the SPIFFE IDs that match any of its patterns. A policy
+// without patterns authorizes nothing.
+type Policy struct {
+	patterns []string
+	matchers []spiffeid.Matcher
+}
+
+// NewPolicy returns a policy authorizing the SPIFFE IDs that match any of
+// patterns.
+func NewPolicy(patterns []string) (*Policy, error) {
+	matchers, err := ParsePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &Policy{patterns: patterns, matchers: matchers}, nil
+}
+
+// Empty reports whether the policy has no patterns.
+func (p *Policy) Empty() bool {
+	return len(p.matchers) == 0
+}
+
+// Match returns nil if the policy authorizes id, and an error wrapping
+// ErrUnauthorized otherwise. It is a spiffeid.Matcher.
+func (p *Policy) Match(id spiffeid.ID) error {
+	if MatchesAny(p.matchers, id) {
+		return nil
+	}
+	return fmt.Errorf("%w: %q does not match %s", ErrUnauthorized, id, p)
+}
+
+// String lists the policy's patterns, for logging.
+func (p *Policy) String() string {
+	return strings.Join(p.patterns, ",")
+}
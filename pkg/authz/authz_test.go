@@ -0,0 +1,86 @@
+package authz
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestPolicyMatch(t *testing.T) {
+	policy, err := NewPolicy([]string{
+		"spiffe://example.org/client",
+		"spiffe://example.org/ns/demo/*",
+		"spiffe://partner.org",
+	})
+	if err != nil {
+		t.Fatalf("NewPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"spiffe://example.org/client", true},
+		{"spiffe://example.org/client/sub", false},
+		{"spiffe://example.org/clientX", false},
+		{"spiffe://example.org/ns/demo/sa/client", true},
+		{"spiffe://example.org/ns/demo", false},
+		{"spiffe://example.org/ns/demoX/sa/client", false},
+		{"spiffe://other.org/ns/demo/sa/client", false},
+		{"spiffe://partner.org/anything", true},
+		{"spiffe://partner.org.evil/anything", false},
+		{"spiffe://example.org", false},
+	}
+	for _, tt := range tests {
+		err := policy.Match(spiffeid.RequireFromString(tt.id))
+		if got := err == nil; got != tt.want {
+			t.Errorf("Match(%s) = %v, want authorized %v", tt.id, err, tt.want)
+		}
+		if err != nil && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("Match(%s) error = %v, want %v", tt.id, err, ErrUnauthorized)
+		}
+	}
+}
+
+func TestEmptyPolicyAuthorizesNothing(t *testing.T) {
+	policy, err := NewPolicy(nil)
+	if err != nil {
+		t.Fatalf("NewPolicy() error = %v", err)
+	}
+	if !policy.Empty() {
+		t.Error("Empty() = false for a policy without patterns")
+	}
+	if err := policy.Match(spiffeid.RequireFromString("spiffe://example.org/client")); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Match() error = %v, want %v", err, ErrUnauthorized)
+	}
+}
+
+func TestParsePatternsRejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"example.org", "spiffe://", "spiffe://example.org/a/../b", "spiffe://Example.org/*"} {
+		if _, err := ParsePatterns([]string{pattern}); err == nil {
+			t.Errorf("ParsePatterns(%q) succeeded", pattern)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := SplitList(" a, ,b ,, c ")
+	if want := []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("SplitList() = %q, want %q", got, want)
+	}
+}
+
+func TestTrustDomainPatterns(t *testing.T) {
+	got, err := TrustDomainPatterns([]string{"example.org", "partner.org"})
+	if err != nil {
+		t.Fatalf("TrustDomainPatterns() error = %v", err)
+	}
+	if want := []string{"spiffe://example.org", "spiffe://partner.org"}; !slices.Equal(got, want) {
+		t.Errorf("TrustDomainPatterns() = %q, want %q", got, want)
+	}
+	if _, err := TrustDomainPatterns([]string{"not a domain"}); err == nil {
+		t.Error("TrustDomainPatterns() accepted an invalid trust domain")
+	}
+}
@@ -0,0 +1,87 @@
+// Package graceful shuts the demo workloads down cleanly when Kubernetes stops
+// them.
+//
+// NotifyContext returns a context that is cancelled by SIGTERM or SIGINT, and
+// Serve stops an HTTP server when that context is cancelled, letting in-flight
+// requests finish for up to ShutdownTimeout before closing their connections.
+// Kubernetes waits 30 seconds by default between SIGTERM and SIGKILL, which
+// leaves time for the rest of the workload's cleanup after the drain.
+package graceful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ShutdownTimeout bounds how long Serve waits for in-flight requests to finish.
+const ShutdownTimeout = 10 * time.Second
+
+// NotifyContext returns a copy of parent that is cancelled when the process
+// receives SIGTERM or SIGINT. Once the context is cancelled the signals regain
+// their default behaviour, so a second Ctrl-C kills a workload that is slow to
+// stop. The returned stop function releases the signal handler.
+func NotifyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// Server is the subset of *http.Server used by Serve. It is also satisfied by
+// the Cofide SDK's server.
+type Server interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// Serve calls serve, which must block serving requests on server, until ctx is
+// cancelled or serve fails. On cancellation it shuts server down, waiting up to
+// ShutdownTimeout for in-flight requests before closing their connections. It
+// returns nil if the server was stopped by ctx, and the error from serve or
+// Shutdown otherwise.
+func Serve(ctx context.Context, server Server, serve func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server", "timeout", ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		_ = server.Close()
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+	slog.Info("Server stopped")
+	return nil
+}
+
+// Sleep waits for d, returning false early if ctx is cancelled first. It lets
+// client loops stop promptly on shutdown.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,131 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stuckServer is a Server whose in-flight requests never finish, so Shutdown
+// waits until its context expires.
+type stuckServer struct {
+	stop     chan struct{}
+	deadline time.Time
+	closed   bool
+}
+
+func (s *stuckServer) serve() error {
+	<-s.stop
+	return http.ErrServerClosed
+}
+
+func (s *stuckServer) Shutdown(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.deadline, _ = ctx.Deadline()
+	// Report the timeout straight away rather than waiting for it.
+	return context.DeadlineExceeded
+}
+
+func (s *stuckServer) Close() error {
+	s.closed = true
+	close(s.stop)
+	return nil
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, server, func() error { return server.Serve(l) }) }()
+
+	resp := make(chan error, 1)
+	go func() {
+		r, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			_ = r.Body.Close()
+			if r.StatusCode != http.StatusOK {
+				err = errors.New(r.Status)
+			}
+		}
+		resp <- err
+	}()
+	<-started
+
+	// Serve waits for the in-flight request before returning.
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("Serve() returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-resp; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve() error = %v, want nil after cancellation", err)
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	server := &stuckServer{stop: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	err := Serve(ctx, server, server.serve)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Serve() error = %v, want a shutdown timeout", err)
+	}
+	// Shutdown is not passed the cancelled context, but one that allows
+	// in-flight requests ShutdownTimeout to finish.
+	if d := server.deadline.Sub(start); d < ShutdownTimeout-time.Second || d > ShutdownTimeout+time.Second {
+		t.Errorf("Shutdown deadline is %v after cancellation, want %v", d, ShutdownTimeout)
+	}
+	if !server.closed {
+		t.Error("Serve() did not close the server after the shutdown timed out")
+	}
+}
+
+func TestServeReturnsServeError(t *testing.T) {
+	server := &stuckServer{stop: make(chan struct{})}
+	want := errors.New("address in use")
+	if err := Serve(context.Background(), server, func() error { return want }); !errors.Is(err, want) {
+		t.Errorf("Serve() error = %v, want %v", err, want)
+	}
+	if err := Serve(context.Background(), server, func() error { return http.ErrServerClosed }); err != nil {
+		t.Errorf("Serve() error = %v, want nil for a closed server", err)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if !Sleep(context.Background(), time.Millisecond) {
+		t.Error("Sleep() = false, want true once the duration has passed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if Sleep(ctx, time.Minute) {
+		t.Error("Sleep() = true, want false when cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Sleep() returned %v after cancellation, want promptly", elapsed)
+	}
+}
@@ -0,0 +1,328 @@
+// Package health serves the liveness and readiness endpoints probed by
+// Kubernetes.
+//
+// A workload registers named checks with a Checker and serves them on a plain
+// HTTP port, separate from its own listener so that the kubelet can probe
+// workloads that require mTLS or a bearer token. /healthz runs the liveness
+// checks, such as the stream of SVID updates not having stalled, and /readyz
+// the readiness checks, such as having an SVID that is not about to expire. Readiness also
+// fails until the workload reports that it has started, so that a pod waiting
+// for its first SVID is not sent traffic.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+
+	// checkTimeout bounds the checks run by each request to the health
+	// endpoints. The deploy manifests set a probe timeout of five seconds to
+	// allow for it.
+	checkTimeout = 4 * time.Second
+)
+
+// Config configures the health endpoints.
+type Config struct {
+	// Port is the address the health endpoints are served on.
+	Port string
+	// SVIDExpiryMargin is how long before its X.509-SVID expires a workload
+	// stops being ready, so that Kubernetes is told about a stalled rotation
+	// before the expiry causes an outage.
+	SVIDExpiryMargin time.Duration
+}
+
+// ConfigFromEnv reads the health configuration from the HEALTH_PORT and
+// SVID_EXPIRY_MARGIN environment variables.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Port: ":8081", SVIDExpiryMargin: 5 * time.Minute}
+	if v, ok := os.LookupEnv("HEALTH_PORT"); ok {
+		cfg.Port = v
+	}
+	if v, ok := os.LookupEnv("SVID_EXPIRY_MARGIN"); ok {
+		margin, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SVID_EXPIRY_MARGIN %q: %w", v, err)
+		}
+		if margin < 0 {
+			return cfg, fmt.Errorf("SVID_EXPIRY_MARGIN must not be negative")
+		}
+		cfg.SVIDExpiryMargin = margin
+	}
+	return cfg, nil
+}
+
+// Check reports a problem with the workload, or nil if there is none.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds a workload's liveness and readiness checks. Checks may be
+// added while the endpoints are being served, as the workload's dependencies
+// become available.
+type Checker struct {
+	started atomic.Bool
+
+	mu        sync.RWMutex
+	liveness  []namedCheck
+	readiness []namedCheck
+	// failing holds the names of the checks that failed when last run, so
+	// that only changes are logged.
+	failing map[string]bool
+}
+
+// NewChecker returns a Checker with no checks, which is not ready until
+// MarkStarted is called.
+func NewChecker() *Checker {
+	return &Checker{failing: map[string]bool{}}
+}
+
+// AddLivenessCheck adds a check run by /healthz. A failing liveness check
+// causes Kubernetes to restart the container.
+func (c *Checker) AddLivenessCheck(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness = append(c.liveness, namedCheck{name, check})
+}
+
+// AddReadinessCheck adds a check run by /readyz. A failing readiness check
+// removes the pod from its services' endpoints.
+func (c *Checker) AddReadinessCheck(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness = append(c.readiness, namedCheck{name, check})
+}
+
+// MarkStarted reports that the workload has finished starting, after which
+// it is ready if its readiness checks pass.
+func (c *Checker) MarkStarted() {
+	if !c.started.Swap(true) {
+		slog.Info("Workload started")
+	}
+}
+
+// Handle registers the health endpoints on mux.
+func (c *Checker) Handle(mux *http.ServeMux) {
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, "healthz", c.checks(false))
+	})
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, "readyz", c.checks(true))
+	})
+}
+
+// Serve serves the health endpoints on addr until ctx is cancelled.
+func (c *Checker) Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	c.Handle(mux)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("Serving health endpoints", "port", addr)
+	return graceful.Serve(ctx, server, server.ListenAndServe)
+}
+
+// Run serves the health endpoints on addr in the background until ctx is
+// cancelled, logging any error.
+func (c *Checker) Run(ctx context.Context, addr string) {
+	go func() {
+		if err := c.Serve(ctx, addr); err != nil {
+			slog.Error("Error serving health endpoints", "error", err)
+		}
+	}()
+}
+
+func (c *Checker) checks(readiness bool) []namedCheck {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !readiness {
+		return c.liveness
+	}
+	checks := []namedCheck{{"startup", func(context.Context) error {
+		if !c.started.Load() {
+			return errors.New("workload is starting")
+		}
+		return nil
+	}}}
+	return append(checks, c.readiness...)
+}
+
+// serve runs checks and writes a line per check in the style of the
+// Kubernetes API server's health endpoints, with status 503 if any failed.
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, endpoint string, checks []namedCheck) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	var b strings.Builder
+	healthy := true
+	for _, nc := range checks {
+		err := nc.check(ctx)
+		c.logChange(endpoint, nc.name, err)
+		if err != nil {
+			healthy = false
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", nc.name, err)
+		} else {
+			fmt.Fprintf(&b, "[+]%s ok\n", nc.name)
+		}
+	}
+
+	status := http.StatusOK
+	if healthy {
+		fmt.Fprintf(&b, "%s check passed\n", endpoint)
+	} else {
+		status = http.StatusServiceUnavailable
+		fmt.Fprintf(&b, "%s check failed\n", endpoint)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// logChange logs when a check starts or stops failing, rather than on every
+// probe.
+func (c *Checker) logChange(endpoint, name string, err error) {
+	key := endpoint + "/" + name
+	c.mu.Lock()
+	wasFailing := c.failing[key]
+	c.failing[key] = err != nil
+	c.mu.Unlock()
+
+	switch {
+	case err != nil && !wasFailing:
+		slog.Warn("Health check failing", "endpoint", endpoint, "check", name, "error", err)
+	case err == nil && wasFailing:
+		slog.Info("Health check recovered", "endpoint", endpoint, "check", name)
+	}
+}
+
+// X509SVIDCheck fails if source has no X.509-SVID, or if it expires within
+// margin.
+func X509SVIDCheck(source x509svid.Source, margin time.Duration) Check {
+	return func(context.Context) error {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			return fmt.Errorf("no X.509-SVID: %w", err)
+		}
+		if len(svid.Certificates) == 0 {
+			return errors.New("X.509-SVID has no certificates")
+		}
+		return checkExpiry("X.509-SVID", svid.Certificates[0].NotAfter, margin)
+	}
+}
+
+// JWTSVIDCheck fails if fetch does not return an unexpired JWT-SVID. JWT-SVIDs
+// are short-lived and fetched on demand, so fetch should return the workload's
+// cached SVID if it has one.
+func JWTSVIDCheck(fetch func(context.Context) (*jwtsvid.SVID, error)) Check {
+	return func(ctx context.Context) error {
+		svid, err := fetch(ctx)
+		if err != nil {
+			return fmt.Errorf("no JWT-SVID: %w", err)
+		}
+		return checkExpiry("JWT-SVID", svid.Expiry, 0)
+	}
+}
+
+func checkExpiry(kind string, notAfter time.Time, margin time.Duration) error {
+	remaining := time.Until(notAfter)
+	switch {
+	case remaining <= 0:
+		return fmt.Errorf("%s expired at %s", kind, notAfter.Format(time.RFC3339))
+	case remaining < margin:
+		return fmt.Errorf("%s expires at %s, within %s", kind, notAfter.Format(time.RFC3339), margin)
+	}
+	return nil
+}
+
+// HTTPCheck fails if url cannot be reached, or answers with a server error.
+// Any other response shows that the service is reachable, since the request
+// carries no credentials.
+func HTTPCheck(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s unreachable: %w", url, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// stallSlack is the fraction of an X.509-SVID's lifetime that SVIDUpdates
+// waits past the rotation threshold before reporting the stream as stalled,
+// so that the rotation watchdog reports an overdue SVID first.
+const stallSlack = 0.1
+
+// SVIDUpdates detects a stalled stream of X.509-SVID updates from the
+// Workload API. SPIRE agents push a new SVID halfway through the current one's
+// lifetime, so a stream that has delivered nothing for most of an SVID
+// lifetime has stopped, and restarting the workload reconnects it before the
+// SVID expires.
+type SVIDUpdates struct {
+	source x509svid.Source
+	// stallAfter is the fraction of the SVID lifetime without an update
+	// after which the stream is stalled.
+	stallAfter float64
+	last       atomic.Int64
+}
+
+// NewSVIDUpdates returns an SVIDUpdates for the X.509-SVIDs of source, which
+// has just been updated. rotationThreshold is the fraction of an SVID's
+// lifetime after which it is overdue for rotation, as in svidwatch.Config; the
+// stream is reported stalled a little after that, and before the SVID
+// expires.
+func NewSVIDUpdates(source x509svid.Source, rotationThreshold float64) *SVIDUpdates {
+	u := &SVIDUpdates{source: source, stallAfter: min(rotationThreshold+stallSlack, 1)}
+	u.Updated()
+	return u
+}
+
+// Updated records that the source has received an update.
+func (u *SVIDUpdates) Updated() {
+	u.last.Store(time.Now().UnixNano())
+}
+
+// Check fails if no update has been received for longer than the stall
+// fraction of the current X.509-SVID's lifetime.
+func (u *SVIDUpdates) Check(context.Context) error {
+	svid, err := u.source.GetX509SVID()
+	if err != nil || len(svid.Certificates) == 0 {
+		// The x509-svid readiness check reports a missing SVID.
+		return nil
+	}
+	cert := svid.Certificates[0]
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	limit := time.Duration(u.stallAfter * float64(lifetime))
+	if since := time.Since(time.Unix(0, u.last.Load())); since > limit {
+		return fmt.Errorf("no X.509-SVID update for %s, longer than %.0f%% of the SVID lifetime of %s", since.Round(time.Second), u.stallAfter*100, lifetime.Round(time.Second))
+	}
+	return nil
+}
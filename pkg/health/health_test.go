@@ -0,0 +1,199 @@
+package health
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// fakeSource returns a fixed X.509-SVID, or err.
+type fakeSource struct {
+	svid *x509svid.SVID
+	err  error
+}
+
+func (s fakeSource) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, s.err
+}
+
+// sourceValidFor returns a source with an X.509-SVID issued an hour before
+// now and expiring after ttl.
+func sourceValidFor(ttl time.Duration) fakeSource {
+	now := time.Now()
+	cert := &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(ttl)}
+	return fakeSource{svid: &x509svid.SVID{Certificates: []*x509.Certificate{cert}}}
+}
+
+func get(t *testing.T, c *Checker, path string) (int, string) {
+	t.Helper()
+	mux := http.NewServeMux()
+	c.Handle(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestChecker(t *testing.T) {
+	c := NewChecker()
+	var livenessErr, readinessErr error
+	c.AddLivenessCheck("alive", func(context.Context) error { return livenessErr })
+	c.AddReadinessCheck("ready", func(context.Context) error { return readinessErr })
+
+	// Readiness fails until the workload has started; liveness does not wait.
+	if status, body := get(t, c, ReadinessPath); status != http.StatusServiceUnavailable || !strings.Contains(body, "[-]startup failed: workload is starting\n") {
+		t.Errorf("GET %s before start = %d %q, want 503 with a failed startup check", ReadinessPath, status, body)
+	}
+	if status, body := get(t, c, LivenessPath); status != http.StatusOK || body != "[+]alive ok\nhealthz check passed\n" {
+		t.Errorf("GET %s = %d %q, want 200 with the liveness check", LivenessPath, status, body)
+	}
+
+	c.MarkStarted()
+	if status, body := get(t, c, ReadinessPath); status != http.StatusOK || body != "[+]startup ok\n[+]ready ok\nreadyz check passed\n" {
+		t.Errorf("GET %s = %d %q, want 200 with both checks", ReadinessPath, status, body)
+	}
+
+	// A failing check fails only its own endpoint.
+	readinessErr = errors.New("not ready")
+	if status, body := get(t, c, ReadinessPath); status != http.StatusServiceUnavailable || body != "[+]startup ok\n[-]ready failed: not ready\nreadyz check failed\n" {
+		t.Errorf("GET %s = %d %q, want 503 with the failed check", ReadinessPath, status, body)
+	}
+	if status, _ := get(t, c, LivenessPath); status != http.StatusOK {
+		t.Errorf("GET %s = %d with a failing readiness check, want 200", LivenessPath, status)
+	}
+
+	livenessErr = errors.New("stalled")
+	if status, body := get(t, c, LivenessPath); status != http.StatusServiceUnavailable || !strings.Contains(body, "[-]alive failed: stalled\n") {
+		t.Errorf("GET %s = %d %q, want 503 with the failed check", LivenessPath, status, body)
+	}
+
+	// Checks added later are run too.
+	readinessErr = nil
+	c.AddReadinessCheck("later", func(context.Context) error { return errors.New("late failure") })
+	if status, body := get(t, c, ReadinessPath); status != http.StatusServiceUnavailable || !strings.Contains(body, "[-]later failed: late failure\n") {
+		t.Errorf("GET %s = %d %q, want 503 with the added check", ReadinessPath, status, body)
+	}
+}
+
+func TestX509SVIDCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  fakeSource
+		wantErr string
+	}{
+		{"valid", sourceValidFor(time.Hour), ""},
+		{"no SVID", fakeSource{err: errors.New("no SVID")}, "no X.509-SVID"},
+		{"no certificates", fakeSource{svid: &x509svid.SVID{}}, "has no certificates"},
+		{"within margin", sourceValidFor(time.Minute), "within 5m0s"},
+		{"expired", sourceValidFor(-time.Minute), "expired at"},
+	}
+	for _, tt := range tests {
+		err := X509SVIDCheck(tt.source, 5*time.Minute)(context.Background())
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: X509SVIDCheck() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJWTSVIDCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		svid    *jwtsvid.SVID
+		err     error
+		wantErr string
+	}{
+		{"valid", &jwtsvid.SVID{Expiry: time.Now().Add(time.Minute)}, nil, ""},
+		{"fetch error", nil, errors.New("unavailable"), "no JWT-SVID: unavailable"},
+		{"expired", &jwtsvid.SVID{Expiry: time.Now().Add(-time.Minute)}, nil, "expired at"},
+	}
+	for _, tt := range tests {
+		check := JWTSVIDCheck(func(context.Context) (*jwtsvid.SVID, error) { return tt.svid, tt.err })
+		err := check(context.Background())
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: JWTSVIDCheck() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		// An unauthenticated request may be refused, but shows the service
+		// is up.
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		err := HTTPCheck(server.Client(), server.URL)(context.Background())
+		server.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("HTTPCheck() of a server answering %d error = %v, want error %v", tt.status, err, tt.wantErr)
+		}
+	}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+	if err := HTTPCheck(http.DefaultClient, url)(context.Background()); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("HTTPCheck() of a closed server error = %v, want unreachable", err)
+	}
+}
+
+func TestSVIDUpdates(t *testing.T) {
+	// An SVID with a lifetime of 100 minutes stalls after 90 minutes without
+	// an update with the default rotation threshold.
+	now := time.Now()
+	cert := &x509.Certificate{NotBefore: now, NotAfter: now.Add(100 * time.Minute)}
+	source := fakeSource{svid: &x509svid.SVID{Certificates: []*x509.Certificate{cert}}}
+
+	tests := []struct {
+		name      string
+		threshold float64
+		since     time.Duration
+		wantErr   bool
+	}{
+		{"just updated", 0.8, 0, false},
+		{"past rotation threshold", 0.8, 85 * time.Minute, false},
+		{"past threshold and slack", 0.8, 91 * time.Minute, true},
+		{"lower threshold", 0.5, 61 * time.Minute, true},
+		{"slack capped at lifetime", 1, 99 * time.Minute, false},
+		{"past lifetime", 1, 101 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		u := NewSVIDUpdates(source, tt.threshold)
+		u.last.Store(time.Now().Add(-tt.since).UnixNano())
+		if err := u.Check(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Check() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// An update resets the stall timer.
+	u := NewSVIDUpdates(source, 0.8)
+	u.last.Store(time.Now().Add(-95 * time.Minute).UnixNano())
+	u.Updated()
+	if err := u.Check(context.Background()); err != nil {
+		t.Errorf("Check() after an update error = %v", err)
+	}
+
+	// A missing SVID is left to the x509-svid readiness check.
+	u = NewSVIDUpdates(fakeSource{err: errors.New("no SVID")}, 0.8)
+	u.last.Store(time.Now().Add(-24 * time.Hour).UnixNano())
+	if err := u.Check(context.Background()); err != nil {
+		t.Errorf("Check() without an SVID error = %v, want nil", err)
+	}
+}
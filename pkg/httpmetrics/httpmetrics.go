@@ -0,0 +1,62 @@
+// Package httpmetrics records the duration and status code of the requests
+// served by a ping-pong server, labelled consistently across workloads.
+//
+// Requests are labelled with the name of the server that handled them, the
+// pattern of the ServeMux route that matched, rather than the raw path so that
+// scanners cannot create unbounded label values, and the response status code.
+package httpmetrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "request_duration_seconds",
+		Help:    "The duration of requests, by server, path and response status code",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"server", "path", "code"})
+	responsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "responses_total",
+		Help: "The total number of responses, by server, path and status code",
+	}, []string{"server", "path", "code"})
+)
+
+// Handler records the duration and status code of each request to next, served
+// by the named server, once next has written its response. If onResponse is
+// not nil, it is also called with each response's status code, so that
+// workloads can keep metrics of their own.
+func Handler(server string, next http.Handler, onResponse func(status int)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		code := strconv.Itoa(rec.status)
+		requestDuration.WithLabelValues(server, r.Pattern, code).Observe(time.Since(start).Seconds())
+		responsesTotal.WithLabelValues(server, r.Pattern, code).Inc()
+		if onResponse != nil {
+			onResponse(rec.status)
+		}
+	})
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,40 @@
+package httpmetrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandler(t *testing.T) {
+	var statuses []int
+	onResponse := func(status int) { statuses = append(statuses, status) }
+	mux := http.NewServeMux()
+	mux.Handle("/", Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("...pong"))
+	}), onResponse))
+	mux.Handle("/forbidden", Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}), onResponse))
+
+	tests := []struct {
+		path, pattern, code string
+	}{
+		{"/", "/", "200"},
+		{"/anything", "/", "200"},
+		{"/forbidden", "/forbidden", "403"},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(responsesTotal.WithLabelValues("test", tt.pattern, tt.code))
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got := testutil.ToFloat64(responsesTotal.WithLabelValues("test", tt.pattern, tt.code)) - before; got != 1 {
+			t.Errorf("GET %s: responses_total{path=%q,code=%q} increased by %v, want 1", tt.path, tt.pattern, tt.code, got)
+		}
+	}
+	if want := []int{200, 200, 403}; !slices.Equal(statuses, want) {
+		t.Errorf("onResponse statuses = %v, want %v", statuses, want)
+	}
+}
@@ -0,0 +1,321 @@
+// Package loadgen drives a ping-pong client at a configured request rate and
+// concurrency instead of its usual periodic ping, recording request latencies
+// as Prometheus metrics and summarising them when the run ends.
+package loadgen
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "load_request_duration_seconds",
+		Help:    "Duration of load generation requests, by result",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"result"})
+	requestLatency = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "load_request_latency_seconds",
+		Help:       "p50, p95 and p99 latency of load generation requests, by result",
+		Objectives: map[float64]float64{0.5: 0.05, 0.95: 0.01, 0.99: 0.001},
+		MaxAge:     time.Minute,
+	}, []string{"result"})
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "load_requests_in_flight",
+		Help: "The number of load generation requests in flight",
+	})
+)
+
+// Config configures a load generation run.
+type Config struct {
+	// Enabled replaces the client's periodic ping with a load generation run.
+	Enabled bool
+	// RPS is the target request rate across all workers. Zero sends requests
+	// as fast as the workers complete them.
+	RPS float64
+	// Concurrency is the number of requests in flight at once.
+	Concurrency int
+	// Duration ends the run after this long. Zero runs until Requests have
+	// been sent or the client is stopped.
+	Duration time.Duration
+	// Requests ends the run after this many requests. Zero is unlimited.
+	Requests int
+	// PayloadSize is the size in bytes of a random body sent with each
+	// request. Requests have no body if zero.
+	PayloadSize int
+	// NewConnections opens a new connection for every request, so that each
+	// measurement includes connection setup and any TLS handshake.
+	NewConnections bool
+}
+
+// ConfigFromEnv reads the load generation configuration from LOAD_*
+// environment variables.
+func ConfigFromEnv() (Config, error) {
+	var cfg Config
+	var err error
+	if cfg.Enabled, err = parseEnv("LOAD_ENABLED", false, strconv.ParseBool); err != nil {
+		return cfg, err
+	}
+	if cfg.RPS, err = parseEnv("LOAD_RPS", 0, func(v string) (float64, error) { return strconv.ParseFloat(v, 64) }); err != nil {
+		return cfg, err
+	}
+	if cfg.Concurrency, err = parseEnv("LOAD_CONCURRENCY", 1, strconv.Atoi); err != nil {
+		return cfg, err
+	}
+	if cfg.Duration, err = parseEnv("LOAD_DURATION", 0, time.ParseDuration); err != nil {
+		return cfg, err
+	}
+	if cfg.Requests, err = parseEnv("LOAD_REQUESTS", 0, strconv.Atoi); err != nil {
+		return cfg, err
+	}
+	if cfg.PayloadSize, err = parseEnv("LOAD_PAYLOAD_SIZE", 0, strconv.Atoi); err != nil {
+		return cfg, err
+	}
+	if cfg.NewConnections, err = parseEnv("LOAD_NEW_CONNECTIONS", false, strconv.ParseBool); err != nil {
+		return cfg, err
+	}
+
+	switch {
+	case cfg.RPS < 0:
+		return cfg, fmt.Errorf("LOAD_RPS must not be negative")
+	case cfg.Concurrency < 1:
+		return cfg, fmt.Errorf("LOAD_CONCURRENCY must be at least 1")
+	case cfg.Duration < 0:
+		return cfg, fmt.Errorf("LOAD_DURATION must not be negative")
+	case cfg.Requests < 0:
+		return cfg, fmt.Errorf("LOAD_REQUESTS must not be negative")
+	case cfg.PayloadSize < 0:
+		return cfg, fmt.Errorf("LOAD_PAYLOAD_SIZE must not be negative")
+	}
+	return cfg, nil
+}
+
+func parseEnv[T any](variable string, defaultValue T, parse func(string) (T, error)) (T, error) {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue, nil
+	}
+	parsed, err := parse(v)
+	if err != nil {
+		return defaultValue, fmt.Errorf("invalid %s %q: %w", variable, v, err)
+	}
+	return parsed, nil
+}
+
+// ConfigureTransport sizes t's connection pool for the configured concurrency,
+// or disables connection reuse if NewConnections is set. The default pool keeps
+// only two idle connections per host, so that higher concurrency would
+// otherwise open new connections for most requests.
+func (c Config) ConfigureTransport(t *http.Transport) {
+	t.MaxIdleConnsPerHost = c.Concurrency
+	t.DisableKeepAlives = c.NewConnections
+}
+
+// RequestFunc sends a single request with the given body, which is nil if no
+// payload is configured.
+type RequestFunc func(ctx context.Context, payload []byte) error
+
+// Summary describes a completed load generation run. Latency percentiles are
+// of successful requests, accurate to about 2%.
+type Summary struct {
+	Requests int
+	Errors   int
+	Elapsed  time.Duration
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// Log writes the summary to the default logger.
+func (s *Summary) Log() {
+	var rps float64
+	if s.Elapsed > 0 {
+		rps = float64(s.Requests) / s.Elapsed.Seconds()
+	}
+	slog.Info("Load generation complete",
+		"requests", s.Requests,
+		"errors", s.Errors,
+		"elapsed", s.Elapsed.Round(time.Millisecond),
+		"rps", fmt.Sprintf("%.1f", rps),
+		"p50", s.P50,
+		"p95", s.P95,
+		"p99", s.P99,
+		"max", s.Max,
+	)
+}
+
+// Run sends requests with do according to cfg until the configured duration or
+// request count is reached or ctx is cancelled, and returns a summary of the
+// run. Requests in flight when the duration elapses are allowed to complete;
+// requests failing because ctx was cancelled are not counted.
+func Run(ctx context.Context, cfg Config, do RequestFunc) *Summary {
+	dispatchCtx := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		dispatchCtx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	var payload []byte
+	if cfg.PayloadSize > 0 {
+		payload = make([]byte, cfg.PayloadSize)
+		_, _ = rand.Read(payload)
+	}
+
+	slog.Info("Starting load generation", "rps", cfg.RPS, "concurrency", cfg.Concurrency, "duration", cfg.Duration, "requests", cfg.Requests, "payload_size", cfg.PayloadSize, "new_connections", cfg.NewConnections)
+	start := time.Now()
+	requests := dispatch(dispatchCtx, cfg)
+
+	var rec recorder
+	var wg sync.WaitGroup
+	for range cfg.Concurrency {
+		wg.Go(func() {
+			for range requests {
+				requestsInFlight.Inc()
+				reqStart := time.Now()
+				err := do(ctx, payload)
+				elapsed := time.Since(reqStart)
+				requestsInFlight.Dec()
+				if ctx.Err() != nil {
+					return
+				}
+				rec.record(elapsed, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	return rec.summary(time.Since(start))
+}
+
+// dispatch returns a channel yielding a value for each request to send, at
+// the configured rate. It is closed when the run should end.
+func dispatch(ctx context.Context, cfg Config) <-chan struct{} {
+	var limiter *rate.Limiter
+	if cfg.RPS > 0 {
+		limiter = rate.NewLimiter(rate.Limit(cfg.RPS), 1)
+	}
+	requests := make(chan struct{})
+	go func() {
+		defer close(requests)
+		for sent := 0; cfg.Requests == 0 || sent < cfg.Requests; sent++ {
+			if limiter != nil {
+				if err := limiter.Wait(ctx); err != nil {
+					return
+				}
+			}
+			select {
+			case requests <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return requests
+}
+
+// recorder accumulates request outcomes for metrics and the run summary.
+type recorder struct {
+	mu        sync.Mutex
+	errors    int
+	latencies latencyHistogram
+}
+
+func (r *recorder) record(elapsed time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+		slog.Debug("Load generation request failed", "error", err)
+	}
+	requestDuration.WithLabelValues(result).Observe(elapsed.Seconds())
+	requestLatency.WithLabelValues(result).Observe(elapsed.Seconds())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies.record(elapsed)
+}
+
+func (r *recorder) summary(elapsed time.Duration) *Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Summary{
+		Requests: r.latencies.total + r.errors,
+		Errors:   r.errors,
+		Elapsed:  elapsed,
+		P50:      r.latencies.percentile(0.5),
+		P95:      r.latencies.percentile(0.95),
+		P99:      r.latencies.percentile(0.99),
+		Max:      r.latencies.max,
+	}
+}
+
+const (
+	// latencyBucketGrowth is the ratio between the upper bounds of
+	// consecutive latency buckets, so percentiles are accurate to about 2%.
+	latencyBucketGrowth = 1.02
+	// latencyBuckets is the number of latency buckets, covering latencies
+	// from 1µs to several hours. Longer latencies share the last bucket.
+	latencyBuckets = 1200
+)
+
+// latencyHistogram counts latencies in exponentially sized buckets, so that
+// the summary of a run without a duration or request limit takes fixed memory.
+type latencyHistogram struct {
+	counts [latencyBuckets]int
+	total  int
+	max    time.Duration
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.counts[latencyBucket(d)]++
+	h.total++
+	h.max = max(h.max, d)
+}
+
+// percentile returns the nearest-rank percentile q, as the upper bound of the
+// bucket holding it, capped at the maximum latency recorded.
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := max(int(math.Ceil(q*float64(h.total))), 1)
+	seen := 0
+	for i, count := range h.counts {
+		if seen += count; seen >= rank {
+			return min(latencyBucketBound(i), h.max)
+		}
+	}
+	return h.max
+}
+
+// latencyBucket returns the index of the bucket holding d: the smallest i for
+// which d is at most latencyBucketBound(i).
+func latencyBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	return min(int(math.Ceil(math.Log(us)/math.Log(latencyBucketGrowth))), latencyBuckets-1)
+}
+
+// latencyBucketBound returns the upper bound of bucket i.
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(math.Pow(latencyBucketGrowth, float64(i)) * float64(time.Microsecond))
+}
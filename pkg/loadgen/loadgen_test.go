@@ -0,0 +1,187 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogramPercentile(t *testing.T) {
+	last := latencyBucketBound(latencyBuckets - 1)
+	tests := []struct {
+		name    string
+		latency time.Duration
+		want    time.Duration
+	}{
+		{"zero", 0, latencyBucketBound(0)},
+		{"first bucket bound", time.Microsecond, time.Microsecond},
+		{"just above first bucket", time.Microsecond + time.Nanosecond, latencyBucketBound(1)},
+		{"bucket 10 bound", latencyBucketBound(10), latencyBucketBound(10)},
+		{"just above bucket 10", latencyBucketBound(10) + time.Nanosecond, latencyBucketBound(11)},
+		{"bucket 500 bound", latencyBucketBound(500), latencyBucketBound(500)},
+		{"just above bucket 500", latencyBucketBound(500) + time.Nanosecond, latencyBucketBound(501)},
+		{"1ms", time.Millisecond, latencyBucketBound(latencyBucket(time.Millisecond))},
+		{"1s", time.Second, latencyBucketBound(latencyBucket(time.Second))},
+		{"last bucket bound", last, last},
+		{"beyond last bucket", 2 * last, last},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The slower latency keeps the maximum from capping the
+			// percentile.
+			var h latencyHistogram
+			h.record(tt.latency)
+			h.record(4 * last)
+			got := h.percentile(0.5)
+			if got != tt.want {
+				t.Errorf("percentile(0.5) = %v, want %v", got, tt.want)
+			}
+			// Within range, the reported latency is no less than the recorded
+			// one and at most 2% more.
+			if tt.latency <= last && (got < tt.latency || float64(got) > float64(max(tt.latency, time.Microsecond))*latencyBucketGrowth) {
+				t.Errorf("percentile(0.5) = %v, not within 2%% above %v", got, tt.latency)
+			}
+		})
+	}
+}
+
+func TestLatencyBucketBounds(t *testing.T) {
+	for i := range latencyBuckets {
+		bound := latencyBucketBound(i)
+		if got := latencyBucket(bound); got != i {
+			t.Errorf("latencyBucket(%v) = %d, want bucket %d whose bound it is", bound, got, i)
+		}
+		// Bounds are truncated to whole nanoseconds, so a nanosecond more may
+		// still lie in the same bucket, whose bound is then a nanosecond
+		// short of it.
+		if i < latencyBuckets-1 {
+			d := bound + time.Nanosecond
+			if b := latencyBucket(d); b < i || latencyBucketBound(b)+time.Nanosecond < d {
+				t.Errorf("latencyBucket(%v) = %d, with bound %v below it", d, b, latencyBucketBound(b))
+			}
+		}
+	}
+}
+
+func TestLatencyHistogramRanks(t *testing.T) {
+	var h latencyHistogram
+	if got := h.percentile(0.99); got != 0 {
+		t.Errorf("percentile(0.99) of an empty histogram = %v, want 0", got)
+	}
+	// 100 latencies of 1ms to 100ms: nearest-rank percentiles are the
+	// latencies at those ranks, reported as their bucket bounds.
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	for _, tt := range []struct {
+		q    float64
+		rank time.Duration
+	}{
+		{0.5, 50 * time.Millisecond},
+		{0.95, 95 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+	} {
+		want := min(latencyBucketBound(latencyBucket(tt.rank)), h.max)
+		if got := h.percentile(tt.q); got != want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.q, got, want)
+		}
+	}
+	if h.max != 100*time.Millisecond {
+		t.Errorf("max = %v, want 100ms", h.max)
+	}
+}
+
+// get returns a RequestFunc sending a GET request to url, failing on any
+// status other than 200.
+func get(url string) RequestFunc {
+	return func(ctx context.Context, _ []byte) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+func TestRun(t *testing.T) {
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// Every fifth request fails.
+		if received.Add(1)%5 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	const requests, rps = 20, 50.0
+	summary := Run(context.Background(), Config{RPS: rps, Concurrency: 4, Requests: requests}, get(server.URL))
+
+	if got := received.Load(); got != requests {
+		t.Errorf("server received %d requests, want %d", got, requests)
+	}
+	if summary.Requests != requests || summary.Errors != requests/5 {
+		t.Errorf("summary = %d requests, %d errors, want %d requests, %d errors", summary.Requests, summary.Errors, requests, requests/5)
+	}
+	// The limiter allows a burst of one, so the last request is sent after
+	// (requests-1)/rps.
+	if minElapsed := time.Duration(float64(requests-1) / rps * float64(time.Second)); summary.Elapsed < minElapsed*9/10 {
+		t.Errorf("Elapsed = %v, want at least %v at %v rps", summary.Elapsed, minElapsed, rps)
+	}
+	if rate := float64(summary.Requests) / summary.Elapsed.Seconds(); rate > rps*1.1 {
+		t.Errorf("achieved %.1f rps, want at most %v", rate, rps)
+	}
+}
+
+func TestRunConcurrency(t *testing.T) {
+	var inFlight, maxInFlight, sent atomic.Int64
+	do := func(context.Context, []byte) error {
+		sent.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+
+	summary := Run(context.Background(), Config{Concurrency: 3, Requests: 30}, do)
+	if summary.Requests != 30 || sent.Load() != 30 {
+		t.Errorf("summary.Requests = %d, sent %d, want 30", summary.Requests, sent.Load())
+	}
+	if got := maxInFlight.Load(); got != 3 {
+		t.Errorf("at most %d requests were in flight, want 3", got)
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	do := func(context.Context, []byte) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	summary := Run(context.Background(), Config{Concurrency: 2, Duration: 100 * time.Millisecond}, do)
+	// The timeout starts just before Run's clock, so the run may appear a
+	// little shorter.
+	if summary.Elapsed < 90*time.Millisecond || summary.Elapsed > time.Second {
+		t.Errorf("Elapsed = %v, want about 100ms", summary.Elapsed)
+	}
+	if summary.Requests == 0 {
+		t.Error("no requests were sent")
+	}
+}
@@ -0,0 +1,193 @@
+package svidwatch
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// BundlesPath is the path workloads expose the trust bundle debug endpoint on.
+const BundlesPath = "/debug/trust-bundles"
+
+// maxPeers is the number of peers recorded for the debug endpoint. Once it is
+// reached, the least recently verified peer is forgotten to make room for a
+// new one, so that a workload called by many short-lived peers does not grow
+// without bound.
+const maxPeers = 1000
+
+var verifiedPeers = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "verified_peers_total",
+	Help: "The total number of peer X.509-SVIDs verified, by the trust domain of the bundle and the fingerprint of the CA that verified them",
+}, []string{"trust_domain", "federated", "fingerprint"})
+
+// TrustBundles describes a workload's X.509 trust bundles and the peers they
+// have verified.
+type TrustBundles struct {
+	// TrustDomain is the workload's own trust domain.
+	TrustDomain  string        `json:"trust_domain,omitempty"`
+	Bundles      []TrustBundle `json:"bundles"`
+	Peers        []Peer        `json:"peers"`
+	LastUpdateAt time.Time     `json:"last_update_at,omitzero"`
+}
+
+// TrustBundle describes the X.509 bundle of a trust domain.
+type TrustBundle struct {
+	TrustDomain string `json:"trust_domain"`
+	// Federated is true if the bundle is for a trust domain other than the
+	// workload's own.
+	Federated   bool        `json:"federated"`
+	Authorities []Authority `json:"authorities"`
+}
+
+// Authority describes a CA certificate in a trust bundle.
+type Authority struct {
+	Subject     string    `json:"subject"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"sha256_fingerprint"`
+}
+
+// Peer describes the bundle that last verified a peer's X.509-SVID.
+type Peer struct {
+	SPIFFEID    string `json:"spiffe_id"`
+	TrustDomain string `json:"trust_domain"`
+	Federated   bool   `json:"federated"`
+	// Fingerprint is the SHA-256 fingerprint of the CA in the bundle that
+	// the peer's certificate chains to.
+	Fingerprint    string    `json:"ca_sha256_fingerprint"`
+	LastVerifiedAt time.Time `json:"last_verified_at"`
+}
+
+// fingerprint returns the hex-encoded SHA-256 fingerprint of cert.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func newAuthority(cert *x509.Certificate) Authority {
+	return Authority{
+		Subject:     cert.Subject.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Fingerprint: fingerprint(cert),
+	}
+}
+
+// ownTrustDomain returns the trust domain of the workload's X.509-SVID, or the
+// zero value if it has none.
+func (w *Watchdog) ownTrustDomain() spiffeid.TrustDomain {
+	svid, err := w.source.GetX509SVID()
+	if err != nil {
+		return spiffeid.TrustDomain{}
+	}
+	return svid.ID.TrustDomain()
+}
+
+// Authorizer wraps authorizer to record which trust bundle verified each peer
+// that it authorizes.
+func (w *Watchdog) Authorizer(authorizer tlsconfig.Authorizer) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		if err := authorizer(id, verifiedChains); err != nil {
+			return err
+		}
+		if len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+			chain := verifiedChains[0]
+			w.recordPeer(id, chain[len(chain)-1])
+		}
+		return nil
+	}
+}
+
+// recordPeer records that the X.509-SVID of id was verified by the trust
+// bundle authority ca, logging when a peer is first verified or is verified by
+// a different CA.
+func (w *Watchdog) recordPeer(id spiffeid.ID, ca *x509.Certificate) {
+	td := id.TrustDomain()
+	peer := Peer{
+		SPIFFEID:       id.String(),
+		TrustDomain:    td.Name(),
+		Federated:      td != w.ownTrustDomain(),
+		Fingerprint:    fingerprint(ca),
+		LastVerifiedAt: time.Now(),
+	}
+	verifiedPeers.WithLabelValues(peer.TrustDomain, strconv.FormatBool(peer.Federated), peer.Fingerprint).Inc()
+
+	w.mu.Lock()
+	previous, seen := w.peers[peer.SPIFFEID]
+	if !seen && len(w.peers) >= maxPeers {
+		w.evictOldestPeer()
+	}
+	w.peers[peer.SPIFFEID] = peer
+	w.mu.Unlock()
+
+	if !seen || previous.Fingerprint != peer.Fingerprint {
+		slog.Info("Peer verified by trust bundle", "peer.id", peer.SPIFFEID, "trust_domain", peer.TrustDomain, "federated", peer.Federated, "ca.subject", ca.Subject.String(), "ca.fingerprint", peer.Fingerprint)
+	}
+}
+
+// evictOldestPeer forgets the least recently verified peer. w.mu must be held.
+func (w *Watchdog) evictOldestPeer() {
+	var oldest string
+	var oldestAt time.Time
+	for id, peer := range w.peers {
+		if oldest == "" || peer.LastVerifiedAt.Before(oldestAt) {
+			oldest, oldestAt = id, peer.LastVerifiedAt
+		}
+	}
+	delete(w.peers, oldest)
+}
+
+// TrustBundles describes the most recently received trust bundles and the
+// peers they have verified.
+func (w *Watchdog) TrustBundles() *TrustBundles {
+	own := w.ownTrustDomain()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tb := &TrustBundles{
+		TrustDomain:  own.Name(),
+		Bundles:      []TrustBundle{},
+		Peers:        []Peer{},
+		LastUpdateAt: w.bundlesUpdatedAt,
+	}
+	if w.bundles != nil {
+		for _, bundle := range w.bundles.Bundles() {
+			b := TrustBundle{
+				TrustDomain: bundle.TrustDomain().Name(),
+				Federated:   bundle.TrustDomain() != own,
+				Authorities: []Authority{},
+			}
+			for _, cert := range bundle.X509Authorities() {
+				b.Authorities = append(b.Authorities, newAuthority(cert))
+			}
+			tb.Bundles = append(tb.Bundles, b)
+		}
+	}
+	for _, peer := range w.peers {
+		tb.Peers = append(tb.Peers, peer)
+	}
+	slices.SortFunc(tb.Bundles, func(a, b TrustBundle) int { return strings.Compare(a.TrustDomain, b.TrustDomain) })
+	slices.SortFunc(tb.Peers, func(a, b Peer) int { return strings.Compare(a.SPIFFEID, b.SPIFFEID) })
+	return tb
+}
+
+// BundlesHandler writes the workload's trust bundles and verified peers as
+// JSON. It is registered at BundlesPath.
+func (w *Watchdog) BundlesHandler(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(w.TrustBundles()); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
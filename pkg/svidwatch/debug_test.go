@@ -0,0 +1,150 @@
+package svidwatch
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+var federatedOrg = spiffeid.RequireTrustDomainFromString("federated.org")
+
+func TestBundlesHandler(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	federatedCA := spiffetest.NewCA(t, federatedOrg)
+	source := newSource(t, spiffetest.New(t, ca, spiffetest.WithIDs(workloadID)))
+	w := NewWatchdog(Config{RotationThreshold: 0.8}, source)
+
+	w.setBundles(x509bundle.NewSet(ca.X509Bundle(), federatedCA.X509Bundle()))
+	peer := spiffeid.RequireFromString("spiffe://federated.org/ns/demo/sa/peer")
+	root := federatedCA.X509Bundle().X509Authorities()[0]
+	w.recordPeer(peer, root)
+
+	rec := httptest.NewRecorder()
+	w.BundlesHandler(rec, httptest.NewRequest(http.MethodGet, BundlesPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var got TrustBundles
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if got.TrustDomain != exampleOrg.Name() {
+		t.Errorf("TrustDomain = %q, want %q", got.TrustDomain, exampleOrg.Name())
+	}
+	if got.LastUpdateAt.IsZero() {
+		t.Error("LastUpdateAt is zero after a bundle update")
+	}
+	// Bundles are sorted by trust domain.
+	want := []struct {
+		ca        *spiffetest.CA
+		federated bool
+	}{
+		{ca, false},
+		{federatedCA, true},
+	}
+	if len(got.Bundles) != len(want) {
+		t.Fatalf("Bundles = %+v, want %d bundles", got.Bundles, len(want))
+	}
+	for i, w := range want {
+		b := got.Bundles[i]
+		cert := w.ca.X509Bundle().X509Authorities()[0]
+		if b.TrustDomain != w.ca.TrustDomain().Name() || b.Federated != w.federated {
+			t.Errorf("Bundles[%d] = %+v, want trust domain %s, federated %v", i, b, w.ca.TrustDomain(), w.federated)
+		}
+		if len(b.Authorities) != 1 || b.Authorities[0].Fingerprint != fingerprint(cert) || !b.Authorities[0].NotAfter.Equal(cert.NotAfter) {
+			t.Errorf("Bundles[%d].Authorities = %+v, want the CA certificate with fingerprint %s", i, b.Authorities, fingerprint(cert))
+		}
+	}
+	if len(got.Peers) != 1 || got.Peers[0].SPIFFEID != peer.String() || !got.Peers[0].Federated || got.Peers[0].Fingerprint != fingerprint(root) {
+		t.Errorf("Peers = %+v, want federated peer %s verified by %s", got.Peers, peer, fingerprint(root))
+	}
+}
+
+func TestRecordAuthorities(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	federatedCA := spiffetest.NewCA(t, federatedOrg)
+
+	// value returns the expiry metric of the CA certificate cert of td.
+	value := func(td spiffeid.TrustDomain, cert *x509.Certificate) float64 {
+		return testutil.ToFloat64(trustBundleAuthority.WithLabelValues(td.Name(), cert.Subject.String(), fingerprint(cert)))
+	}
+
+	recordAuthorities(x509bundle.NewSet(ca.X509Bundle(), federatedCA.X509Bundle()))
+	if got := testutil.CollectAndCount(trustBundleAuthority); got != 2 {
+		t.Errorf("trust_bundle_authority_not_after has %d series, want 2", got)
+	}
+	old := ca.X509Bundle().X509Authorities()[0]
+	if got, want := value(exampleOrg, old), float64(old.NotAfter.Unix()); got != want {
+		t.Errorf("trust_bundle_authority_not_after = %v, want %v", got, want)
+	}
+
+	// After rotation the bundle holds both CAs, then only the new one once the
+	// old CA is removed; a removed CA's series goes with it.
+	ca.Rotate()
+	bundle := ca.X509Bundle()
+	recordAuthorities(x509bundle.NewSet(bundle))
+	if got := testutil.CollectAndCount(trustBundleAuthority); got != 2 {
+		t.Errorf("trust_bundle_authority_not_after has %d series after rotation, want 2", got)
+	}
+	bundle.RemoveX509Authority(old)
+	recordAuthorities(x509bundle.NewSet(bundle))
+	if got := testutil.CollectAndCount(trustBundleAuthority); got != 1 {
+		t.Errorf("trust_bundle_authority_not_after has %d series after removing the old CA, want 1", got)
+	}
+	current := bundle.X509Authorities()[0]
+	if got, want := value(exampleOrg, current), float64(current.NotAfter.Unix()); got != want {
+		t.Errorf("trust_bundle_authority_not_after = %v, want %v", got, want)
+	}
+}
+
+func TestRecordPeerEvictsOldest(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	source := newSource(t, spiffetest.New(t, ca, spiffetest.WithIDs(workloadID)))
+	w := NewWatchdog(Config{RotationThreshold: 0.8}, source)
+	root := ca.X509Bundle().X509Authorities()[0]
+
+	peerID := func(i int) spiffeid.ID {
+		return spiffeid.RequireFromString(fmt.Sprintf("spiffe://example.org/ns/demo/sa/peer-%d", i))
+	}
+	// Peers are verified in order, an hour ago.
+	start := time.Now().Add(-time.Hour)
+	for i := range maxPeers {
+		w.peers[peerID(i).String()] = Peer{SPIFFEID: peerID(i).String(), LastVerifiedAt: start.Add(time.Duration(i) * time.Second)}
+	}
+	// Verifying a known peer again refreshes it rather than evicting another.
+	w.recordPeer(peerID(0), root)
+	if got := len(w.TrustBundles().Peers); got != maxPeers {
+		t.Fatalf("len(Peers) = %d, want %d", got, maxPeers)
+	}
+
+	w.recordPeer(peerID(maxPeers), root)
+	peers := w.TrustBundles().Peers
+	if len(peers) != maxPeers {
+		t.Fatalf("len(Peers) = %d, want %d", len(peers), maxPeers)
+	}
+	seen := map[string]bool{}
+	for _, peer := range peers {
+		seen[peer.SPIFFEID] = true
+	}
+	for _, id := range []spiffeid.ID{peerID(0), peerID(maxPeers)} {
+		if !seen[id.String()] {
+			t.Errorf("Peers does not include %s", id)
+		}
+	}
+	if seen[peerID(1).String()] {
+		t.Errorf("Peers still includes the least recently verified peer %s", peerID(1))
+	}
+}
@@ -0,0 +1,253 @@
+// Package svidwatch watches a workload's X.509-SVID and trust bundles so that a
+// stalled rotation is noticed before a certificate expires.
+//
+// SPIRE agents renew X.509-SVIDs halfway through their lifetime, so an SVID
+// that has lived well past that point suggests that the agent cannot reach its
+// server or is not pushing updates. The Watchdog reports the fraction of the
+// current SVID's lifetime that has elapsed and flags the SVID as overdue for
+// rotation once it passes a threshold. It also records the trust domains and
+// CA expiries of the workload's trust bundles, whose rotation stalls in the
+// same way, and which bundle verified each peer, which it serves as JSON at
+// BundlesPath for debugging federation.
+package svidwatch
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	svidLifetimeElapsed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "svid_lifetime_elapsed_ratio",
+		Help: "The fraction of the current X.509-SVID's lifetime that has elapsed",
+	})
+	svidRotationOverdue = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "svid_rotation_overdue",
+		Help: "1 if the current X.509-SVID has passed the rotation threshold without being renewed, 0 otherwise",
+	})
+
+	trustBundles = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trust_bundles",
+		Help: "The number of trust domains in the workload's X.509 trust bundle set",
+	})
+	trustBundleAuthority = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trust_bundle_authority_not_after",
+		Help: "The timestamp when each CA in the workload's X.509 trust bundles expires, by trust domain, subject and SHA-256 fingerprint",
+	}, []string{"trust_domain", "subject", "fingerprint"})
+	trustBundleUpdates = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trust_bundle_updates_total",
+		Help: "The total number of changes to the workload's X.509 trust bundle set",
+	})
+)
+
+// CheckInterval is how often workloads should call CheckSVID between SVID
+// updates.
+const CheckInterval = 10 * time.Second
+
+// Config configures a Watchdog.
+type Config struct {
+	// RotationThreshold is the fraction of an X.509-SVID's lifetime after
+	// which it is overdue for rotation.
+	RotationThreshold float64
+	// FailReadiness makes the readiness check fail while rotation is overdue.
+	FailReadiness bool
+}
+
+// ConfigFromEnv reads the watchdog configuration from the
+// SVID_ROTATION_THRESHOLD and SVID_ROTATION_FAIL_READINESS environment
+// variables.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{RotationThreshold: 0.8}
+	if v, ok := os.LookupEnv("SVID_ROTATION_THRESHOLD"); ok {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SVID_ROTATION_THRESHOLD %q: %w", v, err)
+		}
+		if threshold <= 0 || threshold > 1 {
+			return cfg, fmt.Errorf("SVID_ROTATION_THRESHOLD must be greater than 0 and at most 1")
+		}
+		cfg.RotationThreshold = threshold
+	}
+	if v, ok := os.LookupEnv("SVID_ROTATION_FAIL_READINESS"); ok {
+		fail, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SVID_ROTATION_FAIL_READINESS %q: %w", v, err)
+		}
+		cfg.FailReadiness = fail
+	}
+	return cfg, nil
+}
+
+// Watchdog watches a workload's X.509-SVID and trust bundles.
+type Watchdog struct {
+	cfg    Config
+	source x509svid.Source
+
+	// overdue is the error reported by Check while rotation is overdue.
+	overdue atomic.Pointer[error]
+
+	mu sync.Mutex
+	// overdueSerial is the serial number of the SVID last reported overdue,
+	// so that each SVID is reported once.
+	overdueSerial    string
+	bundles          *x509bundle.Set
+	bundlesUpdatedAt time.Time
+	// peers holds up to maxPeers of the peers verified through Authorizer,
+	// by SPIFFE ID.
+	peers map[string]Peer
+}
+
+// NewWatchdog returns a Watchdog for the X.509-SVIDs of source.
+func NewWatchdog(cfg Config, source x509svid.Source) *Watchdog {
+	return &Watchdog{cfg: cfg, source: source, peers: map[string]Peer{}}
+}
+
+// CheckSVID records how much of the current X.509-SVID's lifetime has elapsed
+// at now, warning once for each SVID that passes the rotation threshold. It
+// should be called whenever the SVID changes, and periodically in between.
+func (w *Watchdog) CheckSVID(now time.Time) {
+	svid, err := w.source.GetX509SVID()
+	if err != nil || len(svid.Certificates) == 0 {
+		return
+	}
+	cert := svid.Certificates[0]
+	elapsed := lifetimeElapsed(cert, now)
+	svidLifetimeElapsed.Set(elapsed)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if elapsed < w.cfg.RotationThreshold {
+		if w.overdueSerial != "" {
+			slog.Info("X.509-SVID rotated after being overdue", "id", svid.ID, "not_after", cert.NotAfter)
+			w.overdueSerial = ""
+		}
+		svidRotationOverdue.Set(0)
+		w.overdue.Store(nil)
+		return
+	}
+
+	svidRotationOverdue.Set(1)
+	err = fmt.Errorf("X.509-SVID has passed %.0f%% of its lifetime without being renewed and expires at %s", w.cfg.RotationThreshold*100, cert.NotAfter.Format(time.RFC3339))
+	w.overdue.Store(&err)
+	if serial := cert.SerialNumber.String(); serial != w.overdueSerial {
+		w.overdueSerial = serial
+		slog.Warn("X.509-SVID rotation overdue, check the SPIRE agent", "id", svid.ID, "elapsed", fmt.Sprintf("%.0f%%", elapsed*100), "not_after", cert.NotAfter)
+	}
+}
+
+// lifetimeElapsed returns the fraction of cert's lifetime that has elapsed at
+// now, between 0 and 1.
+func lifetimeElapsed(cert *x509.Certificate, now time.Time) float64 {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime <= 0 {
+		return 1
+	}
+	return min(max(float64(now.Sub(cert.NotBefore))/float64(lifetime), 0), 1)
+}
+
+// Check fails while the X.509-SVID is overdue for rotation, if the watchdog is
+// configured to fail readiness. It is a health.Check.
+func (w *Watchdog) Check(context.Context) error {
+	if !w.cfg.FailReadiness {
+		return nil
+	}
+	if err := w.overdue.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// WatchBundles records the trust bundles streamed by client until ctx is
+// cancelled. The workload API client retries failed streams itself.
+func (w *Watchdog) WatchBundles(ctx context.Context, client *workloadapi.Client) {
+	err := client.WatchX509Bundles(ctx, bundleWatcher{ctx: ctx, w: w})
+	if err != nil && ctx.Err() == nil {
+		slog.Error("Stopped watching trust bundles", "error", err)
+	}
+}
+
+// setBundles records a new trust bundle set, logging the trust domains whose
+// bundles changed.
+func (w *Watchdog) setBundles(bundles *x509bundle.Set) {
+	w.mu.Lock()
+	previous := w.bundles
+	w.bundles = bundles
+	w.mu.Unlock()
+	if previous == nil {
+		previous = x509bundle.NewSet()
+	}
+
+	var changed []string
+	for _, bundle := range bundles.Bundles() {
+		td := bundle.TrustDomain()
+		if prev, ok := previous.Get(td); !ok || !prev.Equal(bundle) {
+			changed = append(changed, td.Name())
+		}
+	}
+	for _, bundle := range previous.Bundles() {
+		if td := bundle.TrustDomain(); !bundles.Has(td) {
+			changed = append(changed, td.Name())
+		}
+	}
+	trustBundles.Set(float64(bundles.Len()))
+	recordAuthorities(bundles)
+
+	if len(changed) == 0 {
+		return
+	}
+	w.mu.Lock()
+	w.bundlesUpdatedAt = time.Now()
+	w.mu.Unlock()
+	trustBundleUpdates.Inc()
+	slog.Info("Trust bundles updated", "changed", changed, "trust_domains", trustDomainNames(bundles))
+}
+
+// recordAuthorities replaces the per-CA metrics with the authorities of
+// bundles.
+func recordAuthorities(bundles *x509bundle.Set) {
+	trustBundleAuthority.Reset()
+	for _, bundle := range bundles.Bundles() {
+		for _, cert := range bundle.X509Authorities() {
+			trustBundleAuthority.WithLabelValues(bundle.TrustDomain().Name(), cert.Subject.String(), fingerprint(cert)).Set(float64(cert.NotAfter.Unix()))
+		}
+	}
+}
+
+func trustDomainNames(bundles *x509bundle.Set) []string {
+	var names []string
+	for _, bundle := range bundles.Bundles() {
+		names = append(names, bundle.TrustDomain().Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+// bundleWatcher adapts a Watchdog to workloadapi.X509BundleWatcher.
+type bundleWatcher struct {
+	ctx context.Context
+	w   *Watchdog
+}
+
+func (b bundleWatcher) OnX509BundlesUpdate(bundles *x509bundle.Set) {
+	b.w.setBundles(bundles)
+}
+
+func (b bundleWatcher) OnX509BundlesWatchError(err error) {
+	if b.ctx.Err() == nil {
+		slog.Warn("Error watching trust bundles", "error", err)
+	}
+}
@@ -0,0 +1,200 @@
+package svidwatch
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	workloadID = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/workload")
+)
+
+// newSource returns an X509Source for workloadID served by api.
+func newSource(t *testing.T, api *spiffetest.WorkloadAPI) *workloadapi.X509Source {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create X509Source: %v", err)
+	}
+	t.Cleanup(func() { _ = source.Close() })
+	return source
+}
+
+// currentCert returns the leaf certificate of the X.509-SVID from source.
+func currentCert(t *testing.T, source x509svid.Source) *x509.Certificate {
+	t.Helper()
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("GetX509SVID() error = %v", err)
+	}
+	return svid.Certificates[0]
+}
+
+// at returns the time when fraction of cert's lifetime has elapsed.
+func at(cert *x509.Certificate, fraction float64) time.Time {
+	return cert.NotBefore.Add(time.Duration(fraction * float64(cert.NotAfter.Sub(cert.NotBefore))))
+}
+
+func TestLifetimeElapsed(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(time.Hour)}
+	tests := []struct {
+		name string
+		now  time.Time
+		want float64
+	}{
+		{"before not before", notBefore.Add(-time.Minute), 0},
+		{"at not before", notBefore, 0},
+		{"halfway", notBefore.Add(30 * time.Minute), 0.5},
+		{"at not after", notBefore.Add(time.Hour), 1},
+		{"after not after", notBefore.Add(2 * time.Hour), 1},
+	}
+	for _, tt := range tests {
+		if got := lifetimeElapsed(cert, tt.now); got != tt.want {
+			t.Errorf("%s: lifetimeElapsed() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := lifetimeElapsed(&x509.Certificate{NotBefore: notBefore, NotAfter: notBefore}, notBefore); got != 1 {
+		t.Errorf("lifetimeElapsed() of a certificate with no lifetime = %v, want 1", got)
+	}
+}
+
+func TestCheckSVID(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	api := spiffetest.New(t, ca, spiffetest.WithIDs(workloadID), spiffetest.WithX509SVIDTTL(time.Hour))
+	source := newSource(t, api)
+	w := NewWatchdog(Config{RotationThreshold: 0.8, FailReadiness: true}, source)
+	cert := currentCert(t, source)
+
+	tests := []struct {
+		name    string
+		elapsed float64
+		overdue bool
+	}{
+		{"fresh", 0.1, false},
+		{"below threshold", 0.79, false},
+		{"at threshold", 0.8, true},
+		{"past threshold", 0.95, true},
+	}
+	for _, tt := range tests {
+		w.CheckSVID(at(cert, tt.elapsed))
+		if got := testutil.ToFloat64(svidLifetimeElapsed); got < tt.elapsed-0.001 || got > tt.elapsed+0.001 {
+			t.Errorf("%s: svid_lifetime_elapsed_ratio = %v, want %v", tt.name, got, tt.elapsed)
+		}
+		want := 0.0
+		if tt.overdue {
+			want = 1
+		}
+		if got := testutil.ToFloat64(svidRotationOverdue); got != want {
+			t.Errorf("%s: svid_rotation_overdue = %v, want %v", tt.name, got, want)
+		}
+		if err := w.Check(context.Background()); (err != nil) != tt.overdue {
+			t.Errorf("%s: Check() error = %v, want overdue %v", tt.name, err, tt.overdue)
+		}
+	}
+
+	// A new SVID clears the overdue state.
+	api.RotateSVIDs()
+	deadline := time.Now().Add(10 * time.Second)
+	for currentCert(t, source).SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("X509Source did not receive the rotated SVID")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.CheckSVID(at(currentCert(t, source), 0.1))
+	if got := testutil.ToFloat64(svidRotationOverdue); got != 0 {
+		t.Errorf("svid_rotation_overdue after rotation = %v, want 0", got)
+	}
+	if err := w.Check(context.Background()); err != nil {
+		t.Errorf("Check() after rotation error = %v", err)
+	}
+}
+
+func TestCheckPassesUnlessFailReadiness(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	source := newSource(t, spiffetest.New(t, ca, spiffetest.WithIDs(workloadID)))
+	w := NewWatchdog(Config{RotationThreshold: 0.5}, source)
+
+	w.CheckSVID(at(currentCert(t, source), 0.9))
+	if got := testutil.ToFloat64(svidRotationOverdue); got != 1 {
+		t.Errorf("svid_rotation_overdue = %v, want 1", got)
+	}
+	if err := w.Check(context.Background()); err != nil {
+		t.Errorf("Check() error = %v, want nil without FailReadiness", err)
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	federatedCA := spiffetest.NewCA(t, spiffeid.RequireTrustDomainFromString("federated.org"))
+	source := newSource(t, spiffetest.New(t, ca, spiffetest.WithIDs(workloadID)))
+	w := NewWatchdog(Config{RotationThreshold: 0.8}, source)
+
+	local := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/peer")
+	federated := spiffeid.RequireFromString("spiffe://federated.org/ns/demo/sa/peer")
+	denied := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/denied")
+	authorizer := w.Authorizer(tlsconfig.AuthorizeOneOf(local, federated))
+
+	// chain returns a verified chain for id, ending in the authority of ca.
+	chain := func(ca *spiffetest.CA, id spiffeid.ID) ([][]*x509.Certificate, *x509.Certificate) {
+		t.Helper()
+		svid, err := ca.CreateX509SVID(id, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create X.509-SVID: %v", err)
+		}
+		root := ca.X509Bundle().X509Authorities()[0]
+		return [][]*x509.Certificate{{svid.Certificates[0], root}}, root
+	}
+
+	tests := []struct {
+		name      string
+		ca        *spiffetest.CA
+		id        spiffeid.ID
+		federated string
+	}{
+		{"local", ca, local, "false"},
+		{"federated", federatedCA, federated, "true"},
+	}
+	for _, tt := range tests {
+		chains, root := chain(tt.ca, tt.id)
+		counter := verifiedPeers.WithLabelValues(tt.id.TrustDomain().Name(), tt.federated, fingerprint(root))
+		before := testutil.ToFloat64(counter)
+		if err := authorizer(tt.id, chains); err != nil {
+			t.Fatalf("%s: authorizer() error = %v", tt.name, err)
+		}
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s: verified_peers_total increased by %v, want 1", tt.name, got)
+		}
+	}
+
+	chains, _ := chain(ca, denied)
+	if err := authorizer(denied, chains); err == nil {
+		t.Errorf("authorizer() accepted %s", denied)
+	}
+
+	peers := w.TrustBundles().Peers
+	if len(peers) != 2 {
+		t.Fatalf("TrustBundles().Peers = %+v, want the two authorized peers", peers)
+	}
+	// Peers are sorted by SPIFFE ID.
+	if peers[0].SPIFFEID != local.String() || peers[0].Federated {
+		t.Errorf("Peers[0] = %+v, want local peer %s", peers[0], local)
+	}
+	if peers[1].SPIFFEID != federated.String() || !peers[1].Federated {
+		t.Errorf("Peers[1] = %+v, want federated peer %s", peers[1], federated)
+	}
+}
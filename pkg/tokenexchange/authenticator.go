@@ -0,0 +1,422 @@
+package tokenexchange
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ValidationLocal verifies JWT access tokens against the provider's JWKS.
+	ValidationLocal = "local"
+	// ValidationIntrospection asks the introspection endpoint about every
+	// token, supporting opaque tokens and immediate revocation.
+	ValidationIntrospection = "introspection"
+	// ValidationHybrid verifies JWT access tokens locally and confirms they
+	// are still active by introspection.
+	ValidationHybrid = "hybrid"
+)
+
+// Reasons a request fails authentication or authorization, reported in
+// Error.Reason.
+const (
+	ReasonMissingToken      = "missing_token"
+	ReasonMalformedToken    = "malformed_token"
+	ReasonBadSignature      = "bad_signature"
+	ReasonExpired           = "expired"
+	ReasonInvalidClaims     = "invalid_claims"
+	ReasonInactive          = "inactive"
+	ReasonWrongAudience     = "wrong_audience"
+	ReasonWrongSubject      = "wrong_subject"
+	ReasonMissingActor      = "missing_actor"
+	ReasonInvalidActor      = "invalid_actor"
+	ReasonInvalidDPoP       = "invalid_dpop"
+	ReasonPeerMismatch      = "peer_mismatch"
+	ReasonInsufficientScope = "insufficient_scope"
+	ReasonUnavailable       = "unavailable"
+)
+
+// Error is an authentication or authorization failure. Errors with status 401
+// or a Code are reported with an RFC 6750 or RFC 9449 WWW-Authenticate
+// challenge.
+type Error struct {
+	// Reason classifies the failure for metrics, one of the Reason constants.
+	// It is not sent to the client.
+	Reason      string
+	Status      int
+	Description string
+	// Code is the RFC 6750 §3.1 or RFC 9449 §7.1 error code, if any.
+	Code string
+	// Scope lists the scopes required for the request, for insufficient_scope
+	// errors.
+	Scope string
+	// Scheme is the authentication scheme of the challenge. Empty means Bearer.
+	Scheme string
+}
+
+func (e *Error) Error() string { return e.Description }
+
+// WithReason sets the reason of e and returns it.
+func (e *Error) WithReason(reason string) *Error {
+	e.Reason = reason
+	return e
+}
+
+// InvalidToken returns an RFC 6750 invalid_token error.
+func InvalidToken(description string) *Error {
+	return &Error{Status: http.StatusUnauthorized, Description: description, Code: "invalid_token"}
+}
+
+// dpopError returns a 401 error with a DPoP challenge.
+func dpopError(code, description string) *Error {
+	return &Error{Reason: ReasonInvalidDPoP, Status: http.StatusUnauthorized, Description: description, Code: code, Scheme: DPoPScheme}
+}
+
+// WriteError writes err as a plain text response, with a WWW-Authenticate
+// challenge for the given realm if err is an authentication or authorization
+// failure.
+func WriteError(w http.ResponseWriter, realm string, err *Error) {
+	if err.Status == http.StatusUnauthorized || err.Code != "" {
+		challenge := fmt.Sprintf("%s realm=%q", cmp.Or(err.Scheme, "Bearer"), realm)
+		if err.Scheme == DPoPScheme {
+			challenge += fmt.Sprintf(", algs=%q", strings.Join(signatureAlgNames(), " "))
+		}
+		if err.Code != "" {
+			challenge += fmt.Sprintf(", error=%q, error_description=%q", err.Code, err.Description)
+		}
+		if err.Scope != "" {
+			challenge += fmt.Sprintf(", scope=%q", err.Scope)
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	http.Error(w, err.Description, err.Status)
+}
+
+// AuthenticatorConfig configures an Authenticator.
+type AuthenticatorConfig struct {
+	// Provider is the OIDC provider that issues access tokens.
+	Provider *Provider
+	// Audience returns the audience that tokens must be issued for, usually
+	// the server's SPIFFE ID.
+	Audience func(ctx context.Context) (string, error)
+	// Validation is the token validation strategy. Empty means
+	// ValidationLocal.
+	Validation string
+	// JWKS fetches the provider's signing keys. Required unless Validation is
+	// ValidationIntrospection.
+	JWKS *JWKSFetcher
+	// Introspector queries the provider's introspection endpoint. Required
+	// unless Validation is ValidationLocal.
+	Introspector *Introspector
+	// RequireDPoP rejects tokens that are not DPoP-bound.
+	RequireDPoP bool
+	// Authorize, if set, authorizes the authenticated principal for the
+	// request.
+	Authorize func(r *http.Request, p *Principal) *Error
+	// Realm is advertised in WWW-Authenticate challenges.
+	Realm string
+	// OnAuthenticate, if set, is called with the outcome of each
+	// authentication, for example to record metrics. err is nil on success.
+	OnAuthenticate func(r *http.Request, err *Error)
+}
+
+// Authenticator validates the access tokens presented to a resource server.
+// Tokens bound to a DPoP key must be accompanied by a proof of possession,
+// and tokens received over mutual TLS must identify the TLS peer.
+type Authenticator struct {
+	config AuthenticatorConfig
+	dpop   *DPoPVerifier
+}
+
+// NewAuthenticator returns an Authenticator with the given configuration.
+func NewAuthenticator(config AuthenticatorConfig) (*Authenticator, error) {
+	config.Validation = cmp.Or(config.Validation, ValidationLocal)
+	switch {
+	case config.Provider == nil || config.Audience == nil:
+		return nil, errors.New("authenticator requires a provider and an audience")
+	case config.Validation != ValidationLocal && config.Validation != ValidationIntrospection && config.Validation != ValidationHybrid:
+		return nil, fmt.Errorf("unknown token validation strategy %q", config.Validation)
+	case config.Validation != ValidationIntrospection && config.JWKS == nil:
+		return nil, fmt.Errorf("%s token validation requires a JWKS fetcher", config.Validation)
+	case config.Validation != ValidationLocal && config.Introspector == nil:
+		return nil, fmt.Errorf("%s token validation requires an introspector", config.Validation)
+	}
+	return &Authenticator{config: config, dpop: NewDPoPVerifier()}, nil
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal stored by
+// Authenticator.Middleware, if any.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Middleware authenticates each request before passing it to next, with the
+// verified principal in its context. Failures are written with WriteError.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			WriteError(w, a.config.Realm, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// Authenticate validates the Bearer or DPoP token in the request, returning
+// the verified principal on success.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, *Error) {
+	ctx, span := tracer.Start(r.Context(), "Authenticate", trace.WithAttributes(attribute.String("auth.validation", a.config.Validation)))
+	p, err := a.authenticate(r.WithContext(ctx))
+	if a.config.OnAuthenticate != nil {
+		a.config.OnAuthenticate(r, err)
+	}
+	if err != nil {
+		span.SetAttributes(AttrFailureReason.String(err.Reason))
+		endSpan(span, err)
+	} else {
+		span.SetAttributes(p.SpanAttributes()...)
+		span.End()
+	}
+	return p, err
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, *Error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if token == "" || !strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, DPoPScheme) {
+		err := &Error{Reason: ReasonMissingToken, Status: http.StatusUnauthorized, Description: "No token provided by client"}
+		if a.config.RequireDPoP {
+			err.Scheme = DPoPScheme
+		}
+		return nil, err
+	}
+
+	claims, rawClaims, herr := a.validateToken(r.Context(), token)
+	if herr != nil {
+		return nil, herr
+	}
+
+	if herr := a.verifyDPoP(r, scheme, token, claims.Cnf); herr != nil {
+		return nil, herr
+	}
+
+	if claims.Subject == "" {
+		slog.Warn("Invalid subject in token")
+		return nil, InvalidToken("Invalid subject in token").WithReason(ReasonWrongSubject)
+	}
+
+	audience, err := a.config.Audience(r.Context())
+	if err != nil {
+		slog.Error("Failed to determine token audience", "error", err)
+		return nil, &Error{Reason: ReasonUnavailable, Status: http.StatusInternalServerError, Description: "Unable to determine token audience"}
+	}
+	if !slices.Contains([]string(claims.Audience), audience) {
+		slog.Warn("Invalid audience in token", "audience", claims.Audience, "expected", audience)
+		return nil, InvalidToken("Invalid audience in token").WithReason(ReasonWrongAudience)
+	}
+
+	subject, err := spiffeid.FromString(claims.Subject)
+	if err != nil {
+		slog.Warn("Invalid subject in request", "subject", claims.Subject)
+		return nil, InvalidToken("Invalid subject").WithReason(ReasonWrongSubject)
+	}
+
+	actors, err := claims.Act.Chain()
+	if err != nil {
+		slog.Warn("Invalid act claim in token", "error", err)
+		return nil, InvalidToken("Invalid actor").WithReason(ReasonInvalidActor)
+	}
+	p := &Principal{
+		Subject:  subject,
+		Actors:   actors,
+		Scopes:   strings.Fields(claims.Scope),
+		Audience: claims.Audience,
+		Issuer:   claims.Issuer,
+		Claims:   rawClaims,
+		Token:    token,
+	}
+	if claims.Expiry != nil {
+		p.Expiry = claims.Expiry.Time()
+	}
+
+	if herr := verifyPeer(r, p); herr != nil {
+		return nil, herr
+	}
+
+	if a.config.Authorize != nil {
+		if herr := a.config.Authorize(r, p); herr != nil {
+			return nil, herr
+		}
+	}
+
+	if len(actors) > 0 {
+		slog.Info("Validated delegated token", "subject", subject, "actor", p.ImmediateCaller(), "chain", p.ChainString(), "audience", audience)
+	} else {
+		slog.Info("Validated token", "subject", subject, "audience", audience)
+	}
+	return p, nil
+}
+
+// validateToken verifies the access token according to the configured
+// validation strategy and returns its claims.
+func (a *Authenticator) validateToken(ctx context.Context, token string) (*TokenClaims, map[string]any, *Error) {
+	switch a.config.Validation {
+	case ValidationIntrospection:
+		claims, rawClaims, herr := a.introspectToken(ctx, token)
+		if herr != nil {
+			return nil, nil, herr
+		}
+		// Introspection responses need not include iss or exp, but must be
+		// consistent with the provider if they do.
+		expected := jwt.Expected{Time: time.Now()}
+		if claims.Issuer != "" {
+			expected.Issuer = a.config.Provider.Metadata().Issuer
+		}
+		if err := claims.ValidateWithLeeway(expected, 0); err != nil {
+			slog.Warn("Introspected token failed validation", "error", err)
+			return nil, nil, InvalidToken("Invalid token").WithReason(claimsErrorReason(err))
+		}
+		return claims, rawClaims, nil
+	case ValidationHybrid:
+		claims, rawClaims, herr := a.verifyToken(ctx, token)
+		if herr != nil {
+			return nil, nil, herr
+		}
+		if _, _, herr := a.introspectToken(ctx, token); herr != nil {
+			return nil, nil, herr
+		}
+		return claims, rawClaims, nil
+	default:
+		return a.verifyToken(ctx, token)
+	}
+}
+
+// verifyToken verifies a JWT access token's signature against the provider's
+// JWKS and checks its issuer and validity period.
+func (a *Authenticator) verifyToken(ctx context.Context, token string) (*TokenClaims, map[string]any, *Error) {
+	metadata := a.config.Provider.Metadata()
+	tok, err := jwt.ParseSigned(token, metadata.signatureAlgorithms())
+	if err != nil {
+		slog.Warn("Failed to parse token", "error", err)
+		return nil, nil, InvalidToken("Invalid token").WithReason(ReasonMalformedToken)
+	}
+
+	jwks, err := a.config.JWKS.GetJWKS(ctx, tok.Headers[0].KeyID)
+	if err != nil {
+		slog.Error("Failed to fetch JWKS", "error", err)
+		return nil, nil, &Error{Reason: ReasonUnavailable, Status: http.StatusServiceUnavailable, Description: "Unable to fetch JWKS"}
+	}
+
+	var claims TokenClaims
+	var rawClaims map[string]any
+	if err = tok.Claims(jwks, &claims, &rawClaims); err != nil {
+		slog.Warn("Failed to verify token", "error", err)
+		return nil, nil, InvalidToken("Invalid token").WithReason(ReasonBadSignature)
+	}
+
+	if err = claims.ValidateWithLeeway(jwt.Expected{Issuer: metadata.Issuer, Time: time.Now()}, 0); err != nil {
+		slog.Warn("Token failed time validation", "error", err)
+		return nil, nil, InvalidToken("Invalid token").WithReason(claimsErrorReason(err))
+	}
+	return &claims, rawClaims, nil
+}
+
+// introspectToken introspects the token, mapping inactive tokens to
+// invalid_token and introspection failures to 503.
+func (a *Authenticator) introspectToken(ctx context.Context, token string) (*TokenClaims, map[string]any, *Error) {
+	claims, rawClaims, err := a.config.Introspector.Introspect(ctx, token)
+	if errors.Is(err, ErrTokenInactive) {
+		slog.Warn("Token is not active")
+		return nil, nil, InvalidToken("Token is not active").WithReason(ReasonInactive)
+	}
+	if err != nil {
+		slog.Error("Failed to introspect token", "error", err)
+		return nil, nil, &Error{Reason: ReasonUnavailable, Status: http.StatusServiceUnavailable, Description: "Unable to introspect token"}
+	}
+	return claims, rawClaims, nil
+}
+
+// verifyDPoP checks that a DPoP-bound token is presented with the DPoP scheme
+// and a proof of possession of the bound key (RFC 9449 §7.1). Tokens that are
+// not DPoP-bound are rejected if DPoP is required.
+func (a *Authenticator) verifyDPoP(r *http.Request, scheme, token string, cnf *ConfirmationClaim) *Error {
+	if cnf == nil || cnf.JKT == "" {
+		if a.config.RequireDPoP || strings.EqualFold(scheme, DPoPScheme) {
+			slog.Warn("Rejected token that is not DPoP-bound", "scheme", scheme)
+			return dpopError("invalid_token", "Token is not DPoP-bound")
+		}
+		return nil
+	}
+	if !strings.EqualFold(scheme, DPoPScheme) {
+		slog.Warn("Rejected DPoP-bound token presented as a bearer token")
+		return dpopError("invalid_token", "DPoP-bound token requires the DPoP scheme")
+	}
+
+	proofs := r.Header.Values(DPoPHeader)
+	if len(proofs) != 1 {
+		slog.Warn("Expected exactly one DPoP proof", "proofs", len(proofs))
+		return dpopError("invalid_dpop_proof", "Missing DPoP proof")
+	}
+	jkt, err := a.dpop.Verify(proofs[0], r.Method, requestURL(r), token)
+	if err != nil {
+		slog.Warn("Invalid DPoP proof", "error", err)
+		return dpopError("invalid_dpop_proof", "Invalid DPoP proof")
+	}
+	if jkt != cnf.JKT {
+		slog.Warn("DPoP proof key does not match token", "jkt", jkt, "expected", cnf.JKT)
+		return dpopError("invalid_dpop_proof", "DPoP proof key does not match token")
+	}
+	return nil
+}
+
+// verifyPeer checks, for requests received over mutual TLS, that the
+// X.509-SVID of the TLS peer identifies the immediate caller named by the
+// token. This prevents a token being presented by any workload other than the
+// one it was issued to.
+func verifyPeer(r *http.Request, p *Principal) *Error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	peerID, err := x509svid.IDFromCert(r.TLS.PeerCertificates[0])
+	if err != nil {
+		slog.Warn("Invalid SPIFFE ID in peer certificate", "error", err)
+		return InvalidToken("Invalid peer certificate").WithReason(ReasonPeerMismatch)
+	}
+	if caller := p.ImmediateCaller(); peerID != caller {
+		slog.Warn("TLS peer does not match token", "peer", peerID, "expected", caller)
+		return InvalidToken("Token was not issued to the TLS peer").WithReason(ReasonPeerMismatch)
+	}
+	return nil
+}
+
+// claimsErrorReason returns the failure reason for an error validating the
+// registered claims of a token.
+func claimsErrorReason(err error) string {
+	if errors.Is(err, jwt.ErrExpired) || errors.Is(err, jwt.ErrNotValidYet) || errors.Is(err, jwt.ErrIssuedInTheFuture) {
+		return ReasonExpired
+	}
+	return ReasonInvalidClaims
+}
+
+func signatureAlgNames() []string {
+	names := make([]string, len(signatureAlgs))
+	for i, alg := range signatureAlgs {
+		names[i] = string(alg)
+	}
+	return names
+}
@@ -0,0 +1,104 @@
+package tokenexchange
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CachingClient wraps an Exchanger, reusing exchanged tokens until they are
+// within expiryMargin of expiry. Concurrent exchanges for the same key are
+// deduplicated so that only one request reaches the exchange service.
+type CachingClient struct {
+	exchanger    Exchanger
+	expiryMargin time.Duration
+
+	mu      sync.Mutex
+	entries map[string]Result
+	group   singleflight.Group
+}
+
+// NewCachingClient returns a CachingClient wrapping exchanger.
+func NewCachingClient(exchanger Exchanger, expiryMargin time.Duration) *CachingClient {
+	return &CachingClient{
+		exchanger:    exchanger,
+		expiryMargin: expiryMargin,
+		entries:      make(map[string]Result),
+	}
+}
+
+// Exchange returns a cached token for the parameters if one is available and
+// not near expiry, otherwise it performs the exchange. Results without an
+// expiry are not cached.
+func (c *CachingClient) Exchange(ctx context.Context, params Params) (Result, error) {
+	key := exchangeCacheKey(params)
+
+	c.mu.Lock()
+	result, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Until(result.Expiry) > c.expiryMargin {
+		slog.Debug("Using cached access token", "audience", params.Audience, "expiry", result.Expiry.Format(time.RFC3339))
+		return result, nil
+	}
+
+	// The shared exchange must not be cancelled when the first caller goes
+	// away, as other callers may be waiting for it.
+	ch := c.group.DoChan(key, func() (any, error) {
+		result, err := c.exchanger.Exchange(context.WithoutCancel(ctx), params)
+		if err != nil {
+			return Result{}, err
+		}
+		c.store(key, result)
+		return result, nil
+	})
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return Result{}, res.Err
+		}
+		return res.Val.(Result), nil
+	}
+}
+
+// store caches result under key and evicts expired entries.
+func (c *CachingClient) store(key string, result Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if !entry.Expiry.After(now) {
+			delete(c.entries, k)
+		}
+	}
+	if time.Until(result.Expiry) > c.expiryMargin {
+		c.entries[key] = result
+	}
+}
+
+// exchangeCacheKey derives a cache key from the subject token, actor token,
+// audience and scopes. Tokens are hashed so that the key does not retain them.
+func exchangeCacheKey(params Params) string {
+	scopes := slices.Clone(params.Scopes)
+	slices.Sort(scopes)
+	h := sha256.New()
+	for _, part := range []string{
+		params.SubjectTokenType, params.SubjectToken,
+		params.ActorTokenType, params.ActorToken,
+		params.Audience, strings.Join(scopes, " "),
+	} {
+		// Length-prefix each part so that distinct tuples cannot collide.
+		_, _ = h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(part))))
+		_, _ = h.Write([]byte(part))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
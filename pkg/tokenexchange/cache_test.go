@@ -0,0 +1,137 @@
+package tokenexchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeExchanger issues tokens expiring after ttl, counting the exchanges.
+type fakeExchanger struct {
+	ttl   time.Duration
+	err   error
+	calls atomic.Int32
+	// release, if set, blocks exchanges until it is closed.
+	release chan struct{}
+}
+
+func (e *fakeExchanger) Exchange(_ context.Context, params Params) (Result, error) {
+	n := e.calls.Add(1)
+	if e.release != nil {
+		<-e.release
+	}
+	if e.err != nil {
+		return Result{}, e.err
+	}
+	return Result{Token: fmt.Sprintf("%s-%d", params.Audience, n), Expiry: time.Now().Add(e.ttl)}, nil
+}
+
+func TestCachingClientReusesTokens(t *testing.T) {
+	fake := &fakeExchanger{ttl: time.Hour}
+	c := NewCachingClient(fake, time.Minute)
+	ctx := context.Background()
+
+	first, err := c.Exchange(ctx, Params{SubjectToken: "svid", Audience: "server", Scopes: []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	// Scopes are compared regardless of order.
+	second, err := c.Exchange(ctx, Params{SubjectToken: "svid", Audience: "server", Scopes: []string{"b", "a"}})
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if second.Token != first.Token || fake.calls.Load() != 1 {
+		t.Errorf("second exchange returned %q after %d exchanges, want cached %q", second.Token, fake.calls.Load(), first.Token)
+	}
+
+	for _, params := range []Params{
+		{SubjectToken: "svid", Audience: "other"},
+		{SubjectToken: "other-svid", Audience: "server", Scopes: []string{"a", "b"}},
+		{SubjectToken: "svid", Audience: "server", Scopes: []string{"a"}},
+		{SubjectToken: "svid", ActorToken: "actor", Audience: "server", Scopes: []string{"a", "b"}},
+	} {
+		before := fake.calls.Load()
+		if _, err := c.Exchange(ctx, params); err != nil {
+			t.Fatalf("Exchange() error = %v", err)
+		}
+		if fake.calls.Load() != before+1 {
+			t.Errorf("Exchange(%+v) used a token cached for other parameters", params)
+		}
+	}
+}
+
+func TestCachingClientDoesNotCacheTokensNearExpiry(t *testing.T) {
+	fake := &fakeExchanger{ttl: 30 * time.Second}
+	c := NewCachingClient(fake, time.Minute)
+
+	for range 2 {
+		if _, err := c.Exchange(context.Background(), Params{Audience: "server"}); err != nil {
+			t.Fatalf("Exchange() error = %v", err)
+		}
+	}
+	if n := fake.calls.Load(); n != 2 {
+		t.Errorf("made %d exchanges, want 2", n)
+	}
+}
+
+func TestCachingClientDoesNotCacheErrors(t *testing.T) {
+	fake := &fakeExchanger{ttl: time.Hour, err: errors.New("unavailable")}
+	c := NewCachingClient(fake, time.Minute)
+
+	for range 2 {
+		if _, err := c.Exchange(context.Background(), Params{Audience: "server"}); !errors.Is(err, fake.err) {
+			t.Fatalf("Exchange() error = %v, want %v", err, fake.err)
+		}
+	}
+	if n := fake.calls.Load(); n != 2 {
+		t.Errorf("made %d exchanges, want 2", n)
+	}
+}
+
+func TestCachingClientDeduplicatesConcurrentExchanges(t *testing.T) {
+	fake := &fakeExchanger{ttl: time.Hour, release: make(chan struct{})}
+	c := NewCachingClient(fake, time.Minute)
+
+	// A caller giving up does not cancel the exchange shared with the others.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := c.Exchange(ctx, Params{Audience: "server"})
+		cancelled <- err
+	}()
+	for fake.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Go(func() {
+			result, err := c.Exchange(context.Background(), Params{Audience: "server"})
+			if err != nil {
+				t.Errorf("Exchange() error = %v", err)
+			}
+			tokens[i] = result.Token
+		})
+	}
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Exchange() error = %v, want %v", err, context.Canceled)
+	}
+	close(fake.release)
+	wg.Wait()
+
+	if n := fake.calls.Load(); n != 1 {
+		t.Errorf("made %d exchanges, want 1", n)
+	}
+	for _, token := range tokens {
+		if token != tokens[0] {
+			t.Errorf("callers received different tokens: %q", tokens)
+			break
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package tokenexchange
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+const (
+	GrantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	ClientAssertionTypeJWTSVID = "urn:ietf:params:oauth:client-assertion-type:jwt-spiffe"
+	TokenTypeJWTSVID           = "urn:ietf:params:oauth:token-type:jwt_spiffe"
+	TokenTypeAccessToken       = "urn:ietf:params:oauth:token-type:access_token"
+	// AuthMethodPrivateKeyJWT is the token endpoint authentication method for
+	// clients authenticating with a JWT client assertion (RFC 7523).
+	AuthMethodPrivateKeyJWT = "private_key_jwt"
+)
+
+// maxActorChainDepth bounds the nesting of act claims accepted from a token,
+// regardless of policy.
+const maxActorChainDepth = 16
+
+var signatureAlgs = []jose.SignatureAlgorithm{jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512, jose.ES256, jose.ES384, jose.ES512}
+
+// SignatureAlgorithms returns the algorithms accepted for JWT-SVIDs, access
+// tokens and DPoP proofs.
+func SignatureAlgorithms() []jose.SignatureAlgorithm {
+	return slices.Clone(signatureAlgs)
+}
+
+// ActorClaim represents the RFC 8693 "act" (actor) claim in a delegated token.
+// Prior actors in a delegation chain are nested in Act.
+type ActorClaim struct {
+	Sub string      `json:"sub"`
+	Act *ActorClaim `json:"act,omitempty"`
+}
+
+// Chain returns the actors in a, in hop order. The outermost act claim is the
+// most recent actor, so nested claims are returned first.
+func (a *ActorClaim) Chain() ([]spiffeid.ID, error) {
+	var actors []spiffeid.ID
+	for act := a; act != nil; act = act.Act {
+		if len(actors) == maxActorChainDepth {
+			return nil, fmt.Errorf("act claim nested deeper than %d", maxActorChainDepth)
+		}
+		id, err := spiffeid.FromString(act.Sub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid act.sub %q: %w", act.Sub, err)
+		}
+		actors = append(actors, id)
+	}
+	slices.Reverse(actors)
+	return actors, nil
+}
+
+// TokenClaims extends the standard JWT claims with the RFC 8693 "act" claim.
+type TokenClaims struct {
+	jwt.Claims
+	Act *ActorClaim `json:"act,omitempty"`
+	// Scope is the space-separated list of scopes granted to the token.
+	Scope string `json:"scope,omitempty"`
+	// Cnf binds the token to a DPoP key.
+	Cnf *ConfirmationClaim `json:"cnf,omitempty"`
+}
+
+// Principal is the verified identity of a caller: the token subject and the
+// chain of actors that the token was delegated through.
+type Principal struct {
+	Subject spiffeid.ID
+	// Actors is the delegation chain in hop order, starting with the first
+	// actor after the subject and ending with the immediate caller.
+	Actors []spiffeid.ID
+	// Scopes are the scopes granted to the token.
+	Scopes []string
+	// Audience, Issuer and Expiry are the token's aud, iss and exp claims.
+	Audience []string
+	Issuer   string
+	Expiry   time.Time
+	// Claims are the token's claims, as decoded JSON values.
+	Claims map[string]any
+	// Token is the access token presented by the caller, for use as the
+	// subject token of a delegated exchange.
+	Token string
+}
+
+// ImmediateCaller returns the workload that presented the token: the most
+// recent actor of a delegated token, or otherwise its subject.
+func (p *Principal) ImmediateCaller() spiffeid.ID {
+	if len(p.Actors) > 0 {
+		return p.Actors[len(p.Actors)-1]
+	}
+	return p.Subject
+}
+
+// ChainString renders the delegation chain, e.g. "client -> relay1 -> relay2".
+func (p *Principal) ChainString() string {
+	ids := make([]string, 0, len(p.Actors)+1)
+	ids = append(ids, p.Subject.String())
+	for _, actor := range p.Actors {
+		ids = append(ids, actor.String())
+	}
+	return strings.Join(ids, " -> ")
+}
@@ -0,0 +1,38 @@
+package tokenexchange
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+var (
+	clientID = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/client")
+	relayID  = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/relay")
+	relay2ID = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/relay2")
+)
+
+func TestActorClaimChain(t *testing.T) {
+	var act *ActorClaim
+	for _, id := range []spiffeid.ID{clientID, relayID, relay2ID} {
+		act = &ActorClaim{Sub: id.String(), Act: act}
+	}
+	chain, err := act.Chain()
+	if err != nil {
+		t.Fatalf("Chain() error = %v", err)
+	}
+	if want := []spiffeid.ID{clientID, relayID, relay2ID}; !slices.Equal(chain, want) {
+		t.Errorf("Chain() = %v, want %v", chain, want)
+	}
+
+	for range maxActorChainDepth {
+		act = &ActorClaim{Sub: relayID.String(), Act: act}
+	}
+	if _, err := act.Chain(); err == nil {
+		t.Errorf("Chain() accepted an act claim nested deeper than %d", maxActorChainDepth)
+	}
+	if _, err := (&ActorClaim{Sub: "not-a-spiffe-id"}).Chain(); err == nil {
+		t.Error("Chain() accepted an invalid act.sub")
+	}
+}
@@ -0,0 +1,287 @@
+package tokenexchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultMaxAttempts is the number of attempts a Client makes for exchanges
+// that fail with a retryable error, unless set with WithMaxAttempts.
+const defaultMaxAttempts = 3
+
+// Client performs RFC 8693 token exchange requests against a token endpoint.
+type Client struct {
+	// tokenURL returns the current token endpoint URL.
+	tokenURL func() string
+	client   *http.Client
+	retry    retryPolicy
+	// dpop, if set, signs a DPoP proof for each request so that issued tokens
+	// are bound to its key.
+	dpop *DPoPSigner
+	// onAttempt, if set, is called after each exchange request.
+	onAttempt func(duration time.Duration, err error)
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithMaxAttempts sets the total number of attempts, including the first, made
+// for an exchange that fails with a retryable error.
+func WithMaxAttempts(n int) ClientOption {
+	return func(c *Client) {
+		c.retry = defaultRetryPolicy(n)
+	}
+}
+
+// WithDPoP binds the issued tokens to the key of signer by sending a DPoP
+// proof with each exchange request. The token endpoint must then issue
+// DPoP-bound tokens.
+func WithDPoP(signer *DPoPSigner) ClientOption {
+	return func(c *Client) {
+		c.dpop = signer
+	}
+}
+
+// WithOnAttempt sets a function called with the duration and error, if any, of
+// each exchange request, including retries, for example to record metrics.
+func WithOnAttempt(fn func(duration time.Duration, err error)) ClientOption {
+	return func(c *Client) {
+		c.onAttempt = fn
+	}
+}
+
+// NewClient returns a Client for the token endpoint whose URL is returned by
+// tokenURL, such as Provider.TokenEndpoint.
+func NewClient(tokenURL func() string, client *http.Client, opts ...ClientOption) *Client {
+	c := &Client{
+		tokenURL: tokenURL,
+		client:   client,
+		retry:    defaultRetryPolicy(defaultMaxAttempts),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Params holds the parameters for an RFC 8693 token exchange request.
+type Params struct {
+	ClientAssertionType string
+	ClientAssertion     string
+	SubjectTokenType    string
+	SubjectToken        string
+	ActorToken          string
+	ActorTokenType      string
+	Audience            string
+	Scopes              []string
+}
+
+// Exchanger performs token exchanges. It is implemented by Client and
+// CachingClient.
+type Exchanger interface {
+	Exchange(ctx context.Context, params Params) (Result, error)
+}
+
+// Result holds the RFC 8693 §2.2.1 response to a successful token exchange.
+type Result struct {
+	Token           string
+	IssuedTokenType string
+	TokenType       string
+	// ExpiresIn is the lifetime of the token, or zero if the response did not
+	// include expires_in.
+	ExpiresIn    time.Duration
+	Scopes       []string
+	RefreshToken string
+	// Expiry is the time the token expires, derived from ExpiresIn when the
+	// response was received. It is zero if ExpiresIn is zero.
+	Expiry time.Time
+}
+
+// Exchange performs an RFC 8693 token exchange and returns the resulting access
+// token. If the client has a DPoP signer, the token endpoint must issue a
+// DPoP-bound token. Retryable failures are retried according to the client's retry policy;
+// errors returned by the token endpoint are reported as *OAuthError.
+func (c *Client) Exchange(ctx context.Context, params Params) (result Result, err error) {
+	ctx, span := tracer.Start(ctx, "TokenExchange", trace.WithAttributes(
+		AttrAudience.String(params.Audience),
+		AttrDelegated.Bool(params.ActorToken != ""),
+	))
+	defer func() {
+		var oerr *OAuthError
+		if errors.As(err, &oerr) && oerr.Code != "" {
+			span.SetAttributes(AttrErrorCode.String(oerr.Code))
+		}
+		endSpan(span, err)
+	}()
+
+	form := url.Values{}
+	form.Set("grant_type", GrantTypeTokenExchange)
+	form.Set("client_assertion_type", params.ClientAssertionType)
+	form.Set("client_assertion", params.ClientAssertion)
+	form.Set("subject_token_type", params.SubjectTokenType)
+	form.Set("subject_token", params.SubjectToken)
+	if params.ActorToken != "" {
+		form.Set("actor_token", params.ActorToken)
+		form.Set("actor_token_type", params.ActorTokenType)
+	}
+	form.Set("audience", params.Audience)
+	if len(params.Scopes) > 0 {
+		form.Set("scope", strings.Join(params.Scopes, " "))
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		result, err := c.exchange(ctx, form)
+		if c.onAttempt != nil {
+			c.onAttempt(time.Since(start), err)
+		}
+		if err == nil {
+			return result, nil
+		}
+		delay, retry := c.retry.next(attempt, err)
+		if !retry || ctx.Err() != nil {
+			return Result{}, err
+		}
+		slog.Warn("Token exchange failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("error", err.Error())))
+		select {
+		case <-ctx.Done():
+			return Result{}, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// exchange sends a single token exchange request.
+func (c *Client) exchange(ctx context.Context, form url.Values) (Result, error) {
+	tokenURL := c.tokenURL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to create exchange request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.dpop != nil {
+		// A fresh proof is needed for each attempt, as proofs cannot be replayed.
+		proof, err := c.dpop.Proof(http.MethodPost, tokenURL, "")
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to create DPoP proof: %w", err)
+		}
+		req.Header.Set(DPoPHeader, proof)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Result{}, &retryableError{fmt.Errorf("failed to send exchange request: %w", err)}
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Result{}, &retryableError{fmt.Errorf("failed to read exchange response: %w", err)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, parseOAuthError(resp, body)
+	}
+
+	var tokenResp struct {
+		AccessToken     string `json:"access_token"`
+		IssuedTokenType string `json:"issued_token_type"`
+		TokenType       string `json:"token_type"`
+		ExpiresIn       int64  `json:"expires_in"`
+		Scope           string `json:"scope"`
+		RefreshToken    string `json:"refresh_token"`
+	}
+	err = json.Unmarshal(body, &tokenResp)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to unmarshal exchange response: %w", err)
+	}
+
+	if tokenResp.AccessToken == "" {
+		return Result{}, errors.New("token not found in exchange response")
+	}
+	if c.dpop != nil && !strings.EqualFold(tokenResp.TokenType, DPoPTokenType) {
+		return Result{}, fmt.Errorf("exchange service issued a %q token, not a DPoP-bound token", tokenResp.TokenType)
+	}
+
+	result := Result{
+		Token:           tokenResp.AccessToken,
+		IssuedTokenType: tokenResp.IssuedTokenType,
+		TokenType:       tokenResp.TokenType,
+		ExpiresIn:       time.Duration(tokenResp.ExpiresIn) * time.Second,
+		Scopes:          strings.Fields(tokenResp.Scope),
+		RefreshToken:    tokenResp.RefreshToken,
+	}
+	if result.ExpiresIn > 0 {
+		result.Expiry = time.Now().Add(result.ExpiresIn)
+	}
+	return result, nil
+}
+
+// retryPolicy applies bounded exponential backoff with full jitter to
+// retryable exchange failures. The zero value does not retry.
+type retryPolicy struct {
+	// maxAttempts is the total number of attempts, including the first.
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// defaultRetryPolicy returns a retryPolicy making up to maxAttempts attempts.
+func defaultRetryPolicy(maxAttempts int) retryPolicy {
+	return retryPolicy{
+		maxAttempts: maxAttempts,
+		baseDelay:   200 * time.Millisecond,
+		maxDelay:    5 * time.Second,
+	}
+}
+
+// next returns the delay before the next attempt and whether to retry after
+// the given attempt failed with err. A Retry-After hint from the server is
+// honoured unless it exceeds maxDelay, in which case the error is returned.
+func (p retryPolicy) next(attempt int, err error) (time.Duration, bool) {
+	if attempt >= p.maxAttempts || !isRetryable(err) {
+		return 0, false
+	}
+
+	var oerr *OAuthError
+	if errors.As(err, &oerr) && oerr.RetryAfter > 0 {
+		return oerr.RetryAfter, oerr.RetryAfter <= p.maxDelay
+	}
+
+	backoff := min(p.baseDelay<<(attempt-1), p.maxDelay)
+	return rand.N(backoff) + 1, true
+}
+
+// retryableError marks a transport-level failure as retryable.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// isRetryable reports whether err is a transient exchange failure: a network
+// error, or a 5xx or 429 response.
+func isRetryable(err error) bool {
+	var rerr *retryableError
+	if errors.As(err, &rerr) {
+		return true
+	}
+	var oerr *OAuthError
+	return errors.As(err, &oerr) && oerr.Retryable()
+}
@@ -0,0 +1,229 @@
+package tokenexchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTokenServer serves token exchange requests with handler, counting them.
+func newTokenServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, attempt int32)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, attempts.Add(1))
+	}))
+	t.Cleanup(server.Close)
+	return server, &attempts
+}
+
+func writeToken(w http.ResponseWriter, tokenType string) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintf(w, `{"access_token":"token","issued_token_type":%q,"token_type":%q,"expires_in":300,"scope":"ping:read"}`, TokenTypeAccessToken, tokenType)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `{"error":%q}`, code)
+}
+
+func TestClientExchange(t *testing.T) {
+	server, _ := newTokenServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("invalid request: %v", err)
+		}
+		for name, want := range map[string]string{
+			"grant_type":    GrantTypeTokenExchange,
+			"subject_token": "svid",
+			"actor_token":   "actor",
+			"audience":      "server",
+			"scope":         "ping:read ping:write",
+		} {
+			if got := r.PostForm.Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+		writeToken(w, "Bearer")
+	})
+	c := NewClient(func() string { return server.URL }, server.Client())
+
+	result, err := c.Exchange(context.Background(), Params{
+		SubjectToken: "svid",
+		ActorToken:   "actor",
+		Audience:     "server",
+		Scopes:       []string{"ping:read", "ping:write"},
+	})
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if result.Token != "token" || result.ExpiresIn != 5*time.Minute || time.Until(result.Expiry) > 5*time.Minute || len(result.Scopes) != 1 {
+		t.Errorf("Exchange() = %+v", result)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail responds to the first failures attempts.
+		fail         func(w http.ResponseWriter)
+		failures     int32
+		maxAttempts  int
+		wantAttempts int32
+		wantCode     string
+	}{
+		{
+			name:         "retries server errors",
+			fail:         func(w http.ResponseWriter) { writeError(w, http.StatusServiceUnavailable, "temporarily_unavailable") },
+			failures:     2,
+			maxAttempts:  3,
+			wantAttempts: 3,
+		},
+		{
+			name: "retries rate limiting",
+			fail: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "0")
+				writeError(w, http.StatusTooManyRequests, "slow_down")
+			},
+			failures:     1,
+			maxAttempts:  3,
+			wantAttempts: 2,
+		},
+		{
+			name:         "gives up after max attempts",
+			fail:         func(w http.ResponseWriter) { writeError(w, http.StatusInternalServerError, "server_error") },
+			failures:     5,
+			maxAttempts:  2,
+			wantAttempts: 2,
+			wantCode:     "server_error",
+		},
+		{
+			name:         "does not retry invalid grants",
+			fail:         func(w http.ResponseWriter) { writeError(w, http.StatusBadRequest, "invalid_grant") },
+			failures:     1,
+			maxAttempts:  3,
+			wantAttempts: 1,
+			wantCode:     "invalid_grant",
+		},
+		{
+			name: "does not wait longer than the maximum delay",
+			fail: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "60")
+				writeError(w, http.StatusServiceUnavailable, "temporarily_unavailable")
+			},
+			failures:     1,
+			maxAttempts:  3,
+			wantAttempts: 1,
+			wantCode:     "temporarily_unavailable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, attempts := newTokenServer(t, func(w http.ResponseWriter, r *http.Request, attempt int32) {
+				if attempt <= tt.failures {
+					tt.fail(w)
+					return
+				}
+				writeToken(w, "Bearer")
+			})
+			var observed atomic.Int32
+			c := NewClient(func() string { return server.URL }, server.Client(),
+				WithMaxAttempts(tt.maxAttempts),
+				WithOnAttempt(func(time.Duration, error) { observed.Add(1) }),
+			)
+
+			_, err := c.Exchange(context.Background(), Params{Audience: "server"})
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", got, tt.wantAttempts)
+			}
+			if got := observed.Load(); got != tt.wantAttempts {
+				t.Errorf("OnAttempt called %d times, want %d", got, tt.wantAttempts)
+			}
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Errorf("Exchange() error = %v", err)
+				}
+				return
+			}
+			var oerr *OAuthError
+			if !errors.As(err, &oerr) || oerr.Code != tt.wantCode {
+				t.Errorf("Exchange() error = %v, want %s", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestClientRetriesNetworkErrors(t *testing.T) {
+	server, _ := newTokenServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {})
+	url := server.URL
+	server.Close()
+	var attempts atomic.Int32
+	c := NewClient(func() string { return url }, http.DefaultClient,
+		WithMaxAttempts(2),
+		WithOnAttempt(func(time.Duration, error) { attempts.Add(1) }),
+	)
+
+	_, err := c.Exchange(context.Background(), Params{Audience: "server"})
+	var rerr *retryableError
+	if !errors.As(err, &rerr) {
+		t.Errorf("Exchange() error = %v, want a network error", err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("made %d attempts, want 2", n)
+	}
+}
+
+func TestParseOAuthError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{"Retry-After": {"7"}}}
+	oerr := parseOAuthError(resp, []byte("<html>bad gateway</html>"))
+	if oerr.Code != "" || oerr.Description != "<html>bad gateway</html>" || oerr.RetryAfter != 7*time.Second || !oerr.Retryable() {
+		t.Errorf("parseOAuthError() = %+v", oerr)
+	}
+
+	resp = &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}}
+	oerr = parseOAuthError(resp, []byte(`{"error":"invalid_target","error_description":"no"}`))
+	if oerr.Code != "invalid_target" || oerr.Description != "no" || oerr.Retryable() {
+		t.Errorf("parseOAuthError() = %+v", oerr)
+	}
+}
+
+func TestClientDPoP(t *testing.T) {
+	signer, err := NewDPoPSigner()
+	if err != nil {
+		t.Fatalf("NewDPoPSigner() error = %v", err)
+	}
+	verifier := NewDPoPVerifier()
+	var tokenType atomic.Value
+	tokenType.Store(DPoPTokenType)
+	server, _ := newTokenServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+		jkt, err := verifier.Verify(r.Header.Get(DPoPHeader), r.Method, "http://"+r.Host+r.URL.Path, "")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_dpop_proof")
+			return
+		}
+		if jkt != signer.Thumbprint() {
+			t.Errorf("proof thumbprint = %q, want %q", jkt, signer.Thumbprint())
+		}
+		writeToken(w, tokenType.Load().(string))
+	})
+	c := NewClient(func() string { return server.URL }, server.Client(), WithDPoP(signer))
+
+	// Each attempt carries a fresh proof, so repeated exchanges are not
+	// rejected as replays.
+	for range 2 {
+		if _, err := c.Exchange(context.Background(), Params{Audience: "server"}); err != nil {
+			t.Fatalf("Exchange() error = %v", err)
+		}
+	}
+
+	// A Bearer token would not be bound to the client's key.
+	tokenType.Store("Bearer")
+	if _, err := c.Exchange(context.Background(), Params{Audience: "server"}); err == nil {
+		t.Error("Exchange() accepted a Bearer token when DPoP was requested")
+	}
+}
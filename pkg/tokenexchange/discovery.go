@@ -0,0 +1,182 @@
+package tokenexchange
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// ProviderMetadata holds the OIDC provider metadata (OpenID Connect Discovery
+// 1.0 §3, RFC 8414 §2) used by this package.
+type ProviderMetadata struct {
+	Issuer                                     string   `json:"issuer"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	JWKSUri                                    string   `json:"jwks_uri"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	// ClientAssertionTypesSupported is not registered metadata, but is
+	// advertised by some token exchange services.
+	ClientAssertionTypesSupported    []string `json:"client_assertion_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	// IntrospectionEndpoint is the RFC 7662 token introspection endpoint
+	// (RFC 8414 §2), if the provider supports introspection.
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+}
+
+// Discover fetches, parses and validates the OIDC discovery document for the
+// given issuer URL. The document must name the issuer URL as its issuer and
+// advertise support for token exchange and JWT-SVID client assertions.
+func Discover(issuerURL string, client *http.Client) (*ProviderMetadata, error) {
+	issuerURL = strings.TrimRight(issuerURL, "/")
+	discoveryURL := issuerURL + "/.well-known/openid-configuration"
+
+	resp, err := client.Get(discoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery request failed with status %d", resp.StatusCode)
+	}
+
+	var doc ProviderMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OIDC discovery document: %w", err)
+	}
+
+	if err := doc.validate(issuerURL); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// validate checks the metadata against the issuer URL it was fetched from and
+// the features this package requires. Absent grant types and
+// authentication methods take their RFC 8414 defaults, which exclude token
+// exchange and client assertions.
+func (d *ProviderMetadata) validate(issuerURL string) error {
+	if d.Issuer != issuerURL {
+		return fmt.Errorf("OIDC discovery document issuer %q does not match %q", d.Issuer, issuerURL)
+	}
+	if d.TokenEndpoint == "" {
+		return fmt.Errorf("OIDC discovery document missing token_endpoint")
+	}
+	if d.JWKSUri == "" {
+		return fmt.Errorf("OIDC discovery document missing jwks_uri")
+	}
+	if !slices.Contains(d.GrantTypesSupported, GrantTypeTokenExchange) {
+		return fmt.Errorf("OIDC provider does not support grant type %s", GrantTypeTokenExchange)
+	}
+	if !slices.Contains(d.TokenEndpointAuthMethodsSupported, AuthMethodPrivateKeyJWT) {
+		return fmt.Errorf("OIDC provider does not support token endpoint authentication method %s", AuthMethodPrivateKeyJWT)
+	}
+	if len(d.ClientAssertionTypesSupported) > 0 && !slices.Contains(d.ClientAssertionTypesSupported, ClientAssertionTypeJWTSVID) {
+		return fmt.Errorf("OIDC provider does not support client assertion type %s", ClientAssertionTypeJWTSVID)
+	}
+	if len(d.TokenEndpointAuthSigningAlgValuesSupported) > 0 && !slices.ContainsFunc(d.TokenEndpointAuthSigningAlgValuesSupported, isJWTSVIDAlg) {
+		return fmt.Errorf("OIDC provider does not support any JWT-SVID signing algorithm for client assertions")
+	}
+	if len(d.signatureAlgorithms()) == 0 {
+		return fmt.Errorf("OIDC provider advertises no supported signing algorithm")
+	}
+	return nil
+}
+
+// signatureAlgorithms returns the token signing algorithms accepted from the
+// provider: those advertised in id_token_signing_alg_values_supported that are
+// also in signatureAlgs, or all of signatureAlgs if none are
+// advertised.
+func (d *ProviderMetadata) signatureAlgorithms() []jose.SignatureAlgorithm {
+	if len(d.IDTokenSigningAlgValuesSupported) == 0 {
+		return signatureAlgs
+	}
+	var algs []jose.SignatureAlgorithm
+	for _, alg := range signatureAlgs {
+		if slices.Contains(d.IDTokenSigningAlgValuesSupported, string(alg)) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// isJWTSVIDAlg reports whether alg may be used to sign a JWT-SVID.
+func isJWTSVIDAlg(alg string) bool {
+	return slices.Contains(signatureAlgs, jose.SignatureAlgorithm(alg))
+}
+
+// Provider holds the current metadata of an OIDC provider, optionally
+// re-running discovery periodically so that endpoint changes are picked up
+// without a restart.
+type Provider struct {
+	issuerURL string
+	client    *http.Client
+	metadata  atomic.Pointer[ProviderMetadata]
+}
+
+// NewProvider performs discovery for issuerURL and returns a provider holding
+// the result.
+func NewProvider(issuerURL string, client *http.Client) (*Provider, error) {
+	doc, err := Discover(issuerURL, client)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{issuerURL: issuerURL, client: client}
+	p.metadata.Store(doc)
+	return p, nil
+}
+
+// Metadata returns the most recently discovered provider metadata.
+func (p *Provider) Metadata() *ProviderMetadata {
+	return p.metadata.Load()
+}
+
+// TokenEndpoint returns the current token endpoint URL.
+func (p *Provider) TokenEndpoint() string {
+	return p.Metadata().TokenEndpoint
+}
+
+// JWKSURI returns the current JWKS URL.
+func (p *Provider) JWKSURI() string {
+	return p.Metadata().JWKSUri
+}
+
+// IntrospectionEndpoint returns the current introspection endpoint URL, or ""
+// if the provider does not support introspection.
+func (p *Provider) IntrospectionEndpoint() string {
+	return p.Metadata().IntrospectionEndpoint
+}
+
+// Run re-runs discovery every interval until ctx is cancelled. If discovery
+// fails, the previous metadata is kept.
+func (p *Provider) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		doc, err := Discover(p.issuerURL, p.client)
+		if err != nil {
+			slog.Warn("OIDC re-discovery failed, keeping previous metadata", "error", err)
+			continue
+		}
+		if prev := p.metadata.Swap(doc); prev.TokenEndpoint != doc.TokenEndpoint || prev.JWKSUri != doc.JWKSUri {
+			slog.Info("OIDC provider metadata changed", "token_endpoint", doc.TokenEndpoint, "jwks_uri", doc.JWKSUri)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tokenexchange
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// serveDiscovery serves the discovery document returned by doc for the issuer
+// URL of the server, and returns the server.
+func serveDiscovery(t *testing.T, doc func(issuer string) *ProviderMetadata) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(doc(server.URL))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func validDiscovery(issuer string) *ProviderMetadata {
+	return &ProviderMetadata{
+		Issuer:                            issuer,
+		TokenEndpoint:                     issuer + "/token",
+		JWKSUri:                           issuer + "/keys",
+		GrantTypesSupported:               []string{GrantTypeTokenExchange},
+		TokenEndpointAuthMethodsSupported: []string{AuthMethodPrivateKeyJWT},
+	}
+}
+
+func TestDiscoverValidatesMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(d *ProviderMetadata)
+		wantErr bool
+	}{
+		{"valid", func(*ProviderMetadata) {}, false},
+		{"issuer mismatch", func(d *ProviderMetadata) { d.Issuer = "https://evil.example" }, true},
+		{"missing token endpoint", func(d *ProviderMetadata) { d.TokenEndpoint = "" }, true},
+		{"missing jwks_uri", func(d *ProviderMetadata) { d.JWKSUri = "" }, true},
+		{"no token exchange grant", func(d *ProviderMetadata) { d.GrantTypesSupported = nil }, true},
+		{"no private_key_jwt", func(d *ProviderMetadata) { d.TokenEndpointAuthMethodsSupported = []string{"client_secret_basic"} }, true},
+		{"no JWT-SVID assertions", func(d *ProviderMetadata) { d.ClientAssertionTypesSupported = []string{"urn:example"} }, true},
+		{"no JWT-SVID assertion algorithms", func(d *ProviderMetadata) { d.TokenEndpointAuthSigningAlgValuesSupported = []string{"HS256"} }, true},
+		{"no supported signing algorithms", func(d *ProviderMetadata) { d.IDTokenSigningAlgValuesSupported = []string{"HS256"} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := serveDiscovery(t, func(issuer string) *ProviderMetadata {
+				d := validDiscovery(issuer)
+				tt.modify(d)
+				return d
+			})
+			// A trailing slash on the configured issuer URL is ignored.
+			_, err := Discover(server.URL+"/", server.Client())
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("Discover() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	d := &ProviderMetadata{}
+	if got := d.signatureAlgorithms(); !slices.Equal(got, signatureAlgs) {
+		t.Errorf("signatureAlgorithms() = %v, want %v", got, signatureAlgs)
+	}
+	d.IDTokenSigningAlgValuesSupported = []string{"HS256", "ES256", "RS256"}
+	if got, want := d.signatureAlgorithms(), []jose.SignatureAlgorithm{jose.RS256, jose.ES256}; !slices.Equal(got, want) {
+		t.Errorf("signatureAlgorithms() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,38 @@
+// Package tokenexchange lets SPIFFE workloads authenticate to each other with
+// OAuth 2.0 access tokens obtained by exchanging their JWT-SVIDs at a token
+// exchange service (RFC 8693).
+//
+// On the client side, a Transport obtains and attaches a token for each
+// request's destination audience:
+//
+//	provider, err := tokenexchange.NewProvider(issuerURL, http.DefaultClient)
+//	exchanger := tokenexchange.NewCachingClient(tokenexchange.NewClient(provider.TokenEndpoint, http.DefaultClient), 30*time.Second)
+//	client := &http.Client{Transport: &tokenexchange.Transport{
+//		Exchanger:  exchanger,
+//		SVIDSource: tokenexchange.NewJWTSVIDSource(wlClient, provider.TokenEndpoint),
+//		Audience:   tokenexchange.StaticAudience("spiffe://example.org/server"),
+//	}}
+//
+// On the server side, an Authenticator validates tokens and stores the
+// verified subject and delegation chain in the request context:
+//
+//	jwks := tokenexchange.NewJWKSFetcher(provider.JWKSURI, http.DefaultClient)
+//	go jwks.Run(ctx)
+//	auth, err := tokenexchange.NewAuthenticator(tokenexchange.AuthenticatorConfig{
+//		Provider: provider,
+//		Audience: func(context.Context) (string, error) { return "spiffe://example.org/server", nil },
+//		JWKS:     jwks,
+//	})
+//	http.Handle("/", auth.Middleware(handler))
+//
+// Handlers retrieve the caller with PrincipalFromContext, and may call further
+// services on its behalf by passing WithSubjectToken(ctx, principal.Token) in
+// the context of requests sent through a Transport.
+//
+// The package has no metrics dependency. Callers observe it through hooks
+// instead: WithOnAttempt for exchange requests, JWTSVIDSource.OnFetch,
+// JWKSFetcher.OnRefresh and OnLookup, and AuthenticatorConfig.OnAuthenticate,
+// whose errors carry a Reason for labelling. JWT-SVID fetches, exchanges, JWKS
+// fetches and authentication are also traced with the global OpenTelemetry
+// tracer provider, with attributes such as AttrSubject and AttrActors.
+package tokenexchange
@@ -0,0 +1,223 @@
+package tokenexchange
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	// DPoPHeader carries a DPoP proof JWT (RFC 9449 §4.1).
+	DPoPHeader = "DPoP"
+	// DPoPScheme is the authorization scheme for DPoP-bound access tokens
+	// (RFC 9449 §7.1).
+	DPoPScheme = "DPoP"
+	// DPoPTokenType is the token_type of a DPoP-bound access token.
+	DPoPTokenType  = "DPoP"
+	dpopProofType  = "dpop+jwt"
+	dpopSigningAlg = jose.ES256
+	// dpopProofMaxAge bounds how far a proof's iat may be from the current
+	// time. Proof IDs are remembered for this long to detect replays.
+	dpopProofMaxAge = time.Minute
+)
+
+// ConfirmationClaim is the RFC 7800 "cnf" claim binding a token to a key.
+type ConfirmationClaim struct {
+	// JKT is the base64url-encoded SHA-256 JWK thumbprint of the DPoP key
+	// (RFC 9449 §6.1).
+	JKT string `json:"jkt,omitempty"`
+}
+
+// dpopProofClaims are the claims of a DPoP proof JWT (RFC 9449 §4.2).
+type dpopProofClaims struct {
+	ID       string           `json:"jti"`
+	Method   string           `json:"htm"`
+	URL      string           `json:"htu"`
+	IssuedAt *jwt.NumericDate `json:"iat"`
+	// AccessTokenHash is the base64url-encoded SHA-256 hash of the access
+	// token, required when the proof accompanies an access token.
+	AccessTokenHash string `json:"ath,omitempty"`
+}
+
+// DPoPSigner holds an ephemeral key pair and creates DPoP proofs with it.
+// Access tokens obtained with its proofs are bound to the key, so they can only
+// be used by this process.
+type DPoPSigner struct {
+	signer     jose.Signer
+	thumbprint string
+}
+
+// NewDPoPSigner returns a DPoPSigner with a freshly generated P-256 key.
+func NewDPoPSigner() (*DPoPSigner, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DPoP key: %w", err)
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: dpopSigningAlg, Key: key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(dpopProofType),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DPoP signer: %w", err)
+	}
+	thumbprint, err := jwkThumbprint(&jose.JSONWebKey{Key: key.Public()})
+	if err != nil {
+		return nil, err
+	}
+	return &DPoPSigner{signer: signer, thumbprint: thumbprint}, nil
+}
+
+// Thumbprint returns the JWK thumbprint of the signer's public key.
+func (s *DPoPSigner) Thumbprint() string {
+	return s.thumbprint
+}
+
+// Proof returns a DPoP proof for a request with the given method and URL. If
+// accessToken is non-empty, the proof is bound to it with the ath claim.
+func (s *DPoPSigner) Proof(method, rawURL, accessToken string) (string, error) {
+	htu, err := normalizeHTU(rawURL)
+	if err != nil {
+		return "", err
+	}
+	claims := dpopProofClaims{
+		ID:       rand.Text(),
+		Method:   method,
+		URL:      htu,
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}
+	if accessToken != "" {
+		claims.AccessTokenHash = accessTokenHash(accessToken)
+	}
+	return jwt.Signed(s.signer).Claims(claims).Serialize()
+}
+
+// DPoPVerifier verifies DPoP proofs, rejecting proofs whose jti has been seen
+// within dpopProofMaxAge.
+type DPoPVerifier struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewDPoPVerifier returns a DPoPVerifier with an empty replay cache.
+func NewDPoPVerifier() *DPoPVerifier {
+	return &DPoPVerifier{seen: make(map[string]time.Time)}
+}
+
+// Verify checks a DPoP proof for a request with the given method and URL and
+// returns the thumbprint of the key that signed it. If accessToken is
+// non-empty, the proof's ath claim must match it.
+func (v *DPoPVerifier) Verify(proof, method, rawURL, accessToken string) (string, error) {
+	tok, err := jwt.ParseSigned(proof, signatureAlgs)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse DPoP proof: %w", err)
+	}
+	header := tok.Headers[0]
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return "", fmt.Errorf("unexpected DPoP proof type %q", typ)
+	}
+	if header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() {
+		return "", errors.New("DPoP proof does not carry a public key")
+	}
+
+	var claims dpopProofClaims
+	if err := tok.Claims(header.JSONWebKey, &claims); err != nil {
+		return "", fmt.Errorf("failed to verify DPoP proof: %w", err)
+	}
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return "", errors.New("DPoP proof missing jti or iat")
+	}
+	if claims.Method != method {
+		return "", fmt.Errorf("DPoP proof htm %q does not match request method %q", claims.Method, method)
+	}
+	htu, err := normalizeHTU(claims.URL)
+	if err != nil {
+		return "", err
+	}
+	if expected, err := normalizeHTU(rawURL); err != nil || htu != expected {
+		return "", fmt.Errorf("DPoP proof htu %q does not match request URL %q", claims.URL, rawURL)
+	}
+	iat := claims.IssuedAt.Time()
+	if age := time.Since(iat); age > dpopProofMaxAge || age < -dpopProofMaxAge {
+		return "", fmt.Errorf("DPoP proof iat %s outside the acceptable window", iat.Format(time.RFC3339))
+	}
+	if accessToken != "" && claims.AccessTokenHash != accessTokenHash(accessToken) {
+		return "", errors.New("DPoP proof ath does not match access token")
+	}
+
+	thumbprint, err := jwkThumbprint(header.JSONWebKey)
+	if err != nil {
+		return "", err
+	}
+	// Replays are checked last so that invalid proofs do not fill the cache.
+	if !v.remember(thumbprint+":"+claims.ID, iat.Add(dpopProofMaxAge)) {
+		return "", fmt.Errorf("DPoP proof %q has already been used", claims.ID)
+	}
+	return thumbprint, nil
+}
+
+// remember records a proof ID until expiry, evicting expired entries. It
+// returns false if the ID is already recorded.
+func (v *DPoPVerifier) remember(id string, expiry time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for seenID, seenExpiry := range v.seen {
+		if now.After(seenExpiry) {
+			delete(v.seen, seenID)
+		}
+	}
+	if _, ok := v.seen[id]; ok {
+		return false
+	}
+	v.seen[id] = expiry
+	return true
+}
+
+// requestURL returns the URL of r as seen by the client, without query or
+// fragment, for comparison with a DPoP proof's htu claim.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// normalizeHTU returns rawURL without query or fragment and with the scheme
+// and host lowercased (RFC 9449 §4.3).
+func normalizeHTU(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid DPoP htu %q: %w", rawURL, err)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath(), nil
+}
+
+func accessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func jwkThumbprint(jwk *jose.JSONWebKey) (string, error) {
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute JWK thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
@@ -0,0 +1,83 @@
+package tokenexchange
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDPoPProof(t *testing.T) {
+	signer, err := NewDPoPSigner()
+	if err != nil {
+		t.Fatalf("NewDPoPSigner() error = %v", err)
+	}
+	other, err := NewDPoPSigner()
+	if err != nil {
+		t.Fatalf("NewDPoPSigner() error = %v", err)
+	}
+	const url = "https://server.example/ping"
+
+	proof := func(s *DPoPSigner, method, url, token string) string {
+		t.Helper()
+		p, err := s.Proof(method, url, token)
+		if err != nil {
+			t.Fatalf("Proof() error = %v", err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		proof   string
+		method  string
+		url     string
+		token   string
+		wantJKT string
+	}{
+		{"valid", proof(signer, http.MethodGet, url, "token"), http.MethodGet, url, "token", signer.Thumbprint()},
+		{"query and case ignored", proof(signer, http.MethodGet, "HTTPS://Server.Example/ping?x=1", ""), http.MethodGet, url, "", signer.Thumbprint()},
+		{"other key", proof(other, http.MethodGet, url, ""), http.MethodGet, url, "", other.Thumbprint()},
+		{"wrong method", proof(signer, http.MethodPost, url, ""), http.MethodGet, url, "", ""},
+		{"wrong URL", proof(signer, http.MethodGet, "https://server.example/other", ""), http.MethodGet, url, "", ""},
+		{"wrong access token", proof(signer, http.MethodGet, url, "token"), http.MethodGet, url, "stolen", ""},
+		{"missing access token hash", proof(signer, http.MethodGet, url, ""), http.MethodGet, url, "token", ""},
+		{"not a proof", "not-a-jwt", http.MethodGet, url, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jkt, err := NewDPoPVerifier().Verify(tt.proof, tt.method, tt.url, tt.token)
+			if tt.wantJKT == "" {
+				if err == nil {
+					t.Error("Verify() accepted an invalid proof")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if jkt != tt.wantJKT {
+				t.Errorf("Verify() = %q, want %q", jkt, tt.wantJKT)
+			}
+		})
+	}
+}
+
+func TestDPoPVerifierRejectsReplays(t *testing.T) {
+	signer, err := NewDPoPSigner()
+	if err != nil {
+		t.Fatalf("NewDPoPSigner() error = %v", err)
+	}
+	verifier := NewDPoPVerifier()
+	proof, err := signer.Proof(http.MethodGet, "https://server.example/", "")
+	if err != nil {
+		t.Fatalf("Proof() error = %v", err)
+	}
+
+	if _, err := verifier.Verify(proof, http.MethodGet, "https://server.example/", ""); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	_, err = verifier.Verify(proof, http.MethodGet, "https://server.example/", "")
+	if err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Errorf("Verify() of a replayed proof error = %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package tokenexchange
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTokenInactive is returned by Introspect for tokens that are not active.
+var ErrTokenInactive = errors.New("token is not active")
+
+// Introspector queries an RFC 7662 token introspection endpoint, authenticating
+// with a JWT-SVID client assertion. Active results are cached for cacheTTL, or
+// until the token expires if sooner; a zero cacheTTL disables caching.
+type Introspector struct {
+	// endpoint returns the current introspection endpoint URL.
+	endpoint   func() string
+	client     *http.Client
+	svidSource *JWTSVIDSource
+	cacheTTL   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]introspectionResult
+}
+
+// introspectionResult is a cached active introspection response.
+type introspectionResult struct {
+	claims    *TokenClaims
+	rawClaims map[string]any
+	expiry    time.Time
+}
+
+// NewIntrospector returns an Introspector for the endpoint returned by
+// endpoint, such as Provider.IntrospectionEndpoint, authenticating with
+// JWT-SVIDs from svidSource.
+func NewIntrospector(endpoint func() string, client *http.Client, svidSource *JWTSVIDSource, cacheTTL time.Duration) *Introspector {
+	return &Introspector{
+		endpoint:   endpoint,
+		client:     client,
+		svidSource: svidSource,
+		cacheTTL:   cacheTTL,
+		cache:      make(map[string]introspectionResult),
+	}
+}
+
+// Introspect returns the claims of an active token, or ErrTokenInactive if the
+// introspection endpoint reports the token as inactive.
+func (i *Introspector) Introspect(ctx context.Context, token string) (*TokenClaims, map[string]any, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	i.mu.Lock()
+	result, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && time.Now().Before(result.expiry) {
+		slog.Debug("Using cached introspection result", "expiry", result.expiry.Format(time.RFC3339))
+		return result.claims, result.rawClaims, nil
+	}
+
+	claims, rawClaims, err := i.introspect(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if i.cacheTTL > 0 {
+		expiry := time.Now().Add(i.cacheTTL)
+		if claims.Expiry != nil && claims.Expiry.Time().Before(expiry) {
+			expiry = claims.Expiry.Time()
+		}
+		i.store(key, introspectionResult{claims: claims, rawClaims: rawClaims, expiry: expiry})
+	}
+	return claims, rawClaims, nil
+}
+
+// store caches an introspection result, evicting expired entries.
+func (i *Introspector) store(key string, result introspectionResult) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	for k, cached := range i.cache {
+		if now.After(cached.expiry) {
+			delete(i.cache, k)
+		}
+	}
+	i.cache[key] = result
+}
+
+// introspect sends a single introspection request.
+func (i *Introspector) introspect(ctx context.Context, token string) (*TokenClaims, map[string]any, error) {
+	svid, err := i.svidSource.GetSVID(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	form.Set("client_assertion_type", ClientAssertionTypeJWTSVID)
+	form.Set("client_assertion", svid.Marshal())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.endpoint(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send introspection request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read introspection response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, parseOAuthError(resp, body)
+	}
+
+	var active struct {
+		Active bool `json:"active"`
+	}
+	var claims TokenClaims
+	var rawClaims map[string]any
+	for _, v := range []any{&active, &claims, &rawClaims} {
+		if err := json.Unmarshal(body, v); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal introspection response: %w", err)
+		}
+	}
+	if !active.Active {
+		return nil, nil, ErrTokenInactive
+	}
+	return &claims, rawClaims, nil
+}
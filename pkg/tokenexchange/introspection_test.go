@@ -0,0 +1,175 @@
+package tokenexchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var resourceServerID = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/server")
+
+// newIntrospectionServer serves introspection requests authenticated with
+// JWT-SVIDs issued by ca to resourceServerID, responding with the claims
+// returned by respond and counting the requests.
+func newIntrospectionServer(t *testing.T, ca *spiffetest.CA, respond func(token string) (int, map[string]any)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("invalid request: %v", err)
+		}
+		if got := r.PostForm.Get("client_assertion_type"); got != ClientAssertionTypeJWTSVID {
+			t.Errorf("client_assertion_type = %q, want %q", got, ClientAssertionTypeJWTSVID)
+		}
+		svid, err := jwtsvid.ParseAndValidate(r.PostForm.Get("client_assertion"), ca.JWTBundle(), []string{server.URL})
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid_client")
+			return
+		}
+		if svid.ID != resourceServerID {
+			t.Errorf("client assertion subject = %s, want %s", svid.ID, resourceServerID)
+		}
+		status, claims := respond(r.PostForm.Get("token"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(claims)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// newIntrospectorFor returns an Introspector for server, authenticating with
+// JWT-SVIDs issued by ca to resourceServerID.
+func newIntrospectorFor(t *testing.T, ca *spiffetest.CA, server *httptest.Server, cacheTTL time.Duration) *Introspector {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addr := spiffetest.New(t, ca, spiffetest.WithIDs(resourceServerID)).Addr()
+	wlClient, err := workloadapi.New(ctx, workloadapi.WithAddr(addr))
+	if err != nil {
+		t.Fatalf("failed to create workload client: %v", err)
+	}
+	t.Cleanup(func() { _ = wlClient.Close() })
+	endpoint := func() string { return server.URL }
+	return NewIntrospector(endpoint, server.Client(), NewJWTSVIDSource(wlClient, endpoint), cacheTTL)
+}
+
+func activeClaims(exp time.Time) map[string]any {
+	return map[string]any{"active": true, "sub": "spiffe://example.org/ns/demo/sa/client", "scope": "ping:read", "exp": exp.Unix()}
+}
+
+func TestIntrospectorCachesActiveTokens(t *testing.T) {
+	ca := spiffetest.NewCA(t, resourceServerID.TrustDomain())
+	server, requests := newIntrospectionServer(t, ca, func(string) (int, map[string]any) {
+		return http.StatusOK, activeClaims(time.Now().Add(time.Hour))
+	})
+	i := newIntrospectorFor(t, ca, server, time.Minute)
+
+	for range 2 {
+		claims, raw, err := i.Introspect(context.Background(), "token")
+		if err != nil {
+			t.Fatalf("Introspect() error = %v", err)
+		}
+		if claims.Subject != "spiffe://example.org/ns/demo/sa/client" || claims.Scope != "ping:read" || raw["active"] != true {
+			t.Errorf("Introspect() = %+v, %v", claims, raw)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("made %d introspection requests, want 1", n)
+	}
+
+	// Results are cached per token.
+	if _, _, err := i.Introspect(context.Background(), "other-token"); err != nil {
+		t.Fatalf("Introspect() error = %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("made %d introspection requests, want 2", n)
+	}
+}
+
+func TestIntrospectorDoesNotCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		cacheTTL time.Duration
+		claims   map[string]any
+	}{
+		{"caching disabled", 0, activeClaims(time.Now().Add(time.Hour))},
+		{"expired token", time.Minute, activeClaims(time.Now().Add(-time.Second))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := spiffetest.NewCA(t, resourceServerID.TrustDomain())
+			server, requests := newIntrospectionServer(t, ca, func(string) (int, map[string]any) {
+				return http.StatusOK, tt.claims
+			})
+			i := newIntrospectorFor(t, ca, server, tt.cacheTTL)
+
+			for range 2 {
+				if _, _, err := i.Introspect(context.Background(), "token"); err != nil {
+					t.Fatalf("Introspect() error = %v", err)
+				}
+			}
+			if n := requests.Load(); n != 2 {
+				t.Errorf("made %d introspection requests, want 2", n)
+			}
+		})
+	}
+}
+
+func TestIntrospectorRejectsInactiveTokens(t *testing.T) {
+	ca := spiffetest.NewCA(t, resourceServerID.TrustDomain())
+	server, requests := newIntrospectionServer(t, ca, func(string) (int, map[string]any) {
+		return http.StatusOK, map[string]any{"active": false}
+	})
+	i := newIntrospectorFor(t, ca, server, time.Minute)
+
+	for range 2 {
+		if _, _, err := i.Introspect(context.Background(), "token"); !errors.Is(err, ErrTokenInactive) {
+			t.Fatalf("Introspect() error = %v, want %v", err, ErrTokenInactive)
+		}
+	}
+	// Inactive results are not cached, so revocation takes effect immediately.
+	if n := requests.Load(); n != 2 {
+		t.Errorf("made %d introspection requests, want 2", n)
+	}
+}
+
+func TestIntrospectorReturnsOAuthErrors(t *testing.T) {
+	ca := spiffetest.NewCA(t, resourceServerID.TrustDomain())
+	server, _ := newIntrospectionServer(t, ca, func(string) (int, map[string]any) {
+		return http.StatusBadRequest, map[string]any{"error": "invalid_request"}
+	})
+	i := newIntrospectorFor(t, ca, server, time.Minute)
+
+	_, _, err := i.Introspect(context.Background(), "token")
+	var oerr *OAuthError
+	if !errors.As(err, &oerr) || oerr.Code != "invalid_request" {
+		t.Errorf("Introspect() error = %v, want invalid_request", err)
+	}
+}
+
+func TestIntrospectorAuthenticatesWithJWTSVID(t *testing.T) {
+	// The endpoint does not trust SVIDs issued by the client's CA.
+	server, _ := newIntrospectionServer(t, spiffetest.NewCA(t, resourceServerID.TrustDomain()), func(string) (int, map[string]any) {
+		return http.StatusOK, activeClaims(time.Now().Add(time.Hour))
+	})
+	i := newIntrospectorFor(t, spiffetest.NewCA(t, resourceServerID.TrustDomain()), server, time.Minute)
+
+	_, _, err := i.Introspect(context.Background(), "token")
+	var oerr *OAuthError
+	if !errors.As(err, &oerr) || oerr.Code != "invalid_client" {
+		t.Errorf("Introspect() error = %v, want invalid_client", err)
+	}
+}
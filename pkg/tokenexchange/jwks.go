@@ -0,0 +1,214 @@
+package tokenexchange
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksDefaultTTL is how long a JWKS is cached when the response carries no
+	// usable Cache-Control or Expires header.
+	jwksDefaultTTL = 5 * time.Minute
+	// jwksMinRefreshInterval bounds how often the JWKS is fetched, both by the
+	// background refresh and when a token's kid is not in the cached set.
+	jwksMinRefreshInterval = 30 * time.Second
+	// jwksMaxTTL caps the lifetime advertised by the JWKS response.
+	jwksMaxTTL = 24 * time.Hour
+	// jwksRefreshFraction is the fraction of the cached set's lifetime after
+	// which Run refreshes it, so that a slow or failed refresh is retried
+	// before the set expires.
+	jwksRefreshFraction = 0.8
+)
+
+// JWKSFetcher fetches and caches a JSON Web Key Set from a remote URL. Run
+// refreshes the set in the background before it expires, honouring the
+// response's Cache-Control and Expires headers. If a refresh fails, the last
+// successfully fetched set continues to be served.
+type JWKSFetcher struct {
+	// url returns the current JWKS URL.
+	url    func() string
+	client *http.Client
+
+	// OnRefresh, if set, is called after each fetch of the JWKS with its
+	// error, if any, for example to record metrics. It must be set before
+	// the fetcher is used.
+	OnRefresh func(err error)
+	// OnLookup, if set, is called by GetJWKS with whether the cached set was
+	// served without a fetch. It must be set before the fetcher is used.
+	OnLookup func(hit bool)
+
+	mu        sync.RWMutex
+	jwks      *jose.JSONWebKeySet
+	expiry    time.Time
+	lastFetch time.Time
+	group     singleflight.Group
+}
+
+// NewJWKSFetcher returns a JWKSFetcher for the JWKS at the URL returned by url.
+func NewJWKSFetcher(url func() string, client *http.Client) *JWKSFetcher {
+	return &JWKSFetcher{url: url, client: client}
+}
+
+// Run refreshes the JWKS once jwksRefreshFraction of the cached set's lifetime
+// has elapsed until ctx is cancelled. Failed refreshes are retried after
+// jwksMinRefreshInterval.
+func (f *JWKSFetcher) Run(ctx context.Context) {
+	for {
+		delay := jwksMinRefreshInterval
+		if _, err := f.refresh(ctx); err != nil {
+			slog.Warn("Failed to refresh JWKS, serving cached keys", "error", err)
+		} else {
+			f.mu.RLock()
+			ttl := f.expiry.Sub(f.lastFetch)
+			delay = max(time.Until(f.lastFetch.Add(time.Duration(float64(ttl)*jwksRefreshFraction))), jwksMinRefreshInterval)
+			f.mu.RUnlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// GetJWKS returns the cached JWKS. If kid is non-empty and not in the cached
+// set, the set is refetched, at most once per jwksMinRefreshInterval, so that
+// tokens signed with a newly rotated key are accepted without waiting for the
+// next scheduled refresh. The JWKS is fetched synchronously if none is cached
+// or the cached set has expired; if that fetch fails, a stale set is returned.
+// Apart from the first fetch, fetches are made at most once per
+// jwksMinRefreshInterval, so that while the JWKS endpoint is unreachable
+// requests are served the stale set without waiting on it.
+func (f *JWKSFetcher) GetJWKS(ctx context.Context, kid string) (*jose.JSONWebKeySet, error) {
+	f.mu.RLock()
+	jwks, expiry, lastFetch := f.jwks, f.expiry, f.lastFetch
+	f.mu.RUnlock()
+
+	hit := true
+	defer func() {
+		if f.OnLookup != nil {
+			f.OnLookup(hit)
+		}
+	}()
+
+	if jwks == nil {
+		hit = false
+		return f.refresh(ctx)
+	}
+	expired := time.Now().After(expiry)
+	unknownKID := kid != "" && len(jwks.Key(kid)) == 0
+	if !expired && !unknownKID || time.Since(lastFetch) < jwksMinRefreshInterval {
+		return jwks, nil
+	}
+	if unknownKID {
+		slog.Info("Token key ID not found in JWKS, refreshing", "kid", kid)
+	}
+	hit = false
+
+	refreshed, err := f.refresh(ctx)
+	if err != nil {
+		slog.Warn("Failed to refresh JWKS, serving cached keys", "error", err)
+		return jwks, nil
+	}
+	return refreshed, nil
+}
+
+// refresh fetches the JWKS and updates the cache. Concurrent refreshes share a
+// single request, made with the context of the first caller without its
+// cancellation, so that one caller giving up does not fail the others.
+func (f *JWKSFetcher) refresh(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	v, err, _ := f.group.Do("", func() (any, error) {
+		jwks, ttl, err := f.fetch(context.WithoutCancel(ctx))
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.lastFetch = time.Now()
+		if f.OnRefresh != nil {
+			f.OnRefresh(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.jwks = jwks
+		f.expiry = f.lastFetch.Add(ttl)
+		slog.Debug("Refreshed JWKS", "keys", len(jwks.Keys), "expiry", f.expiry.Format(time.RFC3339))
+		return jwks, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*jose.JSONWebKeySet), nil
+}
+
+// fetch retrieves and parses the JWKS from the remote URL, returning it with
+// the cache lifetime advertised by the response.
+func (f *JWKSFetcher) fetch(ctx context.Context) (_ *jose.JSONWebKeySet, _ time.Duration, err error) {
+	url := f.url()
+	ctx, span := tracer.Start(ctx, "FetchJWKS", trace.WithAttributes(attribute.String("url.full", url)))
+	defer func() { endSpan(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var jwks jose.JSONWebKeySet
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if err != nil {
+		return nil, 0, err
+	}
+	span.SetAttributes(attribute.Int("jwks.keys", len(jwks.Keys)))
+	return &jwks, cacheTTL(resp.Header), nil
+}
+
+// cacheTTL returns the cache lifetime given by the Cache-Control max-age
+// directive or, failing that, the Expires header, clamped to
+// [jwksMinRefreshInterval, jwksMaxTTL]. no-cache and no-store yield the
+// minimum. Without either header it returns jwksDefaultTTL.
+func cacheTTL(h http.Header) time.Duration {
+	ttl := jwksDefaultTTL
+	if cc := h.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-cache", "no-store":
+				return jwksMinRefreshInterval
+			case "max-age":
+				if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+					return min(max(time.Duration(seconds)*time.Second, jwksMinRefreshInterval), jwksMaxTTL)
+				}
+			}
+		}
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			ttl = time.Until(t)
+		} else {
+			// Invalid dates, such as "0", mean already expired.
+			ttl = 0
+		}
+	}
+	return min(max(ttl, jwksMinRefreshInterval), jwksMaxTTL)
+}
@@ -0,0 +1,199 @@
+package tokenexchange
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// jwksServer serves a JWKS holding the keys with the given IDs, counting the
+// requests.
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mu     sync.Mutex
+	kids   []string
+	status int
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	s := &jwksServer{kids: kids, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		kids, status := s.kids, s.status
+		s.mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		var jwks jose.JSONWebKeySet
+		for _, kid := range kids {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Errorf("failed to generate key: %v", err)
+			}
+			jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: key.Public(), KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"})
+		}
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(status int, kids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.kids = status, kids
+}
+
+func newJWKSFetcherFor(s *jwksServer) (*JWKSFetcher, *[]bool) {
+	f := NewJWKSFetcher(func() string { return s.URL }, s.Client())
+	var lookups []bool
+	f.OnLookup = func(hit bool) { lookups = append(lookups, hit) }
+	return f, &lookups
+}
+
+// ageJWKS makes the cached set of f look as if it was fetched d ago.
+func ageJWKS(f *JWKSFetcher, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastFetch = f.lastFetch.Add(-d)
+	f.expiry = f.expiry.Add(-d)
+}
+
+func TestJWKSFetcherCachesKeys(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	f, lookups := newJWKSFetcherFor(s)
+
+	for range 3 {
+		jwks, err := f.GetJWKS(context.Background(), "a")
+		if err != nil {
+			t.Fatalf("GetJWKS() error = %v", err)
+		}
+		if len(jwks.Key("a")) != 1 {
+			t.Fatalf("GetJWKS() = %+v, want key a", jwks)
+		}
+	}
+	if n := s.fetches.Load(); n != 1 {
+		t.Errorf("fetched the JWKS %d times, want 1", n)
+	}
+	if want := []bool{false, true, true}; !slices.Equal(*lookups, want) {
+		t.Errorf("lookups = %v, want %v", *lookups, want)
+	}
+}
+
+func TestJWKSFetcherRefreshesForUnknownKeyID(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	f, _ := newJWKSFetcherFor(s)
+	if _, err := f.GetJWKS(context.Background(), "a"); err != nil {
+		t.Fatalf("GetJWKS() error = %v", err)
+	}
+	s.set(http.StatusOK, "a", "b")
+
+	// Unknown key IDs do not trigger a fetch more than once per
+	// jwksMinRefreshInterval, so that forged tokens cannot flood the endpoint.
+	jwks, err := f.GetJWKS(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("GetJWKS() error = %v", err)
+	}
+	if len(jwks.Key("b")) != 0 || s.fetches.Load() != 1 {
+		t.Errorf("refetched the JWKS within the minimum refresh interval")
+	}
+
+	ageJWKS(f, jwksMinRefreshInterval)
+	jwks, err = f.GetJWKS(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("GetJWKS() error = %v", err)
+	}
+	if len(jwks.Key("b")) != 1 {
+		t.Errorf("GetJWKS() = %+v, want the rotated key b", jwks)
+	}
+	if n := s.fetches.Load(); n != 2 {
+		t.Errorf("fetched the JWKS %d times, want 2", n)
+	}
+}
+
+func TestJWKSFetcherServesStaleKeysDuringOutage(t *testing.T) {
+	s := newJWKSServer(t, "a")
+	f, _ := newJWKSFetcherFor(s)
+	var refreshErrors atomic.Int32
+	f.OnRefresh = func(err error) {
+		if err != nil {
+			refreshErrors.Add(1)
+		}
+	}
+	if _, err := f.GetJWKS(context.Background(), "a"); err != nil {
+		t.Fatalf("GetJWKS() error = %v", err)
+	}
+	s.set(http.StatusServiceUnavailable)
+	ageJWKS(f, jwksDefaultTTL+time.Minute)
+
+	jwks, err := f.GetJWKS(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("GetJWKS() error = %v", err)
+	}
+	if len(jwks.Key("a")) != 1 {
+		t.Errorf("GetJWKS() = %+v, want the stale key a", jwks)
+	}
+	if n := refreshErrors.Load(); n != 1 {
+		t.Errorf("OnRefresh reported %d errors, want 1", n)
+	}
+
+	// The failed refresh is not retried on every request.
+	if _, err := f.GetJWKS(context.Background(), "a"); err != nil {
+		t.Fatalf("GetJWKS() error = %v", err)
+	}
+	if n := s.fetches.Load(); n != 2 {
+		t.Errorf("fetched the JWKS %d times, want 2", n)
+	}
+}
+
+func TestJWKSFetcherFailsWithoutKeys(t *testing.T) {
+	s := newJWKSServer(t)
+	s.set(http.StatusInternalServerError)
+	f, _ := newJWKSFetcherFor(s)
+
+	if _, err := f.GetJWKS(context.Background(), "a"); err == nil {
+		t.Error("GetJWKS() succeeded without a JWKS")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"no headers", http.Header{}, jwksDefaultTTL},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=600"}}, 10 * time.Minute},
+		{"max-age below minimum", http.Header{"Cache-Control": {"max-age=1"}}, jwksMinRefreshInterval},
+		{"max-age above maximum", http.Header{"Cache-Control": {"max-age=31536000"}}, jwksMaxTTL},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, jwksMinRefreshInterval},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=600"}, "Expires": {"0"}}, 10 * time.Minute},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, jwksMinRefreshInterval},
+	}
+	for _, tt := range tests {
+		if got := cacheTTL(tt.header); got != tt.want {
+			t.Errorf("%s: cacheTTL() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	expires := http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}
+	if got := cacheTTL(expires); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("Expires in an hour: cacheTTL() = %s, want about 1h", got)
+	}
+}
@@ -0,0 +1,74 @@
+package tokenexchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OAuthError is an RFC 6749 §5.2 error response, parsed from token and
+// introspection endpoint responses by Client and Introspector.
+type OAuthError struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	URI         string `json:"error_uri,omitempty"`
+	// RetryAfter is the delay requested by a Retry-After header, if any.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *OAuthError) Error() string {
+	msg := fmt.Sprintf("token endpoint returned status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+// Retryable reports whether the request may succeed if retried: the server
+// was rate limiting or failed with a 5xx status. Errors such as invalid_grant
+// or invalid_target are terminal.
+func (e *OAuthError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// parseOAuthError builds an OAuthError from a non-200 token endpoint
+// response. Bodies that are not RFC 6749 error responses are kept as the
+// description.
+func parseOAuthError(resp *http.Response, body []byte) *OAuthError {
+	oerr := &OAuthError{}
+	if err := json.Unmarshal(body, oerr); err != nil || oerr.Code == "" {
+		oerr = &OAuthError{Description: truncate(string(body), 256)}
+	}
+	oerr.StatusCode = resp.StatusCode
+	oerr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	return oerr
+}
+
+// parseRetryAfter parses a Retry-After header given as either delay seconds
+// or an HTTP date. It returns zero if the header is absent or invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
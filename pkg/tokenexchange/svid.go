@@ -0,0 +1,74 @@
+package tokenexchange
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// JWTSVIDSource fetches and caches a JWT-SVID for a given audience, refreshing
+// it when it is within one minute of expiry or the audience changes.
+type JWTSVIDSource struct {
+	wlClient *workloadapi.Client
+	// audience returns the audience the SVID must be issued for.
+	audience func() string
+
+	// OnFetch, if set, is called after each fetch from the workload API with
+	// the fetched SVID or the error, for example to record metrics. It must be
+	// set before the source is used.
+	OnFetch func(svid *jwtsvid.SVID, err error)
+
+	mu   sync.Mutex
+	svid *jwtsvid.SVID
+}
+
+// NewJWTSVIDSource returns a JWTSVIDSource fetching JWT-SVIDs from wlClient for
+// the audience returned by audience, such as Provider.TokenEndpoint.
+func NewJWTSVIDSource(wlClient *workloadapi.Client, audience func() string) *JWTSVIDSource {
+	return &JWTSVIDSource{wlClient: wlClient, audience: audience}
+}
+
+// GetSVID returns a valid JWT-SVID, fetching a new one from the workload API when
+// the cached SVID is absent or within one minute of expiry.
+func (s *JWTSVIDSource) GetSVID(ctx context.Context) (*jwtsvid.SVID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	audience := s.audience()
+	if s.svid == nil || time.Until(s.svid.Expiry) < time.Minute || !slices.Contains(s.svid.Audience, audience) {
+		slog.Info("Fetching JWT-SVID", "audience", audience)
+		svid, err := s.fetch(ctx, audience)
+		if err != nil {
+			if s.svid != nil && time.Now().Before(s.svid.Expiry) {
+				slog.Warn("Failed to refresh JWT-SVID, using cached SVID", "error", err)
+				return s.svid, nil
+			}
+			return nil, fmt.Errorf("failed to obtain JWT-SVID: %w", err)
+		}
+		s.svid = svid
+		slog.Info("Fetched JWT-SVID", "id", svid.ID.String(), "expiry", svid.Expiry.Format(time.RFC3339))
+	} else {
+		slog.Debug("Using cached JWT-SVID", "id", s.svid.ID.String(), "expiry", s.svid.Expiry.Format(time.RFC3339))
+	}
+	return s.svid, nil
+}
+
+// fetch fetches a JWT-SVID for audience from the workload API.
+func (s *JWTSVIDSource) fetch(ctx context.Context, audience string) (*jwtsvid.SVID, error) {
+	ctx, span := tracer.Start(ctx, "FetchJWTSVID", trace.WithAttributes(AttrAudience.String(audience)))
+	svid, err := s.wlClient.FetchJWTSVID(ctx, jwtsvid.Params{Audience: audience})
+	if err == nil {
+		span.SetAttributes(AttrSPIFFEID.String(svid.ID.String()))
+	}
+	endSpan(span, err)
+	if s.OnFetch != nil {
+		s.OnFetch(svid, err)
+	}
+	return svid, err
+}
@@ -0,0 +1,54 @@
+package tokenexchange
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attributes recorded by the package, for use by callers adding their own
+// spans to the same traces.
+const (
+	// AttrSPIFFEID is the SPIFFE ID of a fetched JWT-SVID.
+	AttrSPIFFEID = attribute.Key("spiffe.id")
+	// AttrSubject is the SPIFFE ID of a token's subject.
+	AttrSubject = attribute.Key("spiffe.subject")
+	// AttrActors is the delegation chain of a token, in hop order.
+	AttrActors = attribute.Key("spiffe.actors")
+	// AttrAudience is the audience a token is requested or validated for.
+	AttrAudience = attribute.Key("oauth.audience")
+	// AttrDelegated reports whether a token exchange is delegated.
+	AttrDelegated = attribute.Key("oauth.delegated")
+	// AttrErrorCode is the OAuth error code of a failed token exchange.
+	AttrErrorCode = attribute.Key("oauth.error")
+	// AttrFailureReason is the Reason of a failed authentication.
+	AttrFailureReason = attribute.Key("auth.failure_reason")
+)
+
+// tracer creates the package's spans. It uses the global tracer provider,
+// which records nothing unless the program configures one.
+var tracer trace.Tracer = otel.Tracer("github.com/cofide/cofide-demos/pkg/tokenexchange")
+
+// endSpan ends span, recording err if it is non-nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SpanAttributes returns span attributes describing the principal's subject
+// and delegation chain.
+func (p *Principal) SpanAttributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{AttrSubject.String(p.Subject.String())}
+	if len(p.Actors) > 0 {
+		actors := make([]string, len(p.Actors))
+		for i, actor := range p.Actors {
+			actors[i] = actor.String()
+		}
+		attrs = append(attrs, AttrActors.StringSlice(actors))
+	}
+	return attrs
+}
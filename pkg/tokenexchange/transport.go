@@ -0,0 +1,126 @@
+package tokenexchange
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper that authorizes each request with an
+// access token for the request's destination, obtained by token exchange.
+//
+// By default the caller's own JWT-SVID is exchanged. If the request context
+// carries a subject token set with WithSubjectToken, a delegated exchange is
+// performed instead, with the JWT-SVID as the actor token, so that a service
+// can call downstream on behalf of its own caller.
+type Transport struct {
+	// Base sends the authorized requests. If nil, http.DefaultTransport is
+	// used.
+	Base http.RoundTripper
+	// Exchanger performs the exchanges, typically a CachingClient so that
+	// tokens are reused across requests to the same audience.
+	Exchanger Exchanger
+	// SVIDSource provides the JWT-SVID used as client assertion and as subject
+	// or actor token. Its audience must be the token endpoint.
+	SVIDSource *JWTSVIDSource
+	// Audience returns the audience to request a token for, usually the SPIFFE
+	// ID of the request's destination.
+	Audience func(req *http.Request) (string, error)
+	// Scopes are requested in each exchange.
+	Scopes []string
+	// DPoP, if set, sends tokens with the DPoP scheme and a proof for each
+	// request. It must be the signer the Exchanger's Client was created with.
+	DPoP *DPoPSigner
+}
+
+// StaticAudience returns an Audience function for a Transport whose requests
+// all go to the same destination.
+func StaticAudience(audience string) func(*http.Request) (string, error) {
+	return func(*http.Request) (string, error) { return audience, nil }
+}
+
+type subjectTokenKey struct{}
+
+// WithSubjectToken returns a context that makes a Transport perform a
+// delegated exchange of the given access token, such as Principal.Token.
+func WithSubjectToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, subjectTokenKey{}, token)
+}
+
+// ExchangeError reports a failure to obtain an access token for a request,
+// distinguishing it from failures to send the request itself.
+type ExchangeError struct {
+	Err error
+}
+
+func (e *ExchangeError) Error() string { return "token exchange failed: " + e.Err.Error() }
+func (e *ExchangeError) Unwrap() error { return e.Err }
+
+// RoundTrip obtains an access token for req and sends req with it. Failures to
+// obtain the token are returned as *ExchangeError.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authorized, err := t.authorize(req)
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base().RoundTrip(authorized)
+}
+
+// authorize returns a copy of req carrying an access token for its audience.
+func (t *Transport) authorize(req *http.Request) (*http.Request, error) {
+	ctx := req.Context()
+	audience, err := t.Audience(req)
+	if err != nil {
+		return nil, &ExchangeError{Err: fmt.Errorf("failed to determine audience: %w", err)}
+	}
+	svid, err := t.SVIDSource.GetSVID(ctx)
+	if err != nil {
+		return nil, &ExchangeError{Err: err}
+	}
+
+	params := Params{
+		ClientAssertionType: ClientAssertionTypeJWTSVID,
+		ClientAssertion:     svid.Marshal(),
+		SubjectTokenType:    TokenTypeJWTSVID,
+		SubjectToken:        svid.Marshal(),
+		Audience:            audience,
+		Scopes:              t.Scopes,
+	}
+	subjectToken, delegated := ctx.Value(subjectTokenKey{}).(string)
+	if delegated {
+		params.SubjectTokenType = TokenTypeAccessToken
+		params.SubjectToken = subjectToken
+		params.ActorTokenType = TokenTypeJWTSVID
+		params.ActorToken = svid.Marshal()
+	}
+	result, err := t.Exchanger.Exchange(ctx, params)
+	if err != nil {
+		return nil, &ExchangeError{Err: err}
+	}
+	slog.Debug("Obtained access token via token exchange", "id", svid.ID, "audience", audience, "delegated", delegated)
+
+	// A RoundTripper must not modify the caller's request.
+	req = req.Clone(ctx)
+	if t.DPoP == nil {
+		req.Header.Set("Authorization", "Bearer "+result.Token)
+		return req, nil
+	}
+	proof, err := t.DPoP.Proof(req.Method, req.URL.String(), result.Token)
+	if err != nil {
+		return nil, &ExchangeError{Err: fmt.Errorf("failed to create DPoP proof: %w", err)}
+	}
+	req.Header.Set("Authorization", DPoPScheme+" "+result.Token)
+	req.Header.Set(DPoPHeader, proof)
+	return req, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
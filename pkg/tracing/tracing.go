@@ -0,0 +1,113 @@
+// Package tracing configures OpenTelemetry tracing for the demo workloads from
+// the standard OTEL_* environment variables.
+//
+// Tracing is off unless OTEL_TRACES_EXPORTER selects an exporter: otlp sends
+// spans to an OTLP collector configured by OTEL_EXPORTER_OTLP_ENDPOINT and the
+// related variables, and console writes them to stdout for local runs. W3C
+// trace context is propagated either way, so that a workload without an
+// exporter does not break the traces of the workloads it sits between.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+)
+
+// Exporters selected by OTEL_TRACES_EXPORTER.
+const (
+	ExporterOTLP    = "otlp"
+	ExporterConsole = "console"
+	ExporterNone    = "none"
+)
+
+// Setup installs the global tracer provider and propagator. serviceName is the
+// service.name resource attribute unless OTEL_SERVICE_NAME or
+// OTEL_RESOURCE_ATTRIBUTES sets one. The returned function flushes buffered
+// spans and must be called before the process exits.
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	names := exporterNames()
+	if len(names) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	for _, name := range names {
+		exporter, err := newExporter(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "exporters", names)
+	return provider.Shutdown, nil
+}
+
+// exporterNames returns the exporters listed in OTEL_TRACES_EXPORTER, which
+// defaults to none rather than otlp so that the demos run without a collector.
+func exporterNames() []string {
+	if disabled, _ := os.LookupEnv("OTEL_SDK_DISABLED"); strings.EqualFold(disabled, "true") {
+		return nil
+	}
+	var names []string
+	for name := range strings.SplitSeq(os.Getenv("OTEL_TRACES_EXPORTER"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && name != ExporterNone {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func newExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case ExporterOTLP:
+		switch protocol := otlpProtocol(); protocol {
+		case "grpc":
+			return otlptracegrpc.New(ctx)
+		case "http/protobuf":
+			return otlptracehttp.New(ctx)
+		default:
+			return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+		}
+	case ExporterConsole:
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q", name)
+	}
+}
+
+// otlpProtocol returns the OTLP transport protocol, from
+// OTEL_EXPORTER_OTLP_TRACES_PROTOCOL or OTEL_EXPORTER_OTLP_PROTOCOL.
+func otlpProtocol() string {
+	for _, variable := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if v, ok := os.LookupEnv(variable); ok && v != "" {
+			return v
+		}
+	}
+	return "http/protobuf"
+}
@@ -0,0 +1,116 @@
+// Package whoami describes the identity a ping-pong server authenticated a
+// request with, and serves it as JSON so that demo users and integration
+// tests can check which identity was seen end to end.
+//
+// Servers authenticate each request, store the result in the request context
+// with NewContext, and register Handler at Path behind that authentication.
+package whoami
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Path is the path servers expose the identity endpoint on.
+const Path = "/whoami"
+
+// Authentication mechanisms reported in Identity.Mechanism.
+const (
+	// MechanismMTLS authenticates the peer by its X.509-SVID.
+	MechanismMTLS = "mtls"
+	// MechanismJWTSVID authenticates the peer by a JWT-SVID bearer token.
+	MechanismJWTSVID = "jwt-svid"
+	// MechanismExchangedToken authenticates the peer by an access token
+	// obtained by OAuth 2.0 token exchange.
+	MechanismExchangedToken = "exchanged-token"
+	// MechanismMesh leaves authentication to a service mesh sidecar, which
+	// reports the peer in the X-Forwarded-Client-Cert header.
+	MechanismMesh = "mesh"
+)
+
+// Identity is the identity a request was authenticated with.
+type Identity struct {
+	// PeerID is the SPIFFE ID of the authenticated caller: the token subject,
+	// or the SPIFFE ID of the client certificate.
+	PeerID string `json:"peer_id,omitempty"`
+	// Mechanism is how the caller was authenticated, one of the Mechanism
+	// constants.
+	Mechanism string `json:"mechanism"`
+	// ServerID is the SPIFFE ID of the server itself.
+	ServerID string `json:"server_id,omitempty"`
+	// Token describes the token the caller presented, if any.
+	Token *Token `json:"token,omitempty"`
+	// Certificate describes the client certificate, if any.
+	Certificate *Certificate `json:"certificate,omitempty"`
+}
+
+// Token holds the claims of a JWT-SVID or access token.
+type Token struct {
+	Subject string `json:"sub"`
+	// Actors is the delegation chain of an exchanged token in hop order,
+	// ending with the immediate caller.
+	Actors   []string  `json:"actors,omitempty"`
+	Audience []string  `json:"aud,omitempty"`
+	Issuer   string    `json:"iss,omitempty"`
+	Scopes   []string  `json:"scopes,omitempty"`
+	Expiry   time.Time `json:"exp,omitzero"`
+}
+
+// Certificate holds the details of an X.509 certificate.
+type Certificate struct {
+	SPIFFEID     string    `json:"spiffe_id,omitempty"`
+	Subject      string    `json:"subject,omitempty"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+}
+
+// NewCertificate returns the details of cert. SPIFFEID is empty if cert is not
+// an X.509-SVID.
+func NewCertificate(cert *x509.Certificate) *Certificate {
+	c := &Certificate{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+	if id, err := x509svid.IDFromCert(cert); err == nil {
+		c.SPIFFEID = id.String()
+	}
+	return c
+}
+
+type identityKey struct{}
+
+// NewContext returns a context carrying the identity of the request.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx by NewContext.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// Handler writes the identity of the request as JSON. Requests that were not
+// authenticated are rejected with 401.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	id, ok := FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(id); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
@@ -12,28 +12,38 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
-const socketPath = "unix:///spiffe-workload-api/spire-agent.sock"
+const defaultSocketPath = "unix:///spiffe-workload-api/spire-agent.sock"
 
 func main() {
-	if err := run(context.Background()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
 
 func run(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
-	defer cancel()
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	checker := health.NewChecker()
+	checker.Run(ctx, healthConfig.Port)
 
 	var tlsConfig *tls.Config
 	enableTLS := strings.ToLower(os.Getenv("ENABLE_TLS")) == "true"
 	if enableTLS {
 		slog.Info("Waiting for X.509 SVID")
-		source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(socketPath)))
+		initCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+		defer cancel()
+		source, err := workloadapi.NewX509Source(initCtx, workloadapi.WithClientOptions(workloadapi.WithAddr(getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", defaultSocketPath))))
 		if err != nil {
 			return fmt.Errorf("unable to create X509Source: %w", err)
 		}
@@ -41,6 +51,7 @@ func run(ctx context.Context) error {
 			_ = source.Close()
 		}()
 		slog.Info("Retrieved X.509 SVID")
+		checker.AddReadinessCheck("x509-svid", health.X509SVIDCheck(source, healthConfig.SVIDExpiryMargin))
 
 		var consumerSPIFFEID string
 		consumerSPIFFEID, ok := os.LookupEnv("CONSUMER_SPIFFE_ID")
@@ -65,17 +76,29 @@ func run(ctx context.Context) error {
 	}
 
 	serverAddress := os.Getenv("CONSUMER_SERVER_ADDRESS")
+	checker.MarkStarted()
 	for {
-		err := getBuckets(client, serverAddress)
+		err := getBuckets(ctx, client, serverAddress)
+		if ctx.Err() != nil {
+			slog.Info("Client stopped")
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		time.Sleep(5 * time.Second)
+		if !graceful.Sleep(ctx, 5*time.Second) {
+			slog.Info("Client stopped")
+			return nil
+		}
 	}
 }
 
-func getBuckets(client http.Client, serverAddress string) error {
-	resp, err := client.Get(serverAddress + "/buckets")
+func getBuckets(ctx context.Context, client http.Client, serverAddress string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverAddress+"/buckets", nil)
+	if err != nil {
+		return fmt.Errorf("invalid server address %q: %w", serverAddress, err)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("error connecting to %q: %w", serverAddress, err)
 	}
@@ -95,3 +118,11 @@ func getBuckets(client http.Client, serverAddress string) error {
 	log.Printf("Buckets Found: %s", body)
 	return nil
 }
+
+func getEnvWithDefault(variable string, defaultValue string) string {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	return v
+}
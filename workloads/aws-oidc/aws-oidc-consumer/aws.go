@@ -16,8 +16,15 @@ import (
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
+const (
+	awsRegion = "eu-west-1"
+	// stsEndpoint is the regional STS endpoint used to exchange the JWT-SVID
+	// for AWS credentials.
+	stsEndpoint = "https://sts." + awsRegion + ".amazonaws.com/"
+)
+
 func loadAWSConfig(retriever *JWTSVIDRetriever) (*aws.Config, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-1"))
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(awsRegion))
 	if err != nil {
 		return nil, fmt.Errorf("unable to load SDK config, %w", err)
 	}
@@ -11,6 +11,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
 	"github.com/gin-gonic/gin"
 	"github.com/spiffe/go-spiffe/v2/logger"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
@@ -19,20 +21,27 @@ import (
 )
 
 const (
-	audience    = "consumer-workload"
-	sessionName = "consumer-workload-session"
-	socketPath  = "unix:///spiffe-workload-api/spire-agent.sock"
+	audience          = "consumer-workload"
+	sessionName       = "consumer-workload-session"
+	defaultSocketPath = "unix:///spiffe-workload-api/spire-agent.sock"
 )
 
 func main() {
-	if err := run(context.Background()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx); err != nil {
 		log.Fatal("", err)
 	}
 }
 
 func run(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	checker := health.NewChecker()
+	checker.Run(ctx, healthConfig.Port)
+	checker.AddReadinessCheck("sts", health.HTTPCheck(&http.Client{}, stsEndpoint))
 
 	router := gin.Default()
 	router.GET("/", getRoot)
@@ -42,10 +51,12 @@ func run(ctx context.Context) error {
 	enableTLS := strings.ToLower(os.Getenv("ENABLE_TLS")) == "true"
 	if enableTLS {
 		slog.Info("Waiting for X.509 SVID")
+		initCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
 		source, err := workloadapi.NewX509Source(
-			ctx,
+			initCtx,
 			workloadapi.WithClientOptions(
-				workloadapi.WithAddr(socketPath),
+				workloadapi.WithAddr(getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", defaultSocketPath)),
 				workloadapi.WithLogger(logger.Std),
 			),
 		)
@@ -56,6 +67,7 @@ func run(ctx context.Context) error {
 			_ = source.Close()
 		}()
 		slog.Info("Retrieved X.509 SVID")
+		checker.AddReadinessCheck("x509-svid", health.X509SVIDCheck(source, healthConfig.SVIDExpiryMargin))
 
 		var analysisSPIFFEID string
 		analysisSPIFFEID, ok := os.LookupEnv("ANALYSIS_SPIFFE_ID")
@@ -73,20 +85,19 @@ func run(ctx context.Context) error {
 	}
 
 	server := &http.Server{
-		Addr:              ":9090",
+		Addr:              getEnvWithDefault("PORT", ":9090"),
 		Handler:           router,
 		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: time.Second * 10,
 	}
 
+	checker.MarkStarted()
+	serve := server.ListenAndServe
 	if enableTLS {
-		if err := server.ListenAndServeTLS("", ""); err != nil {
-			return fmt.Errorf("failed to serve: %w", err)
-		}
-	} else {
-		if err := server.ListenAndServe(); err != nil {
-			return fmt.Errorf("failed to serve: %w", err)
-		}
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+	}
+	if err := graceful.Serve(ctx, server, serve); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
 	}
 	return nil
 }
@@ -100,11 +111,14 @@ func getRoot(c *gin.Context) {
 }
 
 func getBuckets(c *gin.Context) {
-	workloadAPI, err := workloadapi.New(context.Background())
+	workloadAPI, err := workloadapi.New(c.Request.Context())
 	if err != nil {
 		throw500(c, err)
 		return
 	}
+	defer func() {
+		_ = workloadAPI.Close()
+	}()
 
 	retriever := NewJWTSVIDRetriever(workloadAPI, audience)
 
@@ -122,3 +136,11 @@ func getBuckets(c *gin.Context) {
 
 	c.IndentedJSON(http.StatusOK, buckets)
 }
+
+func getEnvWithDefault(variable string, defaultValue string) string {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	return v
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	consumerID = spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/default")
+	analysisID = spiffeid.RequireFromString("spiffe://example.org/ns/analytics/sa/default")
+)
+
+// startConsumer serves a fake consumer over mTLS with an X.509-SVID for id
+// issued by ca, accepting only analysisID, and returns its URL and a count of
+// the bucket requests.
+func startConsumer(t *testing.T, ca *spiffetest.CA, id spiffeid.ID) (string, *atomic.Int32) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	api := spiffetest.New(t, ca, spiffetest.WithIDs(id))
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create X509Source: %v", err)
+	}
+	t.Cleanup(func() { _ = source.Close() })
+
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /buckets", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte(`[{"Name":"bucket"}]`))
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &http.Server{
+		Handler:   mux,
+		TLSConfig: tlsconfig.MTLSServerConfig(source, source, tlsconfig.AuthorizeID(analysisID)),
+	}
+	go func() { _ = server.ServeTLS(l, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+	return "https://" + l.Addr().String(), &requests
+}
+
+// startAnalysis runs the analysis workload with mTLS enabled, issued an SVID
+// for analysisID by ca, against the consumer at url. It returns a function
+// stopping the workload and a channel receiving the result of run.
+func startAnalysis(t *testing.T, ca *spiffetest.CA, url string) (context.CancelFunc, <-chan error) {
+	t.Helper()
+	t.Setenv("ENABLE_TLS", "true")
+	t.Setenv("CONSUMER_TRUST_DOMAIN", exampleOrg.Name())
+	t.Setenv("CONSUMER_SERVER_ADDRESS", url)
+	t.Setenv("SPIFFE_ENDPOINT_SOCKET", spiffetest.New(t, ca, spiffetest.WithIDs(analysisID)).Addr())
+	t.Setenv("HEALTH_PORT", "127.0.0.1:0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx) }()
+	t.Cleanup(cancel)
+	return cancel, done
+}
+
+func TestGetsBucketsOverMTLS(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	url, requests := startConsumer(t, ca, consumerID)
+	cancel, done := startAnalysis(t, ca, url)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for requests.Load() == 0 {
+		select {
+		case err := <-done:
+			t.Fatalf("run() exited before requesting buckets: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("analysis did not request buckets")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run() error = %v", err)
+	}
+}
+
+func TestRejectsUnauthorizedConsumer(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	url, requests := startConsumer(t, ca, spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/other"))
+	_, done := startAnalysis(t, ca, url)
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "error connecting") {
+			t.Errorf("run() error = %v, want a connection error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run() did not fail against an unauthorized consumer")
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("unauthorized consumer received %d requests", n)
+	}
+}
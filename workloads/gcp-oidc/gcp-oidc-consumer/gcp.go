@@ -47,10 +47,14 @@ func (r JWTSVIDSubTknSupplier) fetchSPIFFEToken(ctx context.Context) (string, er
 }
 
 // LoadGCPConfig uses a token supplier to get temporary credentials through a workload identity provider.
+// stsTokenURL is the Google STS endpoint that exchanges the JWT-SVID for a
+// federated access token.
+const stsTokenURL = "https://sts.googleapis.com/v1/token"
+
 func LoadGCPConfig(workloadIdentityProvider string, subTknSupplier externalaccount.SubjectTokenSupplier, scopes []string) externalaccount.Config {
 	return externalaccount.Config{
 		Audience:             "//iam.googleapis.com/" + workloadIdentityProvider,
-		TokenURL:             "https://sts.googleapis.com/v1/token",
+		TokenURL:             stsTokenURL,
 		SubjectTokenType:     "urn:ietf:params:oauth:token-type:jwt",
 		SubjectTokenSupplier: subTknSupplier,
 		Scopes:               scopes,
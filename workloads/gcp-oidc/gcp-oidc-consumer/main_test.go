@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"golang.org/x/oauth2/google/externalaccount"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	consumerID = spiffeid.RequireFromString("spiffe://example.org/ns/production/sa/default")
+	analysisID = spiffeid.RequireFromString("spiffe://example.org/ns/analytics/sa/default")
+)
+
+// startConsumer runs the consumer with mTLS enabled, issued an SVID for
+// consumerID by ca, until the test completes, and returns its address.
+func startConsumer(t *testing.T, ca *spiffetest.CA) string {
+	t.Helper()
+	addr := spiffetest.FreeAddr(t)
+	t.Setenv("ENABLE_TLS", "true")
+	t.Setenv("ANALYSIS_TRUST_DOMAIN", exampleOrg.Name())
+	t.Setenv("SPIFFE_ENDPOINT_SOCKET", spiffetest.New(t, ca, spiffetest.WithIDs(consumerID)).Addr())
+	t.Setenv("PORT", addr)
+	t.Setenv("HEALTH_PORT", "127.0.0.1:0")
+
+	done := spiffetest.StartWorkload(t, run)
+	spiffetest.WaitReady(t, addr, done)
+	return addr
+}
+
+// newClient returns an HTTP client presenting an X.509-SVID for id issued by
+// ca, and accepting the server authorized by authorizer.
+func newClient(t *testing.T, ca *spiffetest.CA, id spiffeid.ID, authorizer tlsconfig.Authorizer) *http.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	api := spiffetest.New(t, ca, spiffetest.WithIDs(id))
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create X509Source: %v", err)
+	}
+	t.Cleanup(func() { _ = source.Close() })
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsconfig.MTLSClientConfig(source, source, authorizer)},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func TestServesAnalysisOverMTLS(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	addr := startConsumer(t, ca)
+	client := newClient(t, ca, analysisID, tlsconfig.AuthorizeID(consumerID))
+
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("GET / error = %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "Success" {
+		t.Errorf("GET / = %d %q, want 200 Success", resp.StatusCode, body)
+	}
+}
+
+func TestRejectsUnauthorizedClient(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	addr := startConsumer(t, ca)
+
+	tests := []struct {
+		name   string
+		client *http.Client
+	}{
+		{"other workload", newClient(t, ca, spiffeid.RequireFromString("spiffe://example.org/ns/analytics/sa/other"), tlsconfig.AuthorizeID(consumerID))},
+		{"untrusted CA", newClient(t, spiffetest.NewCA(t, exampleOrg), analysisID, tlsconfig.AuthorizeAny())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.client.Get("https://" + addr + "/")
+			if err == nil {
+				_ = resp.Body.Close()
+				t.Errorf("GET / = %d, want a TLS handshake failure", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestJWTSVIDSubjectTokenSupplier(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wlClient, err := workloadapi.New(ctx, workloadapi.WithAddr(spiffetest.New(t, ca, spiffetest.WithIDs(consumerID)).Addr()))
+	if err != nil {
+		t.Fatalf("failed to create workload client: %v", err)
+	}
+	t.Cleanup(func() { _ = wlClient.Close() })
+	supplier, err := NewJWTSVIDSubTknSupplier(wlClient, audience)
+	if err != nil {
+		t.Fatalf("NewJWTSVIDSubTknSupplier() error = %v", err)
+	}
+
+	token, err := supplier.SubjectToken(ctx, externalaccount.SupplierOptions{})
+	if err != nil {
+		t.Fatalf("SubjectToken() error = %v", err)
+	}
+	svid, err := jwtsvid.ParseAndValidate(token, ca.JWTBundle(), []string{audience})
+	if err != nil {
+		t.Fatalf("subject token is not a valid JWT-SVID: %v", err)
+	}
+	if svid.ID != consumerID {
+		t.Errorf("subject token subject = %s, want %s", svid.ID, consumerID)
+	}
+}
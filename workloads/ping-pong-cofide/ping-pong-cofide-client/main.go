@@ -2,16 +2,43 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
 	cofidehttp "github.com/cofide/cofide-sdk-go/http/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	pingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ping_duration_seconds",
+		Help:    "The duration of pings, by result",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"result"})
+	pingResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ping_results_total",
+		Help: "The total number of pings, by result and response status code",
+	}, []string{"result", "code"})
+)
+
+// Ping results, used as the result label of ping metrics.
+const (
+	resultSuccess         = "success"
+	resultNon200          = "non_200"
+	resultTimeout         = "timeout"
+	resultConnectionError = "connection_error"
 )
 
 func main() {
@@ -21,7 +48,9 @@ func main() {
 		slog.Error("Failed to process environment variables", "error", err)
 		os.Exit(1)
 	}
-	if err := run(context.Background(), env); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, env); err != nil {
 		slog.Error("Fatal error", "error", err)
 		os.Exit(1)
 	}
@@ -34,10 +63,13 @@ func setupLogging() {
 }
 
 type env struct {
-	serverAddress string
-	serverPort    int
-	xdsServerURI  string
-	xdsNodeID     string
+	serverAddress  string
+	serverPort     int
+	xdsServerURI   string
+	xdsNodeID      string
+	metricsEnabled bool
+	metricsPort    string
+	health         health.Config
 }
 
 func getEnv(variable string) (string, error) {
@@ -70,20 +102,45 @@ func getEnvIntWithDefault(variable string, defaultValue int) int {
 	return intValue
 }
 
+func getEnvBooleanWithDefault(variable string, defaultValue bool) bool {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return defaultValue
+	}
+
+	return b
+}
+
 func newEnv() (*env, error) {
 	xdsServerURI, err := getEnv("XDS_SERVER_URI")
 	if err != nil {
 		return nil, err
 	}
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
 	return &env{
-		serverAddress: getEnvWithDefault("PING_PONG_SERVICE_HOST", "ping-pong-server.demo"),
-		serverPort:    getEnvIntWithDefault("PING_PONG_SERVICE_PORT", 8443),
-		xdsServerURI:  xdsServerURI,
-		xdsNodeID:     getEnvWithDefault("XDS_NODE_ID", "node"),
+		serverAddress:  getEnvWithDefault("PING_PONG_SERVICE_HOST", "ping-pong-server.demo"),
+		serverPort:     getEnvIntWithDefault("PING_PONG_SERVICE_PORT", 8443),
+		xdsServerURI:   xdsServerURI,
+		xdsNodeID:      getEnvWithDefault("XDS_NODE_ID", "node"),
+		metricsEnabled: getEnvBooleanWithDefault("METRICS_ENABLED", true),
+		metricsPort:    getEnvWithDefault("METRICS_PORT", ":8080"),
+		health:         healthConfig,
 	}, nil
 }
 
 func run(ctx context.Context, env *env) error {
+	checker := health.NewChecker()
+	checker.Run(ctx, env.health.Port)
+
+	// NewClient waits for the client's X.509-SVID.
 	client, err := cofidehttp.NewClient(
 		cofidehttp.WithXDS(env.xdsServerURI),
 		cofidehttp.WithXDSNodeID(env.xdsNodeID),
@@ -91,34 +148,72 @@ func run(ctx context.Context, env *env) error {
 	if err != nil {
 		return fmt.Errorf("failed creating Cofide HTTP client: %w", err)
 	}
+	defer client.CloseIdleConnections()
+	checker.AddReadinessCheck("x509-svid", health.X509SVIDCheck(client.X509Source, env.health.SVIDExpiryMargin))
+	checker.MarkStarted()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			identity, err := client.GetIdentity()
-			if err != nil {
-				slog.Error("problem obtaining client identity", "error", err)
-			}
-			slog.Info(fmt.Sprintf("ping from %s...", identity.ToSpiffeID().String()))
-			if err := ping(client, env.serverAddress, env.serverPort); err != nil {
-				slog.Error("problem reaching server", "error", err)
+	if env.metricsEnabled {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		server := &http.Server{
+			Addr:              env.metricsPort,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("Metrics enabled, starting server", "port", env.metricsPort)
+			if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
+				slog.Error("Error serving metrics", "error", err)
 			}
-			time.Sleep(5 * time.Second)
+		}()
+	}
+
+	for {
+		identity, err := client.GetIdentity()
+		if err != nil {
+			slog.Error("problem obtaining client identity", "error", err)
+		}
+		slog.Info(fmt.Sprintf("ping from %s...", identity.ToSpiffeID().String()))
+		if err := ping(ctx, client, env.serverAddress, env.serverPort); err != nil && ctx.Err() == nil {
+			slog.Error("problem reaching server", "error", err)
+		}
+		if !graceful.Sleep(ctx, 5*time.Second) {
+			slog.Info("Client stopped")
+			return nil
 		}
 	}
 }
 
-func ping(client *cofidehttp.Client, serverAddr string, serverPort int) error {
+// ping sends a request to the server, recording the outcome in metrics.
+func ping(ctx context.Context, client *cofidehttp.Client, serverAddr string, serverPort int) error {
+	start := time.Now()
+	status, err := sendPing(ctx, client, serverAddr, serverPort)
+
+	result := pingResult(err)
+	code := ""
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	pingDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	pingResults.WithLabelValues(result, code).Inc()
+	return err
+}
+
+// sendPing sends a request to the server and returns the response status code,
+// which is zero if no response was received.
+func sendPing(ctx context.Context, client *cofidehttp.Client, serverAddr string, serverPort int) (int, error) {
 	url := &url.URL{
 		Scheme: "http",
 		Host:   fmt.Sprintf("%s:%d", serverAddr, serverPort),
 	}
 
-	r, err := client.Get(url.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return 0, err
 	}
 	defer func() {
 		_ = r.Body.Close()
@@ -126,13 +221,39 @@ func ping(client *cofidehttp.Client, serverAddr string, serverPort int) error {
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		return err
+		return r.StatusCode, err
 	}
 	if r.StatusCode != http.StatusOK {
 		// Limit how much of the response we include in the error
 		body = body[:min(len(body), 1024)]
-		return fmt.Errorf("unexpected status code: %d: %s", r.StatusCode, body)
+		return r.StatusCode, &statusError{code: r.StatusCode, body: body}
 	}
 	slog.Info(string(body))
-	return nil
+	return r.StatusCode, nil
+}
+
+// statusError reports a response with a status code other than 200.
+type statusError struct {
+	code int
+	body []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d: %s", e.code, e.body)
+}
+
+// pingResult classifies the outcome of a ping for metrics.
+func pingResult(err error) string {
+	if err == nil {
+		return resultSuccess
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return resultNon200
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return resultTimeout
+	}
+	return resultConnectionError
 }
@@ -6,23 +6,32 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"time"
+	"strconv"
 
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/whoami"
 	cofide_http_server "github.com/cofide/cofide-sdk-go/http/server"
 	"github.com/cofide/cofide-sdk-go/pkg/id"
 	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"golang.org/x/sync/errgroup"
 )
 
 func main() {
-	if err := run(context.Background(), getEnv()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, getEnv()); err != nil {
 		slog.Error("Fatal error, exiting", "error", err)
 		os.Exit(1)
 	}
 }
 
 type Env struct {
-	SecurePort   string
-	InsecurePort string
+	SecurePort     string
+	InsecurePort   string
+	MetricsEnabled bool
+	MetricsPort    string
+	Health         health.Config
 }
 
 func getEnvWithDefault(variable string, defaultValue string) string {
@@ -33,72 +42,101 @@ func getEnvWithDefault(variable string, defaultValue string) string {
 	return v
 }
 
+func getEnvBooleanWithDefault(variable string, defaultValue bool) bool {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Error("Invalid boolean value", "variable", variable, "error", err)
+		return defaultValue
+	}
+	return b
+}
+
 func getEnv() *Env {
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid health configuration", "error", err)
+		os.Exit(1)
+	}
 	return &Env{
-		SecurePort:   getEnvWithDefault("SECURE_PORT", ":8443"),
-		InsecurePort: getEnvWithDefault("INSECURE_PORT", ":8080"),
+		SecurePort:     getEnvWithDefault("SECURE_PORT", ":8443"),
+		InsecurePort:   getEnvWithDefault("INSECURE_PORT", ":8080"),
+		MetricsEnabled: getEnvBooleanWithDefault("METRICS_ENABLED", true),
+		// The insecure server already listens on :8080.
+		MetricsPort: getEnvWithDefault("METRICS_PORT", ":9090"),
+		Health:      healthConfig,
 	}
 }
 
 func run(ctx context.Context, env *Env) error {
-	serverCtx := ctx
-
 	secureMux := http.NewServeMux()
 	secureServer := cofide_http_server.NewServer(&http.Server{
 		Addr:    env.SecurePort,
 		Handler: secureMux,
 	}, cofide_http_server.WithSVIDMatch(id.Equals("ns", "production")),
 	)
-	secureMux.HandleFunc("/", handler(secureServer))
+	secureMux.Handle("/", metricsWrapper("secure", authenticate(secureServer, handler)))
+	secureMux.Handle(whoami.Path, metricsWrapper("secure", authenticate(secureServer, whoami.Handler)))
 
 	insecureMux := http.NewServeMux()
 	insecureServer := &http.Server{
 		Addr:    env.InsecurePort,
 		Handler: insecureMux,
 	}
-	insecureMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	insecureMux.Handle("/", metricsWrapper("insecure", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		_, err := w.Write([]byte("...pong from insecure server"))
 		if err != nil {
 			slog.Error("Insecure server error", "error", err)
 		}
-	})
+	})))
+
+	if env.MetricsEnabled {
+		runMetrics(ctx, env)
+	}
 
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
+	// Start fetching the secure server's X.509-SVID here rather than in
+	// ListenAndServe, so that readiness can wait for it.
+	secureServer.EnsureSPIRE()
 	go func() {
-		fmt.Printf("Starting secure server on %s\n", env.SecurePort)
-		if err := secureServer.ListenAndServe(); err != http.ErrServerClosed {
-			slog.Error("Secure server error", "error", err)
-		}
+		secureServer.WaitReady()
+		checker.AddReadinessCheck("x509-svid", health.X509SVIDCheck(secureServer.X509Source, env.Health.SVIDExpiryMargin))
+		checker.MarkStarted()
 	}()
 
-	go func() {
+	// Both servers are shut down together, on a signal or when either fails.
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		fmt.Printf("Starting secure server on %s\n", env.SecurePort)
+		if err := graceful.Serve(ctx, secureServer, secureServer.ListenAndServe); err != nil {
+			return fmt.Errorf("secure server failed: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
 		fmt.Printf("Starting insecure server on %s\n", env.InsecurePort)
-		if err := insecureServer.ListenAndServe(); err != http.ErrServerClosed {
-			slog.Error("Insecure server error", "error", err)
+		if err := graceful.Serve(ctx, insecureServer, insecureServer.ListenAndServe); err != nil {
+			return fmt.Errorf("insecure server failed: %w", err)
 		}
-	}()
-
-	<-serverCtx.Done()
-
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownCancel()
-
-	if err := secureServer.Shutdown(shutdownCtx); err != nil {
-		return fmt.Errorf("secure server shutdown failed: %w", err)
-	}
-
-	if err := insecureServer.Shutdown(shutdownCtx); err != nil {
-		return fmt.Errorf("insecure server shutdown failed: %w", err)
-	}
+		return nil
+	})
 
-	return nil
+	return g.Wait()
 }
 
-func handler(server *cofide_http_server.Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// authenticate stores the identity of the client, taken from its X.509-SVID,
+// and of the server in the request context.
+func authenticate(server *cofide_http_server.Server, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
 			slog.Error("No client certificate provided")
+			rejectedRequests.WithLabelValues(reasonMissingCertificate).Inc()
 			http.Error(w, "Error: No client certificate provided", http.StatusUnauthorized)
 			return
 		}
@@ -108,10 +146,10 @@ func handler(server *cofide_http_server.Server) http.HandlerFunc {
 		clientID, err := x509svid.IDFromCert(peerCert)
 		if err != nil {
 			slog.Error("Error getting SPIFFE ID from peer cert", "error", err)
+			rejectedRequests.WithLabelValues(reasonInvalidSVID).Inc()
 			http.Error(w, "Error: Invalid client SVID", http.StatusUnauthorized)
 			return
 		}
-		slog.Info("ping", slog.String("client.id", clientID.String()))
 
 		identity, err := server.GetIdentity()
 		if err != nil {
@@ -120,11 +158,24 @@ func handler(server *cofide_http_server.Server) http.HandlerFunc {
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
-		_, err = fmt.Fprintf(w, "...pong from %s", identity.ToSpiffeID().String())
-		if err != nil {
-			slog.Error("Error writing response", "error", err)
+		id := &whoami.Identity{
+			PeerID:      clientID.String(),
+			Mechanism:   whoami.MechanismMTLS,
+			ServerID:    identity.ToSpiffeID().String(),
+			Certificate: whoami.NewCertificate(peerCert),
 		}
+		next(w, r.WithContext(whoami.NewContext(r.Context(), id)))
+	})
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	id, _ := whoami.FromContext(r.Context())
+	slog.Info("ping", slog.String("client.id", id.PeerID))
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, err := fmt.Fprintf(w, "...pong from %s", id.ServerID)
+	if err != nil {
+		slog.Error("Error writing response", "error", err)
 	}
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/httpmetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var rejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rejected_requests_total",
+	Help: "The total number of requests to the secure server rejected by authentication, by reason",
+}, []string{"reason"})
+
+// Rejection reasons, used as the reason label of rejected_requests_total.
+const (
+	reasonMissingCertificate = "missing_certificate"
+	reasonInvalidSVID        = "invalid_svid"
+)
+
+// metricsWrapper records the outcome and duration of each request to the named
+// server once the handler has written its response.
+func metricsWrapper(server string, next http.Handler) http.Handler {
+	return httpmetrics.Handler(server, next, nil)
+}
+
+// runMetrics serves Prometheus metrics on env.MetricsPort in the background
+// until ctx is cancelled.
+func runMetrics(ctx context.Context, env *Env) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              env.MetricsPort,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("Metrics enabled, starting server", "port", env.MetricsPort)
+		if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
+			slog.Error("Error serving metrics", "error", err)
+		}
+	}()
+}
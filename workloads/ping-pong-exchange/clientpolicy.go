@@ -0,0 +1,46 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+
+	"github.com/cofide/cofide-demos/pkg/authz"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// clientPolicy authorizes token subjects. A subject is rejected if it matches
+// any deny pattern, and otherwise accepted if it matches any allow pattern.
+// Patterns are parsed by authz.ParsePatterns.
+type clientPolicy struct {
+	allow []spiffeid.Matcher
+	deny  []spiffeid.Matcher
+}
+
+// newClientPolicy builds a clientPolicy from the environment. CLIENT_SPIFFE_ID
+// is used if CLIENT_SPIFFE_IDS is unset.
+func newClientPolicy(env *Env) (*clientPolicy, error) {
+	allow, err := authz.ParsePatterns(authz.SplitList(cmp.Or(env.ClientSPIFFEIDs, env.ClientSPIFFEID)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CLIENT_SPIFFE_IDS: %w", err)
+	}
+	if len(allow) == 0 {
+		return nil, errors.New("CLIENT_SPIFFE_IDS must not be empty")
+	}
+	deny, err := authz.ParsePatterns(authz.SplitList(env.DeniedClientSPIFFEIDs))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DENIED_CLIENT_SPIFFE_IDS: %w", err)
+	}
+	return &clientPolicy{allow: allow, deny: deny}, nil
+}
+
+// authorize checks the subject against the deny and then the allow patterns.
+func (p *clientPolicy) authorize(subject spiffeid.ID) error {
+	if authz.MatchesAny(p.deny, subject) {
+		return fmt.Errorf("subject %q is denied", subject)
+	}
+	if !authz.MatchesAny(p.allow, subject) {
+		return fmt.Errorf("subject %q is not allowed", subject)
+	}
+	return nil
+}
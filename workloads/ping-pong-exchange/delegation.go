@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cofide/cofide-demos/pkg/authz"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+var errMissingActor = errors.New("missing act claim")
+
+// actorPolicy constrains the delegation chain of an accepted token. The zero
+// value accepts any chain, including none.
+type actorPolicy struct {
+	// immediateActor, if set, requires a chain whose last actor is this ID.
+	immediateActor *spiffeid.ID
+	// allowedChains, if non-empty, requires the chain to equal one of them. An
+	// empty allowed chain permits tokens without an act claim.
+	allowedChains [][]spiffeid.ID
+	// maxDepth limits the chain length. Negative means unlimited.
+	maxDepth int
+	// allowedActors, if non-empty, requires every actor to match one of them.
+	allowedActors []spiffeid.Matcher
+}
+
+// newActorPolicy builds an actorPolicy from the environment.
+func newActorPolicy(env *Env) (*actorPolicy, error) {
+	policy := &actorPolicy{maxDepth: env.MaxActorChainDepth}
+
+	if env.ActorSPIFFEID != "" {
+		id, err := spiffeid.FromString(env.ActorSPIFFEID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACTOR_SPIFFE_ID: %w", err)
+		}
+		policy.immediateActor = &id
+	}
+
+	if env.AllowedActorChains != "" {
+		for _, chain := range strings.Split(env.AllowedActorChains, ";") {
+			ids, err := parseSPIFFEIDList(chain)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ALLOWED_ACTOR_CHAINS: %w", err)
+			}
+			policy.allowedChains = append(policy.allowedChains, ids)
+		}
+	}
+
+	allowedActors, err := authz.ParsePatterns(authz.SplitList(env.AllowedActors))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ALLOWED_ACTORS: %w", err)
+	}
+	policy.allowedActors = allowedActors
+
+	return policy, nil
+}
+
+// authorize checks the delegation chain, in hop order, against the policy.
+func (p *actorPolicy) authorize(actors []spiffeid.ID) error {
+	if p.maxDepth >= 0 && len(actors) > p.maxDepth {
+		return fmt.Errorf("delegation chain length %d exceeds maximum %d", len(actors), p.maxDepth)
+	}
+
+	if p.immediateActor != nil {
+		if len(actors) == 0 {
+			return errMissingActor
+		}
+		if immediate := actors[len(actors)-1]; immediate != *p.immediateActor {
+			return fmt.Errorf("unexpected actor %q", immediate)
+		}
+	}
+
+	for _, actor := range actors {
+		if len(p.allowedActors) > 0 && !authz.MatchesAny(p.allowedActors, actor) {
+			return fmt.Errorf("actor %q not allowed", actor)
+		}
+	}
+
+	if len(p.allowedChains) > 0 && !slices.ContainsFunc(p.allowedChains, func(c []spiffeid.ID) bool { return slices.Equal(c, actors) }) {
+		return errors.New("delegation chain not allowed")
+	}
+
+	return nil
+}
+
+// parseSPIFFEIDList parses a comma-separated list of SPIFFE IDs. An empty
+// string yields an empty list.
+func parseSPIFFEIDList(s string) ([]spiffeid.ID, error) {
+	var ids []spiffeid.ID
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, err := spiffeid.FromString(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE ID %q: %w", entry, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
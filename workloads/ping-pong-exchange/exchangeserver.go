@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/tokenexchange"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	exchangeTokenPath           = "/token"
+	exchangeJWKSPath            = "/keys"
+	exchangeIntrospectionPath   = "/introspect"
+	exchangeDiscoveryPath       = "/.well-known/openid-configuration"
+	exchangeSigningAlg          = jose.ES256
+	exchangeMaxRequestBodyBytes = 1 << 20
+)
+
+// exchangePolicyRule authorizes a client to obtain tokens for a set of audiences.
+type exchangePolicyRule struct {
+	// Client is the SPIFFE ID of the workload authenticated by client_assertion.
+	Client string `json:"client"`
+	// Audiences are the audiences the client may request tokens for.
+	Audiences []string `json:"audiences"`
+	// Scopes, if set, are the scopes the client may request for the audiences.
+	// If unset, any scope may be requested.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// exchangePolicy is the set of rules evaluated by the exchange server. A
+// request is allowed if any rule matches the client and requested audience.
+type exchangePolicy []exchangePolicyRule
+
+// parseExchangePolicy parses a JSON-encoded exchange policy, validating that
+// every client is a SPIFFE ID.
+func parseExchangePolicy(data string) (exchangePolicy, error) {
+	var policy exchangePolicy
+	if err := json.Unmarshal([]byte(data), &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse exchange policy: %w", err)
+	}
+	for _, rule := range policy {
+		if _, err := spiffeid.FromString(rule.Client); err != nil {
+			return nil, fmt.Errorf("invalid client %q in exchange policy: %w", rule.Client, err)
+		}
+	}
+	return policy, nil
+}
+
+// allows reports whether the client may obtain a token for the audience with
+// the given scopes.
+func (p exchangePolicy) allows(client spiffeid.ID, audience string, scopes []string) bool {
+	for _, rule := range p {
+		if rule.Client == client.String() && slices.Contains(rule.Audiences, audience) &&
+			(rule.Scopes == nil || isSubset(scopes, rule.Scopes)) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeServer is a minimal RFC 8693 token exchange service. It authenticates
+// callers by JWT-SVID client assertion, validates subject and actor tokens,
+// applies an exchangePolicy and issues signed access tokens.
+type exchangeServer struct {
+	env      *Env
+	issuer   string
+	bundles  jwtbundle.Source
+	policy   exchangePolicy
+	tokenTTL time.Duration
+	keyID    string
+	key      crypto.Signer
+	signer   jose.Signer
+	dpop     *tokenexchange.DPoPVerifier
+}
+
+// newExchangeServer creates an exchange server with a freshly generated signing key.
+func newExchangeServer(env *Env, bundles jwtbundle.Source, policy exchangePolicy) (*exchangeServer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	keyID, err := randomID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key ID: %w", err)
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: exchangeSigningAlg, Key: jose.JSONWebKey{Key: key, KeyID: keyID}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+	return &exchangeServer{
+		env:      env,
+		issuer:   strings.TrimRight(env.ExchangeURL, "/"),
+		bundles:  bundles,
+		policy:   policy,
+		tokenTTL: env.ExchangeTokenTTL,
+		keyID:    keyID,
+		key:      key,
+		signer:   signer,
+		dpop:     tokenexchange.NewDPoPVerifier(),
+	}, nil
+}
+
+// runExchangeServer obtains the trust bundles from the workload API and serves
+// the exchange endpoints until ctx is cancelled. The server is marked started
+// in checker once it has the bundles.
+func runExchangeServer(ctx context.Context, env *Env, checker *health.Checker) error {
+	policy, err := parseExchangePolicy(env.ExchangePolicy)
+	if err != nil {
+		return err
+	}
+
+	initCtx, initCancel := context.WithTimeout(ctx, 30*time.Second)
+	defer initCancel()
+
+	slog.Info("Connecting to SPIFFE workload API", "socket", env.SpiffeSocketPath)
+	bundles, err := workloadapi.NewJWTSource(initCtx, workloadapi.WithClientOptions(workloadapi.WithAddr(env.SpiffeSocketPath)))
+	if err != nil {
+		return fmt.Errorf("unable to obtain JWT bundles: %w", err)
+	}
+	defer func() { _ = bundles.Close() }()
+
+	s, err := newExchangeServer(env, bundles, policy)
+	if err != nil {
+		return err
+	}
+	checker.MarkStarted()
+	return s.run(ctx)
+}
+
+// run starts the HTTP server and blocks until ctx is cancelled or a fatal error occurs.
+func (s *exchangeServer) run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.env.ListenAddress,
+		Handler:           otelhttp.NewHandler(s.mux(), ModeExchangeServer),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	slog.Info("Exchange server listening", "address", s.env.ListenAddress, "issuer", s.issuer)
+	if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+
+	return nil
+}
+
+// mux returns the handler serving the discovery, JWKS and token endpoints.
+func (s *exchangeServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+exchangeDiscoveryPath, s.handleDiscovery)
+	mux.HandleFunc("GET "+exchangeJWKSPath, s.handleJWKS)
+	mux.HandleFunc("POST "+exchangeTokenPath, s.handleToken)
+	mux.HandleFunc("POST "+exchangeIntrospectionPath, s.handleIntrospect)
+	return mux
+}
+
+func (s *exchangeServer) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.issuer,
+		"token_endpoint":                        s.issuer + exchangeTokenPath,
+		"jwks_uri":                              s.issuer + exchangeJWKSPath,
+		"grant_types_supported":                 []string{tokenexchange.GrantTypeTokenExchange},
+		"token_endpoint_auth_methods_supported": []string{tokenexchange.AuthMethodPrivateKeyJWT},
+		"token_endpoint_auth_signing_alg_values_supported": signatureAlgNames(tokenexchange.SignatureAlgorithms()),
+		"client_assertion_types_supported":                 []string{tokenexchange.ClientAssertionTypeJWTSVID},
+		"id_token_signing_alg_values_supported":            []string{string(exchangeSigningAlg)},
+		"dpop_signing_alg_values_supported":                signatureAlgNames(tokenexchange.SignatureAlgorithms()),
+		"introspection_endpoint":                           s.issuer + exchangeIntrospectionPath,
+		"introspection_endpoint_auth_methods_supported":    []string{tokenexchange.AuthMethodPrivateKeyJWT},
+	})
+}
+
+func (s *exchangeServer) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       s.key.Public(),
+		KeyID:     s.keyID,
+		Algorithm: string(exchangeSigningAlg),
+		Use:       "sig",
+	}}})
+}
+
+func (s *exchangeServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, exchangeMaxRequestBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "Malformed request body"})
+		return
+	}
+
+	// A DPoP proof binds the issued token to the caller's key (RFC 9449 §5).
+	var jkt string
+	if proofs := r.Header.Values(tokenexchange.DPoPHeader); len(proofs) > 0 {
+		var err error
+		if len(proofs) == 1 {
+			jkt, err = s.dpop.Verify(proofs[0], r.Method, s.issuer+exchangeTokenPath, "")
+		} else {
+			err = errors.New("multiple DPoP proofs")
+		}
+		if err != nil {
+			slog.Warn("Invalid DPoP proof", "error", err)
+			writeOAuthError(w, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_dpop_proof", Description: "Invalid DPoP proof"})
+			return
+		}
+	}
+
+	resp, oerr := s.exchange(r.Context(), r.PostForm, jkt)
+	if oerr != nil {
+		slog.Warn("Rejected token exchange request", "error", oerr.Code, "description", oerr.Description)
+		trace.SpanFromContext(r.Context()).SetAttributes(tokenexchange.AttrErrorCode.String(oerr.Code))
+		writeOAuthError(w, oerr)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleIntrospect implements RFC 7662 token introspection. Callers
+// authenticate with a JWT-SVID client assertion, as for token exchange, and a
+// token is only reported as active to a caller in its audience, so that
+// workloads cannot learn about tokens issued for others.
+func (s *exchangeServer) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, exchangeMaxRequestBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "Malformed request body"})
+		return
+	}
+
+	if r.PostForm.Get("client_assertion_type") != tokenexchange.ClientAssertionTypeJWTSVID {
+		writeOAuthError(w, &tokenexchange.OAuthError{StatusCode: http.StatusUnauthorized, Code: "invalid_client", Description: "Unsupported client assertion type"})
+		return
+	}
+	client, err := jwtsvid.ParseAndValidate(r.PostForm.Get("client_assertion"), s.bundles, []string{s.issuer + exchangeTokenPath})
+	if err != nil {
+		slog.Warn("Invalid client assertion", "error", err)
+		writeOAuthError(w, &tokenexchange.OAuthError{StatusCode: http.StatusUnauthorized, Code: "invalid_client", Description: "Invalid client assertion"})
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "Missing token"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	claims, err := s.verify(token)
+	if err != nil || !slices.Contains([]string(claims.Audience), client.ID.String()) {
+		slog.Info("Introspected inactive token", "client", client.ID, "error", err)
+		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+		return
+	}
+	resp, err := introspectionResponse(claims)
+	if err != nil {
+		slog.Error("Failed to encode introspection response", "error", err)
+		writeOAuthError(w, &tokenexchange.OAuthError{StatusCode: http.StatusInternalServerError, Code: "server_error", Description: "Unable to introspect token"})
+		return
+	}
+	slog.Info("Introspected active token", "client", client.ID, "subject", claims.Subject)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// introspectionResponse returns the RFC 7662 §2.2 response for an active token,
+// carrying the token's claims.
+func introspectionResponse(claims *tokenexchange.TokenClaims) (map[string]any, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	resp["active"] = true
+	resp["token_type"] = "Bearer"
+	if claims.Cnf != nil {
+		resp["token_type"] = tokenexchange.DPoPTokenType
+	}
+	return resp, nil
+}
+
+// exchange validates a token exchange request and issues an access token. If
+// jkt is non-empty, the token is bound to the DPoP key with that thumbprint.
+func (s *exchangeServer) exchange(ctx context.Context, form url.Values, jkt string) (map[string]any, *tokenexchange.OAuthError) {
+	if form.Get("grant_type") != tokenexchange.GrantTypeTokenExchange {
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "unsupported_grant_type", Description: "Only token exchange is supported"}
+	}
+
+	// Authenticate the caller.
+	if form.Get("client_assertion_type") != tokenexchange.ClientAssertionTypeJWTSVID {
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusUnauthorized, Code: "invalid_client", Description: "Unsupported client assertion type"}
+	}
+	client, err := jwtsvid.ParseAndValidate(form.Get("client_assertion"), s.bundles, []string{s.issuer + exchangeTokenPath})
+	if err != nil {
+		slog.Warn("Invalid client assertion", "error", err)
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusUnauthorized, Code: "invalid_client", Description: "Invalid client assertion"}
+	}
+
+	audience := form.Get("audience")
+	if audience == "" {
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "Missing audience"}
+	}
+	if !s.policy.allows(client.ID, audience, nil) {
+		slog.Warn("Audience not permitted by policy", "client", client.ID, "audience", audience)
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_target", Description: "Audience not permitted for client"}
+	}
+
+	subjectToken, oerr := s.validateSubjectToken(form.Get("subject_token_type"), form.Get("subject_token"), client.ID)
+	if oerr != nil {
+		return nil, oerr
+	}
+	subject := subjectToken.subject
+
+	// A delegated token may not carry more scopes than the subject token, and
+	// inherits them if none are requested.
+	scopes := strings.Fields(form.Get("scope"))
+	if subjectToken.scopes != nil {
+		if len(scopes) == 0 {
+			scopes = subjectToken.scopes
+		} else if !isSubset(scopes, subjectToken.scopes) {
+			slog.Warn("Requested scopes exceed subject token scopes", "client", client.ID, "scopes", scopes, "subject_scopes", subjectToken.scopes)
+			return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_scope", Description: "Requested scope exceeds subject token scope"}
+		}
+	}
+	if !s.policy.allows(client.ID, audience, scopes) {
+		slog.Warn("Scopes not permitted by policy", "client", client.ID, "audience", audience, "scopes", scopes)
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_scope", Description: "Scope not permitted for client"}
+	}
+
+	act := subjectToken.act
+	if actorToken := form.Get("actor_token"); actorToken != "" {
+		actor, oerr := s.validateActorToken(form.Get("actor_token_type"), actorToken, client.ID)
+		if oerr != nil {
+			return nil, oerr
+		}
+		// The new actor is the outermost act claim, with any prior actors nested
+		// inside it (RFC 8693 §4.1).
+		act = &tokenexchange.ActorClaim{Sub: actor.String(), Act: subjectToken.act}
+	} else if subject != client.ID {
+		// Without an actor token the issued token would let the caller
+		// impersonate the subject, hiding itself from the delegation chain.
+		slog.Warn("Delegated exchange without an actor token", "client", client.ID, "subject", subject)
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "An actor token is required to act for another subject"}
+	}
+
+	// The issued token may not outlive the subject token it was exchanged for.
+	expiry := time.Now().Add(s.tokenTTL)
+	if subjectToken.expiry.Before(expiry) {
+		expiry = subjectToken.expiry
+	}
+
+	token, err := s.issue(subject, audience, scopes, act, jkt, expiry)
+	if err != nil {
+		slog.Error("Failed to issue access token", "error", err)
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusInternalServerError, Code: "server_error", Description: "Unable to issue access token"}
+	}
+	slog.Info("Issued access token", "client", client.ID, "subject", subject, "audience", audience, "scopes", scopes, "delegated", act != nil, "dpop", jkt != "")
+	issued := &tokenexchange.Principal{Subject: subject}
+	if act != nil {
+		// The chain was validated when the subject and actor tokens were.
+		issued.Actors, _ = act.Chain()
+	}
+	trace.SpanFromContext(ctx).SetAttributes(append(issued.SpanAttributes(),
+		attribute.String("oauth.client_id", client.ID.String()),
+		tokenexchange.AttrAudience.String(audience),
+		tokenexchange.AttrDelegated.Bool(act != nil),
+	)...)
+
+	tokenType := "Bearer"
+	if jkt != "" {
+		tokenType = tokenexchange.DPoPTokenType
+	}
+	resp := map[string]any{
+		"access_token":      token,
+		"issued_token_type": tokenexchange.TokenTypeAccessToken,
+		"token_type":        tokenType,
+		"expires_in":        int(time.Until(expiry).Seconds()),
+	}
+	if len(scopes) > 0 {
+		resp["scope"] = strings.Join(scopes, " ")
+	}
+	return resp, nil
+}
+
+// subjectToken holds the claims of a validated subject token that carry over to
+// the issued token.
+type subjectToken struct {
+	subject spiffeid.ID
+	// act is the existing act claim of an access token.
+	act *tokenexchange.ActorClaim
+	// scopes are the scopes granted to an access token, or nil for a
+	// JWT-SVID.
+	scopes []string
+	expiry time.Time
+}
+
+// validateSubjectToken validates the subject token. A JWT-SVID subject token
+// must identify the caller; an access token must have been issued by this
+// server for the caller.
+func (s *exchangeServer) validateSubjectToken(tokenType, token string, client spiffeid.ID) (*subjectToken, *tokenexchange.OAuthError) {
+	switch tokenType {
+	case tokenexchange.TokenTypeJWTSVID:
+		svid, err := jwtsvid.ParseAndValidate(token, s.bundles, []string{s.issuer + exchangeTokenPath})
+		if err != nil {
+			slog.Warn("Invalid subject token", "error", err)
+			return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "Invalid subject token"}
+		}
+		if svid.ID != client {
+			return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "Subject token does not identify the client"}
+		}
+		return &subjectToken{subject: svid.ID, expiry: svid.Expiry}, nil
+	case tokenexchange.TokenTypeAccessToken:
+		claims, err := s.verify(token)
+		if err != nil {
+			slog.Warn("Invalid subject token", "error", err)
+			return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "Invalid subject token"}
+		}
+		if !slices.Contains([]string(claims.Audience), client.String()) {
+			return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "Subject token was not issued to the client"}
+		}
+		subject, err := spiffeid.FromString(claims.Subject)
+		if err != nil {
+			return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "Invalid subject in subject token"}
+		}
+		return &subjectToken{subject: subject, act: claims.Act, scopes: strings.Fields(claims.Scope), expiry: claims.Expiry.Time()}, nil
+	default:
+		return nil, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "Unsupported subject token type"}
+	}
+}
+
+// validateActorToken validates a JWT-SVID actor token, which must identify the caller.
+func (s *exchangeServer) validateActorToken(tokenType, token string, client spiffeid.ID) (spiffeid.ID, *tokenexchange.OAuthError) {
+	if tokenType != tokenexchange.TokenTypeJWTSVID {
+		return spiffeid.ID{}, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "Unsupported actor token type"}
+	}
+	svid, err := jwtsvid.ParseAndValidate(token, s.bundles, []string{s.issuer + exchangeTokenPath})
+	if err != nil {
+		slog.Warn("Invalid actor token", "error", err)
+		return spiffeid.ID{}, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "Invalid actor token"}
+	}
+	if svid.ID != client {
+		return spiffeid.ID{}, &tokenexchange.OAuthError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "Actor token does not identify the client"}
+	}
+	return svid.ID, nil
+}
+
+// issue mints a signed access token expiring at expiry, bound to the DPoP key
+// with thumbprint jkt if it is non-empty.
+func (s *exchangeServer) issue(subject spiffeid.ID, audience string, scopes []string, act *tokenexchange.ActorClaim, jkt string, expiry time.Time) (string, error) {
+	jti, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	var cnf *tokenexchange.ConfirmationClaim
+	if jkt != "" {
+		cnf = &tokenexchange.ConfirmationClaim{JKT: jkt}
+	}
+	now := time.Now()
+	return jwt.Signed(s.signer).Claims(tokenexchange.TokenClaims{
+		Claims: jwt.Claims{
+			Issuer:    s.issuer,
+			Subject:   subject.String(),
+			Audience:  jwt.Audience{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(expiry),
+			ID:        jti,
+		},
+		Act:   act,
+		Scope: strings.Join(scopes, " "),
+		Cnf:   cnf,
+	}).Serialize()
+}
+
+// verify checks the signature and validity of an access token issued by this server.
+func (s *exchangeServer) verify(token string) (*tokenexchange.TokenClaims, error) {
+	tok, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{exchangeSigningAlg})
+	if err != nil {
+		return nil, err
+	}
+	var claims tokenexchange.TokenClaims
+	if err := tok.Claims(s.key.Public(), &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Issuer: s.issuer, Time: time.Now()}, 0); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func signatureAlgNames(algs []jose.SignatureAlgorithm) []string {
+	names := make([]string, len(algs))
+	for i, alg := range algs {
+		names[i] = string(alg)
+	}
+	return names
+}
+
+func writeOAuthError(w http.ResponseWriter, oerr *tokenexchange.OAuthError) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, oerr.StatusCode, oerr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
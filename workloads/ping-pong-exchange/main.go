@@ -1,61 +1,126 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
-	"os/signal"
-	"slices"
+	"strconv"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-jose/go-jose/v4"
-	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/loadgen"
+	"github.com/cofide/cofide-demos/pkg/tokenexchange"
+	"github.com/cofide/cofide-demos/pkg/tracing"
+	"github.com/cofide/cofide-demos/pkg/whoami"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
-	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	ModeClient = "client"
 	ModeServer = "server"
 	ModeRelay  = "relay"
+
+	ModeExchangeServer = "exchange-server"
 )
 
 // Env holds configuration loaded from environment variables.
 type Env struct {
-	ActorSPIFFEID    string
-	ClientSPIFFEID   string
+	ActorSPIFFEID string
+	// AllowedActorChains is a semicolon-separated list of permitted delegation
+	// chains, each a comma-separated list of actor SPIFFE IDs in hop order.
+	AllowedActorChains string
+	// AllowedActors is a comma-separated list of SPIFFE IDs or trust domain IDs
+	// that every actor in a delegation chain must match.
+	AllowedActors string
+	// ClientSPIFFEID is the single authorized client, used if ClientSPIFFEIDs
+	// is unset.
+	ClientSPIFFEID string
+	// ClientSPIFFEIDs is a comma-separated list of SPIFFE ID patterns that
+	// token subjects must match.
+	ClientSPIFFEIDs string
+	// DeniedClientSPIFFEIDs is a comma-separated list of SPIFFE ID patterns
+	// rejected even if they match ClientSPIFFEIDs.
+	DeniedClientSPIFFEIDs string
+	// DPoPEnabled sender-constrains the access tokens obtained by clients and
+	// relays with DPoP proofs.
+	DPoPEnabled bool
+	// DPoPRequired rejects access tokens that are not DPoP-bound.
+	DPoPRequired         bool
+	ExchangeCacheEnabled bool
+	// ExchangeMaxAttempts is the number of attempts made for a token exchange
+	// that fails with a retryable error.
+	ExchangeMaxAttempts int
+	// ExchangeScopes are the scopes requested in token exchanges.
+	ExchangeScopes   []string
 	ExchangeURL      string
-	ListenAddress    string
-	Mode             string
+	ExchangePolicy   string
+	ExchangeTokenTTL time.Duration
+	Health           health.Config
+	// IntrospectionCacheTTL is how long active introspection results are
+	// cached in hybrid token validation.
+	IntrospectionCacheTTL time.Duration
+	ListenAddress         string
+	// Load configures load generation in client mode.
+	Load loadgen.Config
+	// MaxActorChainDepth limits the number of actors in a delegation chain.
+	// Negative means unlimited.
+	MaxActorChainDepth int
+	MetricsEnabled     bool
+	MetricsPort        string
+	Mode               string
+	// OIDCRediscoveryInterval is how often OIDC discovery is repeated. Zero
+	// disables re-discovery.
+	OIDCRediscoveryInterval time.Duration
+	// RelayForwardHeaders is a comma-separated list of request headers a relay
+	// forwards downstream.
+	RelayForwardHeaders string
+	// RelayMaxHops is the maximum number of relays a request may traverse.
+	RelayMaxHops int
+	// RoutePolicy is a JSON list of rules requiring token scopes and claims
+	// per method and path.
+	RoutePolicy      string
 	ServerURL        string
 	ServerSPIFFEID   string
 	SpiffeSocketPath string
+	// TokenValidation is how servers and relays validate access tokens: local,
+	// introspection or hybrid.
+	TokenValidation string
+	// TransportMode secures connections between clients, relays and servers:
+	// plaintext, tls or mtls, using X.509-SVIDs.
+	TransportMode string
 }
 
-var allowedSignatureAlgs = []jose.SignatureAlgorithm{jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512, jose.ES256, jose.ES384, jose.ES512}
+// bearerRealm is the realm advertised in WWW-Authenticate challenges.
+const bearerRealm = "ping-pong"
 
-// actorClaim represents the RFC 8693 "act" (actor) claim in a delegated token.
-type actorClaim struct {
-	Sub string `json:"sub"`
-}
+// exchangeCacheExpiryMargin is how long before expiry a cached access token is
+// replaced by a fresh exchange.
+const exchangeCacheExpiryMargin = 30 * time.Second
 
-// tokenClaims extends the standard JWT claims with the RFC 8693 "act" claim.
-type tokenClaims struct {
-	jwt.Claims
-	Act *actorClaim `json:"act,omitempty"`
-}
+// tracer creates the spans for pings and relayed requests. HTTP requests are
+// traced by otelhttp, and exchanges, JWT-SVID fetches, JWKS fetches and token
+// validation by pkg/tokenexchange.
+var tracer = otel.Tracer("github.com/cofide/cofide-demos/workloads/ping-pong-exchange")
 
 func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	ctx, stop := graceful.NotifyContext(context.Background())
 	defer stop()
 	if err := run(ctx, getEnv()); err != nil {
 		log.Fatal(err)
@@ -64,17 +129,51 @@ func main() {
 
 // getEnv reads and validates all required environment variables, exiting on error.
 func getEnv() *Env {
+	load, err := loadgen.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid load generation configuration", "error", err)
+		os.Exit(1)
+	}
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid health configuration", "error", err)
+		os.Exit(1)
+	}
 	host := getEnvWithDefault("PING_PONG_SERVICE_HOST", "ping-pong-server.demo")
 	port := getEnvWithDefault("PING_PONG_SERVICE_PORT", "8443")
+	transportMode := getTransportMode()
 	env := &Env{
-		ActorSPIFFEID:    getEnvWithDefault("ACTOR_SPIFFE_ID", ""),
-		ClientSPIFFEID:   getEnvWithDefault("CLIENT_SPIFFE_ID", ""),
-		ExchangeURL:      mustGetEnv("EXCHANGE_URL"),
-		ListenAddress:    getEnvWithDefault("PING_PONG_SERVER_LISTEN_ADDRESS", ":8443"),
-		Mode:             mustGetMode(),
-		ServerURL:        fmt.Sprintf("http://%s:%s", host, port),
-		ServerSPIFFEID:   getEnvWithDefault("SERVER_SPIFFE_ID", ""),
-		SpiffeSocketPath: getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", "unix:///spiffe-workload-api/spire-agent.sock"),
+		ActorSPIFFEID:           getEnvWithDefault("ACTOR_SPIFFE_ID", ""),
+		AllowedActorChains:      getEnvWithDefault("ALLOWED_ACTOR_CHAINS", ""),
+		AllowedActors:           getEnvWithDefault("ALLOWED_ACTORS", ""),
+		ClientSPIFFEID:          getEnvWithDefault("CLIENT_SPIFFE_ID", ""),
+		ClientSPIFFEIDs:         getEnvWithDefault("CLIENT_SPIFFE_IDS", ""),
+		DeniedClientSPIFFEIDs:   getEnvWithDefault("DENIED_CLIENT_SPIFFE_IDS", ""),
+		DPoPEnabled:             getEnvBooleanWithDefault("DPOP_ENABLED", false),
+		DPoPRequired:            getEnvBooleanWithDefault("DPOP_REQUIRED", false),
+		ExchangeCacheEnabled:    getEnvBooleanWithDefault("EXCHANGE_CACHE_ENABLED", true),
+		ExchangeMaxAttempts:     getEnvIntWithDefault("EXCHANGE_MAX_ATTEMPTS", 3),
+		ExchangeScopes:          parseScopes(getEnvWithDefault("EXCHANGE_SCOPES", "")),
+		ExchangeURL:             mustGetEnv("EXCHANGE_URL"),
+		ExchangePolicy:          getEnvWithDefault("EXCHANGE_POLICY", "[]"),
+		ExchangeTokenTTL:        getEnvDurationWithDefault("EXCHANGE_TOKEN_TTL", 5*time.Minute),
+		Health:                  healthConfig,
+		IntrospectionCacheTTL:   getEnvDurationWithDefault("INTROSPECTION_CACHE_TTL", 30*time.Second),
+		ListenAddress:           getEnvWithDefault("PING_PONG_SERVER_LISTEN_ADDRESS", ":8443"),
+		Load:                    load,
+		MaxActorChainDepth:      getEnvIntWithDefault("MAX_ACTOR_CHAIN_DEPTH", -1),
+		MetricsEnabled:          getEnvBooleanWithDefault("METRICS_ENABLED", true),
+		MetricsPort:             getEnvWithDefault("METRICS_PORT", ":8080"),
+		OIDCRediscoveryInterval: getEnvDurationWithDefault("OIDC_REDISCOVERY_INTERVAL", time.Hour),
+		RelayForwardHeaders:     getEnvWithDefault("RELAY_FORWARD_HEADERS", "Accept,Content-Type"),
+		RelayMaxHops:            getEnvIntWithDefault("RELAY_MAX_HOPS", 10),
+		Mode:                    mustGetMode(),
+		RoutePolicy:             getEnvWithDefault("ROUTE_POLICY", "[]"),
+		ServerURL:               fmt.Sprintf("%s://%s:%s", urlScheme(transportMode), host, port),
+		ServerSPIFFEID:          getEnvWithDefault("SERVER_SPIFFE_ID", ""),
+		SpiffeSocketPath:        getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", "unix:///spiffe-workload-api/spire-agent.sock"),
+		TokenValidation:         getTokenValidation(),
+		TransportMode:           transportMode,
 	}
 
 	if env.Mode == ModeClient || env.Mode == ModeRelay {
@@ -85,8 +184,8 @@ func getEnv() *Env {
 	}
 
 	if env.Mode == ModeServer || env.Mode == ModeRelay {
-		if _, err := spiffeid.FromString(env.ClientSPIFFEID); err != nil {
-			slog.Error("Invalid CLIENT_SPIFFE_ID", "error", err)
+		if _, err := newClientPolicy(env); err != nil {
+			slog.Error("Invalid client policy", "error", err)
 			os.Exit(1)
 		}
 	}
@@ -109,13 +208,68 @@ func getEnvWithDefault(variable string, defaultValue string) string {
 	return v
 }
 
+// getEnvBooleanWithDefault, getEnvIntWithDefault and getEnvDurationWithDefault
+// exit on a value that does not parse rather than falling back to the default,
+// as several of these variables are security limits that a typo must not relax.
+
+func getEnvBooleanWithDefault(variable string, defaultValue bool) bool {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Error("Invalid boolean value", "variable", variable, "error", err)
+		os.Exit(1)
+	}
+	return b
+}
+
+func getEnvIntWithDefault(variable string, defaultValue int) int {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Error("Invalid integer value", "variable", variable, "error", err)
+		os.Exit(1)
+	}
+	return i
+}
+
+func getEnvDurationWithDefault(variable string, defaultValue time.Duration) time.Duration {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Error("Invalid duration value", "variable", variable, "error", err)
+		os.Exit(1)
+	}
+	return d
+}
+
 func mustGetMode() string {
 	mode := mustGetEnv("PING_PONG_MODE")
 	switch mode {
-	case ModeClient, ModeServer, ModeRelay:
+	case ModeClient, ModeServer, ModeRelay, ModeExchangeServer:
+		return mode
+	default:
+		slog.Error("Invalid PING_PONG_MODE", "value", mode, "valid", []string{ModeClient, ModeServer, ModeRelay, ModeExchangeServer})
+		os.Exit(1)
+		return ""
+	}
+}
+
+func getTokenValidation() string {
+	mode := getEnvWithDefault("TOKEN_VALIDATION", tokenexchange.ValidationLocal)
+	switch mode {
+	case tokenexchange.ValidationLocal, tokenexchange.ValidationIntrospection, tokenexchange.ValidationHybrid:
 		return mode
 	default:
-		slog.Error("Invalid PING_PONG_MODE", "value", mode, "valid", []string{ModeClient, ModeServer, ModeRelay})
+		slog.Error("Invalid TOKEN_VALIDATION", "value", mode, "valid", []string{tokenexchange.ValidationLocal, tokenexchange.ValidationIntrospection, tokenexchange.ValidationHybrid})
 		os.Exit(1)
 		return ""
 	}
@@ -131,23 +285,52 @@ func mustGetEnv(variable string) string {
 }
 
 // run initialises shared dependencies (OIDC discovery, workload API) and starts
-// the client, server, or relay goroutine(s) depending on env.Mode.
+// the client, server, or relay goroutine(s) depending on env.Mode. In
+// exchange-server mode it instead serves a local token exchange service.
 func run(ctx context.Context, env *Env) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	shutdownTracing, err := tracing.Setup(ctx, "ping-pong-exchange-"+env.Mode)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		// Flush buffered spans even though ctx has been cancelled.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
+	if env.MetricsEnabled {
+		go runMetricsServer(ctx, env)
+	}
+
+	// OIDC discovery and connecting to the workload API are part of startup,
+	// so readiness waits for them.
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
+
+	if env.Mode == ModeExchangeServer {
+		slog.Info("Starting", "mode", env.Mode)
+		return runExchangeServer(ctx, env, checker)
+	}
+
 	initCtx, initCancel := context.WithTimeout(ctx, 30*time.Second)
 	defer initCancel()
 
-	httpClient := &http.Client{Timeout: 10 * time.Second}
+	httpClient := &http.Client{Timeout: 10 * time.Second, Transport: otelhttp.NewTransport(http.DefaultTransport)}
 
 	slog.Info("Starting", "mode", env.Mode)
 	slog.Info("Fetching OIDC discovery document", "issuer", env.ExchangeURL)
-	discovery, err := Discover(env.ExchangeURL, httpClient)
+	provider, err := tokenexchange.NewProvider(env.ExchangeURL, httpClient)
 	if err != nil {
 		return fmt.Errorf("OIDC discovery failed: %w", err)
 	}
-	slog.Info("OIDC discovery complete", "token_endpoint", discovery.TokenEndpoint, "jwks_uri", discovery.JWKSUri)
+	discovery := provider.Metadata()
+	slog.Info("OIDC discovery complete", "issuer", discovery.Issuer, "token_endpoint", discovery.TokenEndpoint, "jwks_uri", discovery.JWKSUri)
 
 	slog.Info("Connecting to SPIFFE workload API", "socket", env.SpiffeSocketPath)
 	wlClient, err := workloadapi.New(initCtx, workloadapi.WithAddr(env.SpiffeSocketPath))
@@ -156,43 +339,53 @@ func run(ctx context.Context, env *Env) error {
 	}
 	defer func() { _ = wlClient.Close() }()
 
-	exchangeClient := &ExchangeClient{
-		tokenURL: discovery.TokenEndpoint,
-		client:   httpClient,
-	}
-	svidSource := &JWTSVIDSource{
-		wlClient: wlClient,
-		audience: discovery.TokenEndpoint,
+	svidSource := tokenexchange.NewJWTSVIDSource(wlClient, provider.TokenEndpoint)
+	svidSource.OnFetch = recordJWTSVIDFetch
+	checker.AddReadinessCheck("jwt-svid", health.JWTSVIDCheck(svidSource.GetSVID))
+
+	var x509Source *workloadapi.X509Source
+	if env.TransportMode != TransportPlaintext {
+		slog.Info("Fetching X.509-SVID for transport security", "transport", env.TransportMode)
+		x509Source, err = workloadapi.NewX509Source(initCtx, workloadapi.WithClient(wlClient))
+		if err != nil {
+			return fmt.Errorf("unable to create X509Source: %w", err)
+		}
+		defer func() { _ = x509Source.Close() }()
+		checker.AddReadinessCheck("x509-svid", health.X509SVIDCheck(x509Source, env.Health.SVIDExpiryMargin))
 	}
 
 	wg := sync.WaitGroup{}
+	if env.OIDCRediscoveryInterval > 0 {
+		wg.Go(func() { provider.Run(ctx, env.OIDCRediscoveryInterval) })
+	}
 
 	var client *pingPongClient
 	if env.Mode == ModeClient || env.Mode == ModeRelay {
-		client = &pingPongClient{
-			env:            env,
-			svidSource:     svidSource,
-			exchangeClient: exchangeClient,
-			client:         &http.Client{Timeout: 10 * time.Second},
+		client, err = newPingPongClient(env, provider, svidSource, x509Source, httpClient)
+		if err != nil {
+			return err
 		}
 	}
 	if env.Mode == ModeClient {
-		wg.Go(func() { client.run(ctx) })
+		// A load generation run ends the process when it completes.
+		wg.Go(func() {
+			defer cancel()
+			client.run(ctx)
+		})
 	}
 
 	var serverErr error
 	if env.Mode == ModeServer || env.Mode == ModeRelay {
-		server := pingPongServer{
-			env:              env,
-			authorizedClient: spiffeid.RequireFromString(env.ClientSPIFFEID),
-			exchangeClient:   exchangeClient,
-			svidSource:       svidSource,
-			jwksFetcher:      &JWKSFetcher{url: discovery.JWKSUri, client: httpClient},
-			client:           client,
+		authenticator, err := newAuthenticator(ctx, &wg, env, provider, svidSource, httpClient, checker)
+		if err != nil {
+			return err
 		}
-		if env.ActorSPIFFEID != "" {
-			id := spiffeid.RequireFromString(env.ActorSPIFFEID)
-			server.authorizedActor = &id
+		server := pingPongServer{
+			env:           env,
+			authenticator: authenticator,
+			svidSource:    svidSource,
+			tlsConfig:     serverTLSConfig(env.TransportMode, x509Source),
+			client:        client,
 		}
 		wg.Go(func() {
 			defer cancel()
@@ -200,22 +393,175 @@ func run(ctx context.Context, env *Env) error {
 		})
 	}
 
+	checker.MarkStarted()
 	wg.Wait()
 	return serverErr
 }
 
+// newPingPongClient creates a client whose requests carry access tokens for
+// the downstream server, obtained by token exchange.
+func newPingPongClient(env *Env, provider *tokenexchange.Provider, svidSource *tokenexchange.JWTSVIDSource, x509Source *workloadapi.X509Source, httpClient *http.Client) (*pingPongClient, error) {
+	var opts []tokenexchange.ClientOption
+	opts = append(opts, tokenexchange.WithMaxAttempts(env.ExchangeMaxAttempts), tokenexchange.WithOnAttempt(recordExchangeAttempt))
+	var dpopSigner *tokenexchange.DPoPSigner
+	if env.DPoPEnabled {
+		var err error
+		if dpopSigner, err = tokenexchange.NewDPoPSigner(); err != nil {
+			return nil, err
+		}
+		slog.Info("Binding access tokens to DPoP key", "jkt", dpopSigner.Thumbprint())
+		opts = append(opts, tokenexchange.WithDPoP(dpopSigner))
+	}
+
+	var exchanger tokenexchange.Exchanger = tokenexchange.NewClient(provider.TokenEndpoint, httpClient, opts...)
+	if env.ExchangeCacheEnabled {
+		exchanger = tokenexchange.NewCachingClient(exchanger, exchangeCacheExpiryMargin)
+	}
+
+	serverID := spiffeid.RequireFromString(env.ServerSPIFFEID)
+	// Start from the default transport to keep its proxy, timeout and
+	// connection pooling settings.
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = clientTLSConfig(env.TransportMode, x509Source, serverID)
+	if env.Load.Enabled {
+		env.Load.ConfigureTransport(base)
+	}
+	return &pingPongClient{
+		env: env,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &tokenexchange.Transport{
+				// Trace context is injected after the token is obtained,
+				// so that the exchange is not part of the request's span.
+				Base:       otelhttp.NewTransport(base),
+				Exchanger:  exchanger,
+				SVIDSource: svidSource,
+				Audience:   tokenexchange.StaticAudience(env.ServerSPIFFEID),
+				Scopes:     env.ExchangeScopes,
+				DPoP:       dpopSigner,
+			},
+		},
+	}, nil
+}
+
+// newAuthenticator creates the authenticator validating tokens presented to
+// the server, starting the JWKS refresh in wg if needed and adding a readiness
+// check for it to checker. Tokens must be issued for the server's SPIFFE ID and
+// satisfy the client, actor and route policies.
+func newAuthenticator(ctx context.Context, wg *sync.WaitGroup, env *Env, provider *tokenexchange.Provider, svidSource *tokenexchange.JWTSVIDSource, httpClient *http.Client, checker *health.Checker) (*tokenexchange.Authenticator, error) {
+	actorPolicy, err := newActorPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+	clientPolicy, err := newClientPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Authorized clients", "allowed", cmp.Or(env.ClientSPIFFEIDs, env.ClientSPIFFEID), "denied", env.DeniedClientSPIFFEIDs)
+	routePolicy, err := parseRoutePolicy(env.RoutePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ROUTE_POLICY: %w", err)
+	}
+
+	var jwksFetcher *tokenexchange.JWKSFetcher
+	if env.TokenValidation != tokenexchange.ValidationIntrospection {
+		jwksFetcher = tokenexchange.NewJWKSFetcher(provider.JWKSURI, httpClient)
+		// Failed refreshes do not affect readiness once a JWKS has been
+		// fetched, since the cached keys remain in use.
+		var jwksFetched atomic.Bool
+		jwksFetcher.OnRefresh = func(err error) {
+			recordJWKSRefresh(err)
+			if err == nil {
+				jwksFetched.Store(true)
+			}
+		}
+		jwksFetcher.OnLookup = recordJWKSLookup
+		checker.AddReadinessCheck("jwks", func(context.Context) error {
+			if !jwksFetched.Load() {
+				return errors.New("JWKS not yet fetched")
+			}
+			return nil
+		})
+		wg.Go(func() { jwksFetcher.Run(ctx) })
+	}
+	var introspector *tokenexchange.Introspector
+	if env.TokenValidation != tokenexchange.ValidationLocal {
+		if provider.IntrospectionEndpoint() == "" {
+			return nil, fmt.Errorf("OIDC provider does not advertise an introspection_endpoint, required by TOKEN_VALIDATION=%s", env.TokenValidation)
+		}
+		// Every token is introspected in introspection mode.
+		var cacheTTL time.Duration
+		if env.TokenValidation == tokenexchange.ValidationHybrid {
+			cacheTTL = env.IntrospectionCacheTTL
+		}
+		introspector = tokenexchange.NewIntrospector(provider.IntrospectionEndpoint, httpClient, svidSource, cacheTTL)
+	}
+	slog.Info("Validating access tokens", "strategy", env.TokenValidation)
+
+	return tokenexchange.NewAuthenticator(tokenexchange.AuthenticatorConfig{
+		Provider: provider,
+		Audience: func(ctx context.Context) (string, error) {
+			svid, err := svidSource.GetSVID(ctx)
+			if err != nil {
+				return "", err
+			}
+			return svid.ID.String(), nil
+		},
+		Validation:   env.TokenValidation,
+		JWKS:         jwksFetcher,
+		Introspector: introspector,
+		RequireDPoP:  env.DPoPRequired,
+		Authorize: func(r *http.Request, p *tokenexchange.Principal) *tokenexchange.Error {
+			return authorize(r, p, clientPolicy, actorPolicy, routePolicy)
+		},
+		Realm:          bearerRealm,
+		OnAuthenticate: recordAuthentication,
+	})
+}
+
+// authorize applies the client, actor and route policies to an authenticated
+// principal.
+func authorize(r *http.Request, p *tokenexchange.Principal, clientPolicy *clientPolicy, actorPolicy *actorPolicy, routePolicy routePolicy) *tokenexchange.Error {
+	if err := clientPolicy.authorize(p.Subject); err != nil {
+		slog.Warn("Rejected unauthorized request", "subject", p.Subject, "error", err)
+		return tokenexchange.InvalidToken("Invalid subject").WithReason(tokenexchange.ReasonWrongSubject)
+	}
+
+	if err := actorPolicy.authorize(p.Actors); err != nil {
+		if errors.Is(err, errMissingActor) {
+			slog.Warn("Missing act claim in delegated token")
+			return tokenexchange.InvalidToken("Missing act claim").WithReason(tokenexchange.ReasonMissingActor)
+		}
+		slog.Warn("Rejected unauthorized delegation chain", "chain", p.ChainString(), "error", err)
+		return tokenexchange.InvalidToken("Invalid actor").WithReason(tokenexchange.ReasonInvalidActor)
+	}
+
+	if herr := routePolicy.authorize(r, p.Scopes, p.Claims); herr != nil {
+		slog.Warn("Rejected request not permitted by route policy", "subject", p.Subject, "method", r.Method, "path", r.URL.Path, "error", herr.Description)
+		return herr
+	}
+	return nil
+}
+
 // pingPongClient periodically sends a ping to the server, using a token-exchanged
 // JWT as its credential.
 type pingPongClient struct {
-	env            *Env
-	svidSource     *JWTSVIDSource
-	exchangeClient *ExchangeClient
-	client         *http.Client
+	env *Env
+	// client obtains and attaches access tokens by token exchange.
+	client *http.Client
 }
 
-// run loops every 5 seconds: fetches a JWT-SVID, exchanges it for an access
-// token, and sends a ping to the server until ctx is cancelled.
+// run sends a ping to the server every 5 seconds until ctx is cancelled, or
+// performs a load generation run if configured.
 func (c *pingPongClient) run(ctx context.Context) {
+	if c.env.Load.Enabled {
+		loadgen.Run(ctx, c.env.Load, func(ctx context.Context, payload []byte) error {
+			_, err := c.ping(ctx, payload)
+			return err
+		}).Log()
+		return
+	}
+
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 	for {
@@ -225,54 +571,50 @@ func (c *pingPongClient) run(ctx context.Context) {
 		case <-ticker.C:
 		}
 
-		svid, err := c.svidSource.GetSVID(ctx)
-		if err != nil {
-			slog.With("error", err).Warn("Failed to obtain SVID")
-			continue
-		}
-		slog.Info("Obtained JWT-SVID", "id", svid.ID.String())
-
-		token, err := c.doTokenExchange(ctx, svid)
-		if err != nil {
-			slog.With("error", err).Warn("Failed to obtain access token")
-			continue
-		}
-		slog.Info("Obtained access token via token exchange", "audience", c.env.ServerSPIFFEID)
-
 		slog.Info("Sending ping", "url", c.env.ServerURL)
-		body, err := c.ping(ctx, token)
-		if err != nil {
+		body, err := c.ping(ctx, nil)
+		var exchangeErr *tokenexchange.ExchangeError
+		switch {
+		case ctx.Err() != nil:
+			// The request was abandoned because the client is shutting down.
+			return
+		case errors.As(err, &exchangeErr):
+			slog.Warn("Failed to obtain access token", "error", exchangeErr.Err)
+		case err != nil:
 			slog.Error("Failed to reach server", "error", err)
-		} else {
+		default:
 			slog.Info("Received pong", "response", string(body))
 		}
 	}
 }
 
-// doTokenExchange exchanges the given JWT-SVID for an access token scoped to
-// the configured server SPIFFE ID.
-func (c *pingPongClient) doTokenExchange(ctx context.Context, svid *jwtsvid.SVID) (string, error) {
-	exchangeResult, err := c.exchangeClient.Exchange(ctx, ExchangeParams{
-		ClientAssertionType: "urn:ietf:params:oauth:client-assertion-type:jwt-spiffe",
-		ClientAssertion:     svid.Marshal(),
-		SubjectTokenType:    "urn:ietf:params:oauth:token-type:jwt_spiffe",
-		SubjectToken:        svid.Marshal(),
-		Audience:            c.env.ServerSPIFFEID,
-	})
-	if err != nil {
-		return "", err
-	}
-	return exchangeResult.Token, nil
-}
+// ping sends a request to the server and returns the response body. The
+// request is a POST carrying payload if it is non-nil, and a GET otherwise. The
+// client's transport exchanges the workload's JWT-SVID for an access token
+// scoped to the server's SPIFFE ID and sends it as a Bearer or DPoP credential.
+func (c *pingPongClient) ping(ctx context.Context, payload []byte) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "ping", trace.WithAttributes(
+		attribute.String("url.full", c.env.ServerURL),
+		tokenexchange.AttrAudience.String(c.env.ServerSPIFFEID),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 
-// ping sends a GET request to the server with the token as a Bearer credential
-// and returns the response body.
-func (c *pingPongClient) ping(ctx context.Context, clientToken string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.env.ServerURL, nil)
+	method := http.MethodGet
+	var reqBody io.Reader
+	if payload != nil {
+		method = http.MethodPost
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.env.ServerURL, reqBody)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", clientToken))
 
 	r, err := c.client.Do(req)
 	if err != nil {
@@ -287,200 +629,96 @@ func (c *pingPongClient) ping(ctx context.Context, clientToken string) ([]byte,
 		return nil, err
 	}
 	if r.StatusCode != http.StatusOK {
+		if challenge := r.Header.Get("WWW-Authenticate"); challenge != "" {
+			return nil, fmt.Errorf("unexpected status code: %d: %s", r.StatusCode, challenge)
+		}
 		return nil, fmt.Errorf("unexpected status code: %d: %s", r.StatusCode, body)
 	}
 	return body, nil
 }
 
-// pingPongServer validates incoming JWT bearer tokens and responds with a pong.
-// When a client is set (relay mode) it instead performs a delegated token exchange
-// and forwards the request downstream.
+// pingPongServer validates incoming access tokens and responds with a pong.
+// When a client is set (relay mode) it instead forwards the request downstream
+// with a delegated token.
 type pingPongServer struct {
-	env              *Env
-	authorizedClient spiffeid.ID
-	authorizedActor  *spiffeid.ID // nil if actor validation not required
-	exchangeClient   *ExchangeClient
-	svidSource       *JWTSVIDSource
-	jwksFetcher      *JWKSFetcher
-	client           *pingPongClient
+	env           *Env
+	authenticator *tokenexchange.Authenticator
+	svidSource    *tokenexchange.JWTSVIDSource
+	// tlsConfig is nil in plaintext mode.
+	tlsConfig *tls.Config
+	client    *pingPongClient
 }
 
 // run starts the HTTP server and blocks until ctx is cancelled or a fatal error occurs.
 func (s *pingPongServer) run(ctx context.Context) error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.handler)
+	mux.Handle("/", s.authenticator.Middleware(http.HandlerFunc(s.handler)))
+	// Relays answer identity requests themselves rather than forwarding them.
+	mux.Handle(whoami.Path, s.authenticator.Middleware(http.HandlerFunc(s.identityHandler)))
 
 	server := &http.Server{
 		Addr:              s.env.ListenAddress,
-		Handler:           mux,
+		Handler:           otelhttp.NewHandler(mux, s.env.Mode),
+		TLSConfig:         s.tlsConfig,
 		ReadHeaderTimeout: time.Second * 10,
-		BaseContext:       func(_ net.Listener) context.Context { return ctx },
 	}
 
-	go func() {
-		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := server.Shutdown(shutdownCtx); err != nil {
-			slog.Error("Server shutdown error", "error", err)
-		}
-	}()
-
-	slog.Info("Server listening", "address", s.env.ListenAddress)
-	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	slog.Info("Server listening", "address", s.env.ListenAddress, "transport", s.env.TransportMode)
+	serve := server.ListenAndServe
+	if s.tlsConfig != nil {
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+	}
+	if err := graceful.Serve(ctx, server, serve); err != nil {
 		return fmt.Errorf("failed to serve: %w", err)
 	}
 
 	return nil
 }
 
-// httpError carries an HTTP status code and message for use in handler responses.
-type httpError struct {
-	status  int
-	message string
-}
-
-func (e *httpError) Error() string { return e.message }
-
-// handler authenticates the incoming request and either relays it downstream
-// (relay mode) or writes a "pong" response (server mode).
+// handler either relays the authenticated request downstream (relay mode) or
+// writes a "pong" response (server mode).
 func (s *pingPongServer) handler(w http.ResponseWriter, r *http.Request) {
-	subjectID, token, svid, herr := s.authenticate(r)
-	if herr != nil {
-		w.WriteHeader(herr.status)
-		_, _ = w.Write([]byte(herr.message))
-		return
-	}
+	caller, _ := tokenexchange.PrincipalFromContext(r.Context())
+	trace.SpanFromContext(r.Context()).SetAttributes(caller.SpanAttributes()...)
 
 	if s.client != nil {
-		slog.Info("Received ping from client, forwarding to downstream server", "subject", subjectID, "downstream", s.client.env.ServerURL)
-		s.handleRelay(w, r, token, svid)
+		slog.Info("Received request from client, forwarding to downstream server", "subject", caller.Subject, "chain", caller.ChainString(), "method", r.Method, "path", r.URL.Path, "downstream", s.client.env.ServerURL)
+		s.handleRelay(w, r, caller)
 		return
 	}
 
-	slog.Info("Received ping from client", "subject", subjectID)
+	slog.Info("Received ping from client", "subject", caller.Subject, "chain", caller.ChainString())
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte("...pong")); err != nil {
 		slog.Error("Error writing response", "error", err)
 	} else {
-		slog.Info("Sent pong to client", "subject", subjectID)
+		slog.Info("Sent pong to client", "subject", caller.Subject)
 	}
 }
 
-// authenticate validates the Bearer token in the request, returning the verified
-// subject SPIFFE ID, raw token, and server SVID on success.
-func (s *pingPongServer) authenticate(r *http.Request) (spiffeid.ID, string, *jwtsvid.SVID, *httpError) {
-	auth := r.Header.Get("Authorization")
-	if len(auth) < 7 || auth[:7] != "Bearer " {
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "No token provided by client"}
-	}
-	token := auth[7:]
-
-	jwks, err := s.jwksFetcher.GetJWKS()
-	if err != nil {
-		slog.Error("Failed to fetch JWKS", "error", err)
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusServiceUnavailable, "Unable to fetch JWKS"}
-	}
-
-	tok, err := jwt.ParseSigned(token, allowedSignatureAlgs)
-	if err != nil {
-		slog.Warn("Failed to parse token", "error", err)
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid token"}
-	}
-
-	var claims tokenClaims
-	if err = tok.Claims(jwks, &claims); err != nil {
-		slog.Warn("Failed to verify token", "error", err)
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid token"}
-	}
-
-	if err = claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, 0); err != nil {
-		slog.Warn("Token failed time validation", "error", err)
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid token"}
-	}
-
-	if claims.Subject == "" {
-		slog.Warn("Invalid subject in token")
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid subject in token"}
-	}
-
-	svid, err := s.svidSource.GetSVID(r.Context())
-	if err != nil {
-		slog.Error("Failed to obtain SVID", "error", err)
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusInternalServerError, "Unable to obtain SVID"}
-	}
-
-	if !slices.Contains([]string(claims.Audience), svid.ID.String()) {
-		slog.Warn("Invalid audience in token", "audience", claims.Audience, "expected", svid.ID.String())
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid audience in token"}
-	}
-
-	subjectID, err := spiffeid.FromString(claims.Subject)
-	if err != nil {
-		slog.Warn("Invalid subject in request", "subject", claims.Subject)
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid subject"}
-	}
-
-	if err := spiffeid.MatchID(s.authorizedClient)(subjectID); err != nil {
-		slog.Warn("Rejected unauthorized request", "subject", claims.Subject)
-		return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid subject"}
-	}
-
-	if s.authorizedActor != nil {
-		if claims.Act == nil || claims.Act.Sub == "" {
-			slog.Warn("Missing act claim in delegated token")
-			return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Missing act claim"}
-		}
-		actorID, err := spiffeid.FromString(claims.Act.Sub)
-		if err != nil {
-			slog.Warn("Invalid act.sub in token", "act_sub", claims.Act.Sub)
-			return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid actor"}
-		}
-		if err := spiffeid.MatchID(*s.authorizedActor)(actorID); err != nil {
-			slog.Warn("Rejected unauthorized actor", "actor", claims.Act.Sub)
-			return spiffeid.ID{}, "", nil, &httpError{http.StatusUnauthorized, "Invalid actor"}
-		}
-		slog.Info("Validated delegated token", "subject", subjectID, "actor", claims.Act.Sub, "audience", svid.ID)
-	} else {
-		slog.Info("Validated token", "subject", subjectID, "audience", svid.ID)
-	}
-
-	return subjectID, token, svid, nil
-}
-
-// handleRelay performs a token exchange and forwards the ping to the downstream server.
-func (s *pingPongServer) handleRelay(w http.ResponseWriter, r *http.Request, token string, svid *jwtsvid.SVID) {
-	slog.Info("Performing delegated token exchange", "actor", svid.ID.String(), "audience", s.env.ServerSPIFFEID)
-	exchangeResult, err := s.exchangeClient.Exchange(r.Context(), ExchangeParams{
-		ClientAssertionType: "urn:ietf:params:oauth:client-assertion-type:jwt-spiffe",
-		ClientAssertion:     svid.Marshal(),
-		SubjectTokenType:    "urn:ietf:params:oauth:token-type:access_token",
-		SubjectToken:        token,
-		ActorTokenType:      "urn:ietf:params:oauth:token-type:jwt_spiffe",
-		ActorToken:          svid.Marshal(),
-		Audience:            s.env.ServerSPIFFEID,
-	})
-	if err != nil {
-		slog.Error("Failed to obtain delegated access token", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte("Unable to obtain access token"))
-		return
-	}
-	slog.Info("Obtained delegated access token, forwarding ping to downstream server", "url", s.client.env.ServerURL)
-
-	body, err := s.client.ping(r.Context(), exchangeResult.Token)
-	if err != nil {
-		slog.Error("Failed to reach downstream server", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte("Problem reaching downstream server"))
-		return
-	}
-	slog.Info("Received pong from downstream server, relaying to client")
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	if _, err = w.Write(body); err != nil {
-		slog.Error("Error writing response", "error", err)
-	}
+// identityHandler serves the identity the caller's token was validated with.
+func (s *pingPongServer) identityHandler(w http.ResponseWriter, r *http.Request) {
+	caller, _ := tokenexchange.PrincipalFromContext(r.Context())
+	id := &whoami.Identity{
+		PeerID:    caller.Subject.String(),
+		Mechanism: whoami.MechanismExchangedToken,
+		Token: &whoami.Token{
+			Subject:  caller.Subject.String(),
+			Audience: caller.Audience,
+			Issuer:   caller.Issuer,
+			Scopes:   caller.Scopes,
+			Expiry:   caller.Expiry,
+		},
+	}
+	for _, actor := range caller.Actors {
+		id.Token.Actors = append(id.Token.Actors, actor.String())
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		id.Certificate = whoami.NewCertificate(r.TLS.PeerCertificates[0])
+	}
+	if svid, err := s.svidSource.GetSVID(r.Context()); err == nil {
+		id.ServerID = svid.ID.String()
+	}
+	whoami.Handler(w, r.WithContext(whoami.NewContext(r.Context(), id)))
 }
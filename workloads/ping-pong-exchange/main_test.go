@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/tokenexchange"
+	"github.com/cofide/cofide-demos/pkg/whoami"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	exchangeID = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/exchange")
+	clientID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/client")
+	relayID    = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/relay")
+	relay2ID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/relay2")
+	serverID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/server")
+)
+
+// startWorkload runs a workload with env, issued SVIDs for id by ca, until the
+// test completes, and returns its URL once it is listening.
+func startWorkload(t *testing.T, ca *spiffetest.CA, id spiffeid.ID, env *Env) string {
+	t.Helper()
+	if env.ListenAddress == "" {
+		env.ListenAddress = spiffetest.FreeAddr(t)
+	}
+	env.SpiffeSocketPath = spiffetest.New(t, ca, spiffetest.WithIDs(id)).Addr()
+	env.Health = health.Config{Port: "127.0.0.1:0"}
+	done := spiffetest.StartWorkload(t, func(ctx context.Context) error { return run(ctx, env) })
+	spiffetest.WaitReady(t, env.ListenAddress, done)
+	return urlScheme(env.TransportMode) + "://" + env.ListenAddress
+}
+
+// startExchange runs an exchange server applying policy and returns its URL.
+func startExchange(t *testing.T, ca *spiffetest.CA, policy ...exchangePolicyRule) string {
+	t.Helper()
+	data, err := json.Marshal(exchangePolicy(policy))
+	if err != nil {
+		t.Fatalf("failed to encode exchange policy: %v", err)
+	}
+	addr := spiffetest.FreeAddr(t)
+	return startWorkload(t, ca, exchangeID, &Env{
+		Mode:             ModeExchangeServer,
+		ExchangeURL:      "http://" + addr,
+		ExchangePolicy:   string(data),
+		ExchangeTokenTTL: time.Minute,
+		ListenAddress:    addr,
+		TransportMode:    TransportPlaintext,
+	})
+}
+
+// newEnv returns the configuration of a workload in mode using the exchange
+// server at exchangeURL, with the defaults of getEnv.
+func newEnv(mode, exchangeURL string) *Env {
+	return &Env{
+		Mode:                  mode,
+		ExchangeURL:           exchangeURL,
+		ExchangeCacheEnabled:  true,
+		ExchangeMaxAttempts:   3,
+		IntrospectionCacheTTL: 30 * time.Second,
+		MaxActorChainDepth:    -1,
+		RelayForwardHeaders:   "Accept,Content-Type",
+		RelayMaxHops:          10,
+		RoutePolicy:           "[]",
+		TokenValidation:       tokenexchange.ValidationLocal,
+		TransportMode:         TransportPlaintext,
+	}
+}
+
+// newServerEnv returns the configuration of a server accepting tokens for
+// clientID.
+func newServerEnv(exchangeURL string) *Env {
+	env := newEnv(ModeServer, exchangeURL)
+	env.ClientSPIFFEID = clientID.String()
+	return env
+}
+
+// newRelayEnv returns the configuration of a relay accepting tokens for
+// clientID and forwarding requests to the server with SPIFFE ID id at url.
+func newRelayEnv(exchangeURL string, id spiffeid.ID, url string) *Env {
+	env := newServerEnv(exchangeURL)
+	env.Mode = ModeRelay
+	env.ServerSPIFFEID = id.String()
+	env.ServerURL = url
+	return env
+}
+
+// newClientEnv returns the configuration of a client for the server with
+// SPIFFE ID id at url, requesting scopes.
+func newClientEnv(exchangeURL string, id spiffeid.ID, url string, scopes ...string) *Env {
+	env := newEnv(ModeClient, exchangeURL)
+	env.ServerSPIFFEID = id.String()
+	env.ServerURL = url
+	env.ExchangeScopes = scopes
+	return env
+}
+
+// newClient returns a client, issued SVIDs for id by ca, that sends requests
+// to the server configured in env.
+func newClient(t *testing.T, ca *spiffetest.CA, id spiffeid.ID, env *Env) *pingPongClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addr := spiffetest.New(t, ca, spiffetest.WithIDs(id)).Addr()
+	wlClient, err := workloadapi.New(ctx, workloadapi.WithAddr(addr))
+	if err != nil {
+		t.Fatalf("failed to create workload client: %v", err)
+	}
+	t.Cleanup(func() { _ = wlClient.Close() })
+	var x509Source *workloadapi.X509Source
+	if env.TransportMode != TransportPlaintext {
+		x509Source, err = workloadapi.NewX509Source(ctx, workloadapi.WithClient(wlClient))
+		if err != nil {
+			t.Fatalf("failed to create X509Source: %v", err)
+		}
+		t.Cleanup(func() { _ = x509Source.Close() })
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	provider, err := tokenexchange.NewProvider(env.ExchangeURL, httpClient)
+	if err != nil {
+		t.Fatalf("OIDC discovery failed: %v", err)
+	}
+	svidSource := tokenexchange.NewJWTSVIDSource(wlClient, provider.TokenEndpoint)
+	c, err := newPingPongClient(env, provider, svidSource, x509Source, httpClient)
+	if err != nil {
+		t.Fatalf("newPingPongClient() error = %v", err)
+	}
+	return c
+}
+
+// do sends a request for path with the client's access token and returns the
+// response status, WWW-Authenticate challenge and body.
+func do(t *testing.T, c *pingPongClient, method, path string, body io.Reader) (int, string, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, c.env.ServerURL+path, body)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return resp.StatusCode, resp.Header.Get("WWW-Authenticate"), string(data)
+}
+
+// failures returns a function reporting how many requests have been rejected
+// for reason since it was created.
+func failures(reason string) func() float64 {
+	before := testutil.ToFloat64(tokenValidationFailures.WithLabelValues(reason))
+	return func() float64 {
+		return testutil.ToFloat64(tokenValidationFailures.WithLabelValues(reason)) - before
+	}
+}
+
+func TestPing(t *testing.T) {
+	for _, validation := range []string{tokenexchange.ValidationLocal, tokenexchange.ValidationIntrospection, tokenexchange.ValidationHybrid} {
+		t.Run(validation, func(t *testing.T) {
+			ca := spiffetest.NewCA(t, exampleOrg)
+			exchangeURL := startExchange(t, ca, exchangePolicyRule{Client: clientID.String(), Audiences: []string{serverID.String()}})
+			env := newServerEnv(exchangeURL)
+			env.TokenValidation = validation
+			serverURL := startWorkload(t, ca, serverID, env)
+			c := newClient(t, ca, clientID, newClientEnv(exchangeURL, serverID, serverURL, "ping:read"))
+
+			body, err := c.ping(context.Background(), nil)
+			if err != nil {
+				t.Fatalf("ping() error = %v", err)
+			}
+			if string(body) != "...pong" {
+				t.Errorf("ping() = %q, want %q", body, "...pong")
+			}
+
+			status, _, data := do(t, c, http.MethodGet, whoami.Path, nil)
+			if status != http.StatusOK {
+				t.Fatalf("GET %s = %d %q", whoami.Path, status, data)
+			}
+			var id whoami.Identity
+			if err := json.Unmarshal([]byte(data), &id); err != nil {
+				t.Fatalf("invalid identity %q: %v", data, err)
+			}
+			if id.PeerID != clientID.String() || id.ServerID != serverID.String() || id.Mechanism != whoami.MechanismExchangedToken {
+				t.Errorf("identity = %+v, want peer %s, server %s, mechanism %s", id, clientID, serverID, whoami.MechanismExchangedToken)
+			}
+			if id.Token == nil || id.Token.Issuer != exchangeURL || len(id.Token.Actors) != 0 || strings.Join(id.Token.Scopes, " ") != "ping:read" {
+				t.Errorf("identity token = %+v, want issuer %s, scope ping:read and no actors", id.Token, exchangeURL)
+			}
+		})
+	}
+}
+
+func TestRoutePolicy(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca, exchangePolicyRule{Client: clientID.String(), Audiences: []string{serverID.String()}})
+	env := newServerEnv(exchangeURL)
+	env.RoutePolicy = `[
+		{"path": "/admin", "scopes": ["ping:admin"]},
+		{"method": "POST", "scopes": ["ping:write"]},
+		{"claims": {"iss": "` + exchangeURL + `"}}
+	]`
+	serverURL := startWorkload(t, ca, serverID, env)
+	c := newClient(t, ca, clientID, newClientEnv(exchangeURL, serverID, serverURL, "ping:read"))
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodGet, "/admin", http.StatusForbidden},
+		{http.MethodGet, "/admin/users", http.StatusForbidden},
+		// /administrator is not below /admin, so the /admin rule does not apply.
+		{http.MethodGet, "/administrator", http.StatusOK},
+		{http.MethodPost, "/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			status, challenge, body := do(t, c, tt.method, tt.path, nil)
+			if status != tt.want {
+				t.Fatalf("%s %s = %d %q, want %d", tt.method, tt.path, status, body, tt.want)
+			}
+			if status == http.StatusForbidden && !strings.Contains(challenge, `error="insufficient_scope"`) {
+				t.Errorf("challenge = %q, want insufficient_scope", challenge)
+			}
+		})
+	}
+}
+
+func TestRoutePolicyRules(t *testing.T) {
+	policy, err := parseRoutePolicy(`[{"method": "GET", "path": "/public"}]`)
+	if err != nil {
+		t.Fatalf("parseRoutePolicy() error = %v", err)
+	}
+	none, err := parseRoutePolicy("[]")
+	if err != nil {
+		t.Fatalf("parseRoutePolicy() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		policy  routePolicy
+		method  string
+		path    string
+		allowed bool
+	}{
+		{"matching rule", policy, http.MethodGet, "/public", true},
+		{"unmatched path", policy, http.MethodGet, "/private", false},
+		{"unmatched method", policy, http.MethodPost, "/public", false},
+		{"method differing in case", policy, "get", "/public", false},
+		{"empty policy", none, http.MethodPost, "/private", true},
+	}
+	for _, tt := range tests {
+		herr := tt.policy.authorize(httptest.NewRequest(tt.method, tt.path, nil), nil, nil)
+		if (herr == nil) != tt.allowed {
+			t.Errorf("%s: authorize(%s %s) = %v, want allowed %v", tt.name, tt.method, tt.path, herr, tt.allowed)
+		}
+		if herr != nil && (herr.Status != http.StatusForbidden || herr.Code != "insufficient_scope") {
+			t.Errorf("%s: authorize(%s %s) = %d %s, want 403 insufficient_scope", tt.name, tt.method, tt.path, herr.Status, herr.Code)
+		}
+	}
+
+	if _, err := parseRoutePolicy(`[{"method": "get"}]`); err == nil {
+		t.Error("parseRoutePolicy() accepted a lower case method")
+	}
+}
+
+// The exchange server only grants the scopes its policy allows.
+func TestExchangeScopes(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca, exchangePolicyRule{Client: clientID.String(), Audiences: []string{serverID.String()}, Scopes: []string{"ping:read"}})
+
+	c := newClient(t, ca, clientID, newClientEnv(exchangeURL, serverID, "http://server.invalid", "ping:read"))
+	if _, err := c.ping(context.Background(), nil); errors.As(err, new(*tokenexchange.ExchangeError)) {
+		t.Errorf("token exchange failed: %v", err)
+	}
+	c = newClient(t, ca, clientID, newClientEnv(exchangeURL, serverID, "http://server.invalid", "ping:read", "ping:write"))
+	if _, err := c.ping(context.Background(), nil); oauthErrorCode(err) != "invalid_scope" {
+		t.Errorf("ping() error = %v, want invalid_scope", err)
+	}
+}
+
+// Requests are relayed from the client through relay and relay2 to the server,
+// which sees the delegation chain in the act claim of its token.
+func TestRelayDelegationChain(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca,
+		exchangePolicyRule{Client: clientID.String(), Audiences: []string{relayID.String()}},
+		exchangePolicyRule{Client: relayID.String(), Audiences: []string{relay2ID.String()}},
+		exchangePolicyRule{Client: relay2ID.String(), Audiences: []string{serverID.String()}},
+	)
+
+	tests := []struct {
+		name      string
+		configure func(*Env)
+		want      int
+		reason    string
+	}{
+		{
+			name: "allowed chain",
+			configure: func(env *Env) {
+				env.ActorSPIFFEID = relay2ID.String()
+				env.AllowedActorChains = relayID.String() + "," + relay2ID.String()
+				env.AllowedActors = "spiffe://example.org/ns/demo/*"
+				env.MaxActorChainDepth = 2
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:      "unexpected immediate actor",
+			configure: func(env *Env) { env.ActorSPIFFEID = relayID.String() },
+			want:      http.StatusUnauthorized,
+			reason:    tokenexchange.ReasonInvalidActor,
+		},
+		{
+			name: "chain not allowed",
+			configure: func(env *Env) {
+				env.AllowedActorChains = relay2ID.String() + ";" + relay2ID.String() + "," + relayID.String()
+			},
+			want:   http.StatusUnauthorized,
+			reason: tokenexchange.ReasonInvalidActor,
+		},
+		{
+			name:      "actor not allowed",
+			configure: func(env *Env) { env.AllowedActors = relay2ID.String() },
+			want:      http.StatusUnauthorized,
+			reason:    tokenexchange.ReasonInvalidActor,
+		},
+		{
+			name:      "chain too long",
+			configure: func(env *Env) { env.MaxActorChainDepth = 1 },
+			want:      http.StatusUnauthorized,
+			reason:    tokenexchange.ReasonInvalidActor,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newServerEnv(exchangeURL)
+			tt.configure(env)
+			serverURL := startWorkload(t, ca, serverID, env)
+			relay2URL := startWorkload(t, ca, relay2ID, newRelayEnv(exchangeURL, serverID, serverURL))
+			relayURL := startWorkload(t, ca, relayID, newRelayEnv(exchangeURL, relay2ID, relay2URL))
+			c := newClient(t, ca, clientID, newClientEnv(exchangeURL, relayID, relayURL))
+
+			var rejected func() float64
+			if tt.reason != "" {
+				rejected = failures(tt.reason)
+			}
+			status, challenge, body := do(t, c, http.MethodGet, "/", nil)
+			if status != tt.want {
+				t.Fatalf("GET / = %d %q %q, want %d", status, challenge, body, tt.want)
+			}
+			if status == http.StatusOK && body != "...pong" {
+				t.Errorf("GET / = %q, want %q", body, "...pong")
+			}
+			if rejected != nil && rejected() != 1 {
+				t.Errorf("%s rejections = %v, want 1", tt.reason, rejected())
+			}
+		})
+	}
+}
+
+func TestRejectsTokens(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	other := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/other")
+	exchangeURL := startExchange(t, ca,
+		exchangePolicyRule{Client: clientID.String(), Audiences: []string{serverID.String()}},
+		exchangePolicyRule{Client: other.String(), Audiences: []string{serverID.String()}},
+	)
+
+	tests := []struct {
+		name      string
+		client    spiffeid.ID
+		configure func(*Env)
+	}{
+		{"unauthorized client", other, func(*Env) {}},
+		// A server expecting a relay rejects tokens obtained directly by the
+		// client.
+		{"missing actor", clientID, func(env *Env) { env.ActorSPIFFEID = relayID.String() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newServerEnv(exchangeURL)
+			tt.configure(env)
+			serverURL := startWorkload(t, ca, serverID, env)
+			c := newClient(t, ca, tt.client, newClientEnv(exchangeURL, serverID, serverURL))
+
+			status, challenge, body := do(t, c, http.MethodGet, "/", nil)
+			if status != http.StatusUnauthorized {
+				t.Errorf("GET / = %d %q, want 401", status, body)
+			}
+			if !strings.Contains(challenge, `error="invalid_token"`) {
+				t.Errorf("challenge = %q, want invalid_token", challenge)
+			}
+		})
+	}
+}
+
+// Relays forward the method, path, query, body and configured headers of a
+// request, and stop requests exceeding the hop limit.
+func TestRelayForwardsRequests(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca,
+		exchangePolicyRule{Client: clientID.String(), Audiences: []string{relayID.String()}},
+		exchangePolicyRule{Client: relayID.String(), Audiences: []string{serverID.String()}},
+	)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintf(w, "%s %s %s %s hops=%s", r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type"), body, r.Header.Get(hopCountHeader))
+	}))
+	t.Cleanup(downstream.Close)
+	relayURL := startWorkload(t, ca, relayID, newRelayEnv(exchangeURL, serverID, downstream.URL))
+	c := newClient(t, ca, clientID, newClientEnv(exchangeURL, relayID, relayURL))
+
+	t.Run("forwarded", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPut, relayURL+"/items/1?q=x", strings.NewReader("ping"))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Not-Forwarded", "secret")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			t.Fatalf("PUT: %v", err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		want := "PUT /items/1?q=x application/json ping hops=1"
+		if resp.StatusCode != http.StatusAccepted || string(body) != want {
+			t.Errorf("PUT = %d %q, want %d %q", resp.StatusCode, body, http.StatusAccepted, want)
+		}
+	})
+
+	t.Run("hop limit", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, relayURL+"/", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set(hopCountHeader, "10")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			t.Fatalf("GET /: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("GET / = %d, want %d", resp.StatusCode, http.StatusLoopDetected)
+		}
+	})
+}
+
+// The relay rejects request bodies over relayMaxBodyBytes, whether or not
+// their length is known up front.
+func TestRelayLimits(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca,
+		exchangePolicyRule{Client: clientID.String(), Audiences: []string{relayID.String()}},
+		exchangePolicyRule{Client: relayID.String(), Audiences: []string{serverID.String()}},
+	)
+	// Unlike the server, the downstream reads request bodies, so that the relay
+	// forwards them in full.
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return
+		}
+		_, _ = w.Write([]byte("...pong"))
+	}))
+	t.Cleanup(downstream.Close)
+	relayURL := startWorkload(t, ca, relayID, newRelayEnv(exchangeURL, serverID, downstream.URL))
+	c := newClient(t, ca, clientID, newClientEnv(exchangeURL, relayID, relayURL))
+
+	tests := []struct {
+		name    string
+		body    io.Reader
+		outcome string
+		want    int
+	}{
+		{"small body", strings.NewReader("ping"), relayForwarded, http.StatusOK},
+		{"large body", bytes.NewReader(make([]byte, relayMaxBodyBytes+1)), relayBodyTooLarge, http.StatusRequestEntityTooLarge},
+		// A reader of unknown length is sent chunked, so the relay only finds
+		// it too large while forwarding it.
+		{"large chunked body", io.MultiReader(bytes.NewReader(make([]byte, relayMaxBodyBytes+1))), relayBodyTooLarge, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(relayRequests.WithLabelValues(tt.outcome))
+			status, _, body := do(t, c, http.MethodPost, "/", tt.body)
+			if status != tt.want {
+				t.Fatalf("POST / = %d %q, want %d", status, body, tt.want)
+			}
+			if got := testutil.ToFloat64(relayRequests.WithLabelValues(tt.outcome)) - before; got != 1 {
+				t.Errorf("relay_requests_total{outcome=%q} increased by %v, want 1", tt.outcome, got)
+			}
+		})
+	}
+
+}
+
+// A server rejects tokens from clients it does not authorize.
+func TestClientAuthorization(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	blocked := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/blocked")
+	other := spiffeid.RequireFromString("spiffe://example.org/ns/other/sa/client")
+	audiences := []string{serverID.String()}
+	exchangeURL := startExchange(t, ca,
+		exchangePolicyRule{Client: clientID.String(), Audiences: audiences},
+		exchangePolicyRule{Client: blocked.String(), Audiences: audiences},
+		exchangePolicyRule{Client: other.String(), Audiences: audiences},
+	)
+	env := newServerEnv(exchangeURL)
+	env.ClientSPIFFEIDs = "spiffe://example.org/ns/demo/*"
+	env.DeniedClientSPIFFEIDs = blocked.String()
+	serverURL := startWorkload(t, ca, serverID, env)
+
+	tests := []struct {
+		name   string
+		client spiffeid.ID
+		want   int
+	}{
+		{"allowed", clientID, http.StatusOK},
+		{"denied", blocked, http.StatusUnauthorized},
+		{"outside the allowed patterns", other, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClient(t, ca, tt.client, newClientEnv(exchangeURL, serverID, serverURL))
+			rejected := failures(tokenexchange.ReasonWrongSubject)
+			status, _, body := do(t, c, http.MethodGet, "/", nil)
+			if status != tt.want {
+				t.Fatalf("GET / = %d %q, want %d", status, body, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rejected() != 1 {
+				t.Errorf("%s rejections = %v, want 1", tokenexchange.ReasonWrongSubject, rejected())
+			}
+		})
+	}
+}
+
+func TestTransportModes(t *testing.T) {
+	for _, mode := range []string{TransportTLS, TransportMTLS} {
+		t.Run(mode, func(t *testing.T) {
+			ca := spiffetest.NewCA(t, exampleOrg)
+			exchangeURL := startExchange(t, ca,
+				exchangePolicyRule{Client: clientID.String(), Audiences: []string{relayID.String()}},
+				exchangePolicyRule{Client: relayID.String(), Audiences: []string{serverID.String()}},
+			)
+			env := newServerEnv(exchangeURL)
+			env.TransportMode = mode
+			serverURL := startWorkload(t, ca, serverID, env)
+			relayEnv := newRelayEnv(exchangeURL, serverID, serverURL)
+			relayEnv.TransportMode = mode
+			relayURL := startWorkload(t, ca, relayID, relayEnv)
+			clientEnv := newClientEnv(exchangeURL, relayID, relayURL)
+			clientEnv.TransportMode = mode
+
+			status, _, body := do(t, newClient(t, ca, clientID, clientEnv), http.MethodGet, "/", nil)
+			if status != http.StatusOK || body != "...pong" {
+				t.Errorf("GET / = %d %q, want 200 %q", status, body, "...pong")
+			}
+		})
+	}
+}
+
+func TestDPoP(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca,
+		exchangePolicyRule{Client: clientID.String(), Audiences: []string{relayID.String()}},
+		exchangePolicyRule{Client: relayID.String(), Audiences: []string{serverID.String()}},
+	)
+	env := newServerEnv(exchangeURL)
+	env.DPoPRequired = true
+	serverURL := startWorkload(t, ca, serverID, env)
+
+	t.Run("bearer token rejected", func(t *testing.T) {
+		c := newClient(t, ca, clientID, newClientEnv(exchangeURL, relayID, serverURL))
+		rejected := failures(tokenexchange.ReasonInvalidDPoP)
+		if status, _, body := do(t, c, http.MethodGet, "/", nil); status != http.StatusUnauthorized {
+			t.Fatalf("GET / = %d %q, want 401", status, body)
+		}
+		if rejected() != 1 {
+			t.Errorf("%s rejections = %v, want 1", tokenexchange.ReasonInvalidDPoP, rejected())
+		}
+	})
+
+	t.Run("relayed with DPoP", func(t *testing.T) {
+		relayEnv := newRelayEnv(exchangeURL, serverID, serverURL)
+		relayEnv.DPoPEnabled = true
+		relayEnv.DPoPRequired = true
+		relayURL := startWorkload(t, ca, relayID, relayEnv)
+		clientEnv := newClientEnv(exchangeURL, relayID, relayURL)
+		clientEnv.DPoPEnabled = true
+
+		c := newClient(t, ca, clientID, clientEnv)
+		if _, err := c.ping(context.Background(), nil); err != nil {
+			t.Errorf("ping() error = %v", err)
+		}
+	})
+}
+
+// The exchange server refuses tokens for audiences its policy does not allow.
+func TestExchangePolicy(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca, exchangePolicyRule{Client: clientID.String(), Audiences: []string{relayID.String()}})
+	c := newClient(t, ca, clientID, newClientEnv(exchangeURL, serverID, "http://server.invalid"))
+
+	if _, err := c.ping(context.Background(), nil); oauthErrorCode(err) != "invalid_target" {
+		t.Errorf("ping() error = %v, want invalid_target", err)
+	}
+}
+
+func TestExchangeSubjectTokens(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	exchangeURL := startExchange(t, ca,
+		exchangePolicyRule{Client: clientID.String(), Audiences: []string{relayID.String()}},
+		exchangePolicyRule{Client: relayID.String(), Audiences: []string{serverID.String()}},
+	)
+	tokenURL := exchangeURL + exchangeTokenPath
+	client := tokenexchange.NewClient(func() string { return tokenURL }, http.DefaultClient, tokenexchange.WithMaxAttempts(1))
+	ctx := context.Background()
+
+	svid := func(id spiffeid.ID, ttl time.Duration) string {
+		t.Helper()
+		svid, err := ca.CreateJWTSVID(id, []string{tokenURL}, ttl)
+		if err != nil {
+			t.Fatalf("failed to create JWT-SVID: %v", err)
+		}
+		return svid.Marshal()
+	}
+
+	// The client's token is capped to its JWT-SVID, which expires before
+	// the exchange server's token TTL.
+	clientSVID := svid(clientID, 30*time.Second)
+	clientToken, err := client.Exchange(ctx, tokenexchange.Params{
+		ClientAssertionType: tokenexchange.ClientAssertionTypeJWTSVID,
+		ClientAssertion:     clientSVID,
+		SubjectTokenType:    tokenexchange.TokenTypeJWTSVID,
+		SubjectToken:        clientSVID,
+		Audience:            relayID.String(),
+	})
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if clientToken.ExpiresIn > 30*time.Second {
+		t.Errorf("client token ExpiresIn = %v, want at most the JWT-SVID lifetime of 30s", clientToken.ExpiresIn)
+	}
+
+	relaySVID := svid(relayID, 5*time.Minute)
+	delegate := func(actorToken string) (tokenexchange.Result, error) {
+		params := tokenexchange.Params{
+			ClientAssertionType: tokenexchange.ClientAssertionTypeJWTSVID,
+			ClientAssertion:     relaySVID,
+			SubjectTokenType:    tokenexchange.TokenTypeAccessToken,
+			SubjectToken:        clientToken.Token,
+			Audience:            serverID.String(),
+		}
+		if actorToken != "" {
+			params.ActorTokenType = tokenexchange.TokenTypeJWTSVID
+			params.ActorToken = actorToken
+		}
+		return client.Exchange(ctx, params)
+	}
+
+	// Without an actor token the relay would impersonate the client.
+	var oerr *tokenexchange.OAuthError
+	if _, err := delegate(""); !errors.As(err, &oerr) || oerr.Code != "invalid_request" {
+		t.Errorf("Exchange() without actor token error = %v, want invalid_request", err)
+	}
+
+	relayToken, err := delegate(relaySVID)
+	if err != nil {
+		t.Fatalf("Exchange() with actor token error = %v", err)
+	}
+	if relayToken.Expiry.After(clientToken.Expiry.Add(time.Second)) {
+		t.Errorf("delegated token Expiry = %v, want no later than subject token Expiry %v", relayToken.Expiry, clientToken.Expiry)
+	}
+}
+
+// oauthErrorCode returns the OAuth error code of a failed token exchange, or
+// "" if err is not one.
+func oauthErrorCode(err error) string {
+	var exchangeErr *tokenexchange.ExchangeError
+	var oerr *tokenexchange.OAuthError
+	if !errors.As(err, &exchangeErr) || !errors.As(err, &oerr) {
+		return ""
+	}
+	return oerr.Code
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cofide/cofide-demos/pkg/tokenexchange"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// Metrics counters
+var (
+	jwksRefreshSuccess = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jwks_refresh_success",
+		Help: "The total number of successful JWKS refreshes",
+	})
+	jwksRefreshFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jwks_refresh_failures",
+		Help: "The total number of failed JWKS refreshes",
+	})
+	jwksCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwks_cache_lookups_total",
+		Help: "The total number of JWKS lookups, by whether the cached set was used (hit) or fetched (miss)",
+	}, []string{"result"})
+
+	jwtSVIDFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_svid_fetches_total",
+		Help: "The total number of JWT-SVID fetches from the workload API, by result",
+	}, []string{"result"})
+	jwtSVIDNotAfter = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jwt_svid_not_after",
+		Help: "The timestamp when the current JWT-SVID expires",
+	})
+
+	tokenExchangeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "token_exchange_duration_seconds",
+		Help:    "The duration of token exchange requests, including retries as separate requests, by result",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"result"})
+	tokenExchangeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_exchange_errors_total",
+		Help: "The total number of failed token exchange requests, by OAuth error code, HTTP status or network failure",
+	}, []string{"error"})
+
+	tokenValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_validations_total",
+		Help: "The total number of access tokens validated, by result",
+	}, []string{"result"})
+	tokenValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_validation_failures_total",
+		Help: "The total number of requests rejected by token validation or authorization, by reason",
+	}, []string{"reason"})
+
+	relayRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_requests_total",
+		Help: "The total number of requests handled by a relay, by outcome",
+	}, []string{"outcome"})
+	relayDownstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_downstream_responses_total",
+		Help: "The total number of downstream responses relayed, by status code and hop count",
+	}, []string{"code", "hops"})
+)
+
+// Relay outcomes, used as the outcome label of relay_requests_total.
+const (
+	relayForwarded         = "forwarded"
+	relayInvalidHopCount   = "invalid_hop_count"
+	relayHopLimitExceeded  = "hop_limit_exceeded"
+	relayBodyTooLarge      = "body_too_large"
+	relayExchangeFailed    = "exchange_failed"
+	relayDownstreamError   = "downstream_error"
+	relayDownstreamTimeout = "downstream_timeout"
+)
+
+// recordJWKSRefresh counts the outcome of a JWKS refresh.
+func recordJWKSRefresh(err error) {
+	if err != nil {
+		jwksRefreshFailures.Inc()
+	} else {
+		jwksRefreshSuccess.Inc()
+	}
+}
+
+// recordJWKSLookup counts whether a JWKS lookup was served from the cache.
+func recordJWKSLookup(hit bool) {
+	if hit {
+		jwksCacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		jwksCacheLookups.WithLabelValues("miss").Inc()
+	}
+}
+
+// recordJWTSVIDFetch counts a JWT-SVID fetch and records the SVID's expiry.
+func recordJWTSVIDFetch(svid *jwtsvid.SVID, err error) {
+	if err != nil {
+		jwtSVIDFetches.WithLabelValues("error").Inc()
+		return
+	}
+	jwtSVIDFetches.WithLabelValues("success").Inc()
+	jwtSVIDNotAfter.Set(float64(svid.Expiry.Unix()))
+}
+
+// recordExchangeAttempt records the duration of a token exchange request and
+// classifies its error, if any.
+func recordExchangeAttempt(duration time.Duration, err error) {
+	if err == nil {
+		tokenExchangeDuration.WithLabelValues("success").Observe(duration.Seconds())
+		return
+	}
+	tokenExchangeDuration.WithLabelValues("error").Observe(duration.Seconds())
+	tokenExchangeErrors.WithLabelValues(exchangeErrorLabel(err)).Inc()
+}
+
+// exchangeErrorLabel returns the OAuth error code of a failed exchange, or
+// the HTTP status if the response had none, or timeout or network_error.
+func exchangeErrorLabel(err error) string {
+	var oerr *tokenexchange.OAuthError
+	if errors.As(err, &oerr) {
+		if oerr.Code != "" {
+			return oerr.Code
+		}
+		return "http_" + strconv.Itoa(oerr.StatusCode)
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "network_error"
+}
+
+// recordAuthentication counts the outcome of authenticating a request.
+func recordAuthentication(_ *http.Request, err *tokenexchange.Error) {
+	if err == nil {
+		tokenValidations.WithLabelValues("success").Inc()
+		return
+	}
+	tokenValidations.WithLabelValues("failure").Inc()
+	tokenValidationFailures.WithLabelValues(err.Reason).Inc()
+}
+
+// runMetricsServer serves Prometheus metrics on env.MetricsPort until ctx is
+// cancelled.
+func runMetricsServer(ctx context.Context, env *Env) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              env.MetricsPort,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	slog.Info("Metrics enabled, starting server", "port", env.MetricsPort)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error starting metrics server", "error", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cofide/cofide-demos/pkg/tokenexchange"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// hopCountHeader records the number of relays a request has traversed.
+	hopCountHeader = "X-Ping-Pong-Hops"
+	// relayMaxBodyBytes limits the size of request bodies forwarded by a relay.
+	relayMaxBodyBytes = 10 << 20
+)
+
+// relayResponseHeaders are the downstream response headers copied back to the caller.
+var relayResponseHeaders = []string{"Content-Type", "WWW-Authenticate", hopCountHeader}
+
+// handleRelay forwards the request to the downstream server, which may itself
+// be a relay, with an access token obtained by delegated token exchange of the
+// caller's token. The downstream response status, headers and body are
+// returned to the caller unchanged.
+func (s *pingPongServer) handleRelay(w http.ResponseWriter, r *http.Request, caller *tokenexchange.Principal) {
+	hops, err := hopCount(r)
+	if err != nil {
+		slog.Warn("Invalid hop count header", "error", err)
+		relayRequests.WithLabelValues(relayInvalidHopCount).Inc()
+		http.Error(w, "Invalid hop count", http.StatusBadRequest)
+		return
+	}
+	if hops+1 > s.env.RelayMaxHops {
+		slog.Warn("Rejected request exceeding hop limit", "hops", hops, "max_hops", s.env.RelayMaxHops)
+		relayRequests.WithLabelValues(relayHopLimitExceeded).Inc()
+		http.Error(w, "Hop limit exceeded", http.StatusLoopDetected)
+		return
+	}
+	if r.ContentLength > relayMaxBodyBytes {
+		slog.Warn("Rejected request body exceeding size limit", "content_length", r.ContentLength, "max_bytes", relayMaxBodyBytes)
+		relayRequests.WithLabelValues(relayBodyTooLarge).Inc()
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	slog.Info("Forwarding request with delegated access token", "audience", s.env.ServerSPIFFEID, "url", s.client.env.ServerURL, "hops", hops+1)
+	ctx, span := tracer.Start(r.Context(), "forward", trace.WithAttributes(
+		tokenexchange.AttrAudience.String(s.env.ServerSPIFFEID),
+		attribute.Int("relay.hops", hops+1),
+	))
+	defer span.End()
+	resp, err := s.client.forward(tokenexchange.WithSubjectToken(ctx, caller.Token), r, hops+1)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	var exchangeErr *tokenexchange.ExchangeError
+	if errors.As(err, &exchangeErr) {
+		slog.Error("Failed to obtain delegated access token", "error", exchangeErr.Err)
+		relayRequests.WithLabelValues(relayExchangeFailed).Inc()
+		status, message := exchangeErrorStatus(exchangeErr.Err)
+		if status == http.StatusServiceUnavailable {
+			var oerr *tokenexchange.OAuthError
+			if errors.As(err, &oerr) && oerr.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int((oerr.RetryAfter+time.Second-1)/time.Second)))
+			}
+		}
+		http.Error(w, message, status)
+		return
+	}
+	// A body without a declared length is only found to be too large while
+	// it is being forwarded.
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		slog.Warn("Rejected request body exceeding size limit", "max_bytes", maxBytesErr.Limit)
+		relayRequests.WithLabelValues(relayBodyTooLarge).Inc()
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to reach downstream server", "error", err)
+		status, outcome := http.StatusBadGateway, relayDownstreamError
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			status, outcome = http.StatusGatewayTimeout, relayDownstreamTimeout
+		}
+		relayRequests.WithLabelValues(outcome).Inc()
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("Problem reaching downstream server"))
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	slog.Info("Received response from downstream server, relaying to client", "status", resp.StatusCode)
+	relayRequests.WithLabelValues(relayForwarded).Inc()
+	relayDownstreamResponses.WithLabelValues(strconv.Itoa(resp.StatusCode), strconv.Itoa(hops+1)).Inc()
+
+	for _, header := range relayResponseHeaders {
+		if v := resp.Header.Values(header); len(v) > 0 {
+			w.Header()[http.CanonicalHeaderKey(header)] = v
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
+
+// exchangeErrorStatus maps a failed delegated token exchange to the status and
+// message returned to the caller. Rejections of the caller's token are reported
+// as 401, policy refusals as 403 and exchange service failures as 502, 503 or
+// 504.
+func exchangeErrorStatus(err error) (int, string) {
+	var oerr *tokenexchange.OAuthError
+	if errors.As(err, &oerr) {
+		switch {
+		case oerr.Code == "invalid_grant":
+			return http.StatusUnauthorized, "Token rejected by exchange service"
+		case oerr.Code == "invalid_target", oerr.Code == "invalid_scope", oerr.Code == "unauthorized_client", oerr.Code == "access_denied":
+			return http.StatusForbidden, "Delegation not permitted by exchange service"
+		case oerr.StatusCode == http.StatusTooManyRequests, oerr.StatusCode == http.StatusServiceUnavailable:
+			return http.StatusServiceUnavailable, "Exchange service unavailable"
+		default:
+			return http.StatusBadGateway, "Unable to obtain access token"
+		}
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout, "Timed out obtaining access token"
+	}
+	return http.StatusBadGateway, "Unable to obtain access token"
+}
+
+// forward sends r to the downstream server, preserving the method, path, query,
+// body and configured headers. The client's transport attaches an access token
+// obtained by delegated exchange of the subject token in ctx. The caller must
+// close the response body.
+func (c *pingPongClient) forward(ctx context.Context, r *http.Request, hops int) (*http.Response, error) {
+	body := http.MaxBytesReader(nil, r.Body, relayMaxBodyBytes)
+	req, err := http.NewRequestWithContext(ctx, r.Method, c.env.ServerURL+r.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = r.ContentLength
+
+	for _, header := range strings.Split(c.env.RelayForwardHeaders, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" || strings.EqualFold(header, "Authorization") || strings.EqualFold(header, tokenexchange.DPoPHeader) {
+			continue
+		}
+		if v := r.Header.Values(header); len(v) > 0 {
+			req.Header[http.CanonicalHeaderKey(header)] = v
+		}
+	}
+	req.Header.Set(hopCountHeader, strconv.Itoa(hops))
+
+	return c.client.Do(req)
+}
+
+// hopCount returns the number of relays the request has already traversed.
+func hopCount(r *http.Request) (int, error) {
+	v := r.Header.Get(hopCountHeader)
+	if v == "" {
+		return 0, nil
+	}
+	hops, err := strconv.Atoi(v)
+	if err != nil || hops < 0 {
+		return 0, fmt.Errorf("invalid %s header %q", hopCountHeader, v)
+	}
+	return hops, nil
+}
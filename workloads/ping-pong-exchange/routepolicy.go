@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/cofide/cofide-demos/pkg/tokenexchange"
+)
+
+// routeRule requires the scopes and claims of access tokens presented for
+// requests matching a method and path.
+type routeRule struct {
+	// Method is the HTTP method the rule applies to, which is case-sensitive.
+	// Empty matches any method.
+	Method string `json:"method,omitempty"`
+	// Path is the URL path the rule applies to, along with the paths below
+	// it. Empty matches any path.
+	Path string `json:"path,omitempty"`
+	// Scopes must all be present in the token's scope claim.
+	Scopes []string `json:"scopes,omitempty"`
+	// Claims maps claim names to required values. A list of values requires
+	// the claim to equal any of them; an array claim must contain the value.
+	Claims map[string]any `json:"claims,omitempty"`
+}
+
+// routePolicy is an ordered list of rules. The first rule matching a request
+// applies. An empty policy places no requirements on requests; otherwise
+// requests matching no rule are denied, so a policy ends with a catch-all rule,
+// {}, to allow the routes it does not restrict.
+type routePolicy []routeRule
+
+// parseRoutePolicy parses a JSON-encoded route policy.
+func parseRoutePolicy(data string) (routePolicy, error) {
+	var policy routePolicy
+	if err := json.Unmarshal([]byte(data), &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse route policy: %w", err)
+	}
+	for _, rule := range policy {
+		if rule.Method != strings.ToUpper(rule.Method) {
+			return nil, fmt.Errorf("invalid method %q in route policy: methods are case-sensitive", rule.Method)
+		}
+		if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("invalid path %q in route policy", rule.Path)
+		}
+	}
+	return policy, nil
+}
+
+// matchPath reports whether path is rulePath or lies below it, so that a rule
+// for /admin matches /admin/users but not /administrator.
+func matchPath(rulePath, path string) bool {
+	return path == rulePath || strings.HasPrefix(path, strings.TrimSuffix(rulePath, "/")+"/")
+}
+
+// authorize checks the token's scopes and claims against the first rule
+// matching r, returning an insufficient_scope error if they are not satisfied
+// or no rule matches.
+func (p routePolicy) authorize(r *http.Request, scopes []string, claims map[string]any) *tokenexchange.Error {
+	if len(p) == 0 {
+		return nil
+	}
+	i := slices.IndexFunc(p, func(rule routeRule) bool {
+		return (rule.Method == "" || rule.Method == r.Method) && matchPath(rule.Path, r.URL.Path)
+	})
+	if i < 0 {
+		return &tokenexchange.Error{
+			Reason:      tokenexchange.ReasonInsufficientScope,
+			Status:      http.StatusForbidden,
+			Code:        "insufficient_scope",
+			Description: fmt.Sprintf("No route policy rule allows %s %s", r.Method, r.URL.Path),
+		}
+	}
+	rule := p[i]
+
+	for _, scope := range rule.Scopes {
+		if !slices.Contains(scopes, scope) {
+			return &tokenexchange.Error{
+				Reason:      tokenexchange.ReasonInsufficientScope,
+				Status:      http.StatusForbidden,
+				Code:        "insufficient_scope",
+				Description: fmt.Sprintf("Token lacks required scope %q", scope),
+				Scope:       strings.Join(rule.Scopes, " "),
+			}
+		}
+	}
+	for name, expected := range rule.Claims {
+		if !claimMatches(claims[name], expected) {
+			return &tokenexchange.Error{
+				Reason:      tokenexchange.ReasonInsufficientScope,
+				Status:      http.StatusForbidden,
+				Code:        "insufficient_scope",
+				Description: fmt.Sprintf("Token claim %q does not have a required value", name),
+			}
+		}
+	}
+	return nil
+}
+
+// claimMatches reports whether a token claim satisfies an expected value
+// from a route rule. Both are decoded JSON values.
+func claimMatches(actual, expected any) bool {
+	if values, ok := expected.([]any); ok {
+		return slices.ContainsFunc(values, func(v any) bool { return claimMatches(actual, v) })
+	}
+	if values, ok := actual.([]any); ok {
+		return slices.ContainsFunc(values, func(v any) bool { return reflect.DeepEqual(v, expected) })
+	}
+	return actual != nil && reflect.DeepEqual(actual, expected)
+}
+
+// parseScopes splits a comma- or space-separated list of scopes.
+func parseScopes(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// isSubset reports whether every element of a is in b.
+func isSubset(a, b []string) bool {
+	return !slices.ContainsFunc(a, func(v string) bool { return !slices.Contains(b, v) })
+}
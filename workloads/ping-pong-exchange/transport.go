@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+const (
+	TransportPlaintext = "plaintext"
+	TransportTLS       = "tls"
+	TransportMTLS      = "mtls"
+)
+
+func getTransportMode() string {
+	mode := getEnvWithDefault("TRANSPORT_MODE", TransportPlaintext)
+	switch mode {
+	case TransportPlaintext, TransportTLS, TransportMTLS:
+		return mode
+	default:
+		slog.Error("Invalid TRANSPORT_MODE", "value", mode, "valid", []string{TransportPlaintext, TransportTLS, TransportMTLS})
+		os.Exit(1)
+		return ""
+	}
+}
+
+// urlScheme returns the URL scheme of the downstream server for the transport
+// mode.
+func urlScheme(mode string) string {
+	if mode == TransportPlaintext {
+		return "http"
+	}
+	return "https"
+}
+
+// serverTLSConfig returns the TLS configuration of the ping-pong server, or
+// nil in plaintext mode. In mtls mode any client with an X.509-SVID from a
+// trusted trust domain may connect; the client is authorized by its token,
+// which the authenticator checks identifies the TLS peer.
+func serverTLSConfig(mode string, source *workloadapi.X509Source) *tls.Config {
+	switch mode {
+	case TransportTLS:
+		return tlsconfig.TLSServerConfig(source)
+	case TransportMTLS:
+		return tlsconfig.MTLSServerConfig(source, source, tlsconfig.AuthorizeAny())
+	default:
+		return nil
+	}
+}
+
+// clientTLSConfig returns the TLS configuration used to connect to the
+// downstream server with SPIFFE ID serverID, or nil in plaintext mode. In mtls
+// mode the client presents its own X.509-SVID.
+func clientTLSConfig(mode string, source *workloadapi.X509Source, serverID spiffeid.ID) *tls.Config {
+	switch mode {
+	case TransportTLS:
+		return tlsconfig.TLSClientConfig(source, tlsconfig.AuthorizeID(serverID))
+	case TransportMTLS:
+		return tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(serverID))
+	default:
+		return nil
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,15 +10,23 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/loadgen"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 func main() {
-	if err := run(context.Background(), getEnv()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, getEnv()); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -26,6 +35,10 @@ type Env struct {
 	ServerURL        string
 	SpiffeSocketPath string
 	ServerSPIFFEID   string
+	MetricsEnabled   bool
+	MetricsPort      string
+	Load             loadgen.Config
+	Health           health.Config
 }
 
 func mustGetEnv(variable string) string {
@@ -45,17 +58,47 @@ func getEnvWithDefault(variable string, defaultValue string) string {
 	return v
 }
 
+func getEnvBooleanWithDefault(variable string, defaultValue bool) bool {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Error("Invalid boolean value", "variable", variable, "error", err)
+		return defaultValue
+	}
+	return b
+}
+
 func getEnv() *Env {
+	load, err := loadgen.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid load generation configuration", "error", err)
+		os.Exit(1)
+	}
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid health configuration", "error", err)
+		os.Exit(1)
+	}
 	host := getEnvWithDefault("PING_PONG_SERVICE_HOST", "ping-pong-server.demo")
 	port := getEnvWithDefault("PING_PONG_SERVICE_PORT", "8443")
 	return &Env{
 		ServerURL:        fmt.Sprintf("http://%s:%s", host, port),
 		SpiffeSocketPath: getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", "unix:///spiffe-workload-api/spire-agent.sock"),
 		ServerSPIFFEID:   mustGetEnv("SERVER_SPIFFE_ID"),
+		MetricsEnabled:   getEnvBooleanWithDefault("METRICS_ENABLED", true),
+		MetricsPort:      getEnvWithDefault("METRICS_PORT", ":8080"),
+		Load:             load,
+		Health:           healthConfig,
 	}
 }
 
 func run(ctx context.Context, env *Env) error {
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
+
 	initCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -73,74 +116,176 @@ func run(ctx context.Context, env *Env) error {
 		return fmt.Errorf("failed to create workload client: %w", err)
 	}
 	defer func() { _ = wlClient.Close() }()
-	c := pingPongClient{wlClient: wlClient}
+	c := pingPongClient{wlClient: wlClient, source: source}
+	checker.AddReadinessCheck("jwt-svid", health.JWTSVIDCheck(c.svid))
 
-	client := &http.Client{}
-	var svid *jwtsvid.SVID
-	for {
-		if svid == nil || time.Until(svid.Expiry) < time.Minute {
-			slog.Info("Fetching JWT-SVID")
-			svid, err = source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "ping-pong-server"})
+	if env.MetricsEnabled {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		server := &http.Server{
+			Addr:              env.MetricsPort,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("Metrics enabled, starting server", "port", env.MetricsPort)
+			if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
+				slog.Error("Error serving metrics", "error", err)
+			}
+		}()
+	}
+
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	checker.MarkStarted()
+
+	if env.Load.Enabled {
+		// Fetch the JWT-SVID up front so that a failure is reported once
+		// rather than for every request.
+		if _, err := c.token(ctx); err != nil {
+			return err
+		}
+		env.Load.ConfigureTransport(transport)
+		loadgen.Run(ctx, env.Load, func(ctx context.Context, payload []byte) error {
+			token, err := c.token(ctx)
 			if err != nil {
-				return fmt.Errorf("failed to obtain JWT-SVID: %w", err)
+				return err
 			}
-			slog.Info("Fetched JWT-SVID")
+			_, _, err = c.ping(ctx, client, env, token, payload)
+			return err
+		}).Log()
+		return nil
+	}
+
+	for {
+		token, err := c.token(ctx)
+		if ctx.Err() != nil {
+			slog.Info("Client stopped")
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 
 		slog.Info("ping...")
-		if err := c.ping(client, env, svid.Marshal()); err != nil {
+		body, serverID, err := c.ping(ctx, client, env, token, nil)
+		switch {
+		case ctx.Err() != nil:
+			// The request was abandoned because the client is shutting down.
+		case err != nil:
 			slog.Error("problem reaching server", "error", err)
+		default:
+			slog.Info(string(body), "from", serverID)
+		}
+		if !graceful.Sleep(ctx, 5*time.Second) {
+			slog.Info("Client stopped")
+			return nil
 		}
-		time.Sleep(5 * time.Second)
 	}
 }
 
 type pingPongClient struct {
 	wlClient *workloadapi.Client
+	source   *workloadapi.JWTSource
+
+	mu     sync.Mutex
+	cached *jwtsvid.SVID
 }
 
-func (c *pingPongClient) ping(client *http.Client, env *Env, clientToken string) error {
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, env.ServerURL, nil)
+// svid returns the client's JWT-SVID for the server, fetching a new one when
+// the current one is within a minute of expiry.
+func (c *pingPongClient) svid(ctx context.Context) (*jwtsvid.SVID, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached == nil || time.Until(c.cached.Expiry) < time.Minute {
+		slog.Info("Fetching JWT-SVID")
+		svid, err := c.source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "ping-pong-server"})
+		recordJWTSVIDFetch(svid, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain JWT-SVID: %w", err)
+		}
+		slog.Info("Fetched JWT-SVID")
+		c.cached = svid
+	}
+	return c.cached, nil
+}
+
+// token returns the client's JWT-SVID for the server in its serialized form.
+func (c *pingPongClient) token(ctx context.Context) (string, error) {
+	svid, err := c.svid(ctx)
 	if err != nil {
-		return err
+		return "", err
+	}
+	return svid.Marshal(), nil
+}
+
+// ping sends a request to the server and returns the response body and the
+// server's verified SPIFFE ID, recording the outcome in metrics. The request is
+// a POST carrying payload if it is non-nil, and a GET otherwise.
+func (c *pingPongClient) ping(ctx context.Context, client *http.Client, env *Env, clientToken string, payload []byte) ([]byte, spiffeid.ID, error) {
+	start := time.Now()
+	body, serverID, status, err := c.sendPing(ctx, client, env, clientToken, payload)
+
+	result := pingResult(err)
+	code := ""
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	pingDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	pingResults.WithLabelValues(result, code).Inc()
+	return body, serverID, err
+}
+
+// sendPing sends a request to the server and returns the response body, the
+// server's verified SPIFFE ID and the status code. The status code is zero if
+// no response was received.
+func (c *pingPongClient) sendPing(ctx context.Context, client *http.Client, env *Env, clientToken string, payload []byte) ([]byte, spiffeid.ID, int, error) {
+	method := http.MethodGet
+	var reqBody io.Reader
+	if payload != nil {
+		method = http.MethodPost
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, env.ServerURL, reqBody)
+	if err != nil {
+		return nil, spiffeid.ID{}, 0, err
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", clientToken))
 
 	r, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, spiffeid.ID{}, 0, err
 	}
 	defer func() {
 		_ = r.Body.Close()
 	}()
 
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, spiffeid.ID{}, r.StatusCode, err
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, spiffeid.ID{}, r.StatusCode, &statusError{code: r.StatusCode, body: body}
+	}
+
 	auth := r.Header.Get("Authorization")
 	if len(auth) < 7 || auth[:7] != "Bearer " {
-		return errors.New("no token provided by server")
+		return nil, spiffeid.ID{}, r.StatusCode, &serverAuthError{result: resultInvalidServerToken, err: errors.New("no token provided by server")}
 	}
 
 	// Parse server SVID from bearer token header
 	serverToken := auth[7:]
 	audience := "ping-pong-client"
-	serverSVID, err := c.wlClient.ValidateJWTSVID(context.Background(), serverToken, audience)
+	serverSVID, err := c.wlClient.ValidateJWTSVID(ctx, serverToken, audience)
 	if err != nil {
-		return fmt.Errorf("invalid server token: %w", err)
+		return nil, spiffeid.ID{}, r.StatusCode, &serverAuthError{result: resultInvalidServerToken, err: fmt.Errorf("invalid server token: %w", err)}
 	}
 
 	// Verify server SVID is authorised
 	expectedServerID := env.ServerSPIFFEID
 	matcher := spiffeid.MatchID(spiffeid.RequireFromString(expectedServerID))
 	if err := matcher(serverSVID.ID); err != nil {
-		return fmt.Errorf("invalid server ID: %w", err)
-	}
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return err
-	}
-	if r.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d: %s", r.StatusCode, body)
+		return nil, spiffeid.ID{}, r.StatusCode, &serverAuthError{result: resultUnauthorizedServerID, err: fmt.Errorf("invalid server ID: %w", err)}
 	}
-	slog.Info(string(body), "from", serverSVID.ID)
-	return nil
+	return body, serverSVID.ID, r.StatusCode, nil
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	serverID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-server")
+	clientID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-client")
+)
+
+// startServer serves pings that authenticate the client with a JWT-SVID issued
+// by ca, responding with serverToken, and sends each client's SPIFFE ID on the
+// returned channel.
+func startServer(t *testing.T, ca *spiffetest.CA, serverToken string) (string, <-chan spiffeid.ID) {
+	t.Helper()
+	pings := make(chan spiffeid.ID, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		svid, err := jwtsvid.ParseAndValidate(token, ca.JWTBundle(), []string{"ping-pong-server"})
+		if err != nil {
+			http.Error(w, "Invalid client token provided", http.StatusUnauthorized)
+			return
+		}
+		select {
+		case pings <- svid.ID:
+		default:
+		}
+		w.Header().Set("Authorization", "Bearer "+serverToken)
+		_, _ = w.Write([]byte("...pong"))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, pings
+}
+
+// startClient runs the client, issued SVIDs for clientID by ca, against
+// serverURL until the test completes.
+func startClient(t *testing.T, ca *spiffetest.CA, serverURL string) {
+	t.Helper()
+	env := &Env{
+		ServerURL:        serverURL,
+		SpiffeSocketPath: spiffetest.New(t, ca, spiffetest.WithIDs(clientID)).Addr(),
+		ServerSPIFFEID:   serverID.String(),
+		Health:           health.Config{Port: "127.0.0.1:0"},
+	}
+	spiffetest.StartWorkload(t, func(ctx context.Context) error { return run(ctx, env) })
+}
+
+// newToken returns a JWT-SVID for id issued by ca.
+func newToken(t *testing.T, ca *spiffetest.CA, id spiffeid.ID, audience string) string {
+	t.Helper()
+	svid, err := ca.CreateJWTSVID(id, []string{audience}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateJWTSVID() error = %v", err)
+	}
+	return svid.Marshal()
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	url, pings := startServer(t, ca, newToken(t, ca, serverID, "ping-pong-client"))
+	before := testutil.ToFloat64(pingResults.WithLabelValues(resultSuccess, "200"))
+
+	startClient(t, ca, url)
+
+	select {
+	case id := <-pings:
+		if id != clientID {
+			t.Errorf("server saw client %s, want %s", id, clientID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server was not pinged")
+	}
+	waitFor(t, "a successful ping", func() bool {
+		return testutil.ToFloat64(pingResults.WithLabelValues(resultSuccess, "200")) > before
+	})
+}
+
+func TestVerifiesServerToken(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	untrusted := spiffetest.NewCA(t, exampleOrg)
+	impostor := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/impostor")
+
+	tests := []struct {
+		name        string
+		serverToken string
+		result      string
+	}{
+		{"wrong server", newToken(t, ca, impostor, "ping-pong-client"), resultUnauthorizedServerID},
+		{"wrong audience", newToken(t, ca, serverID, "other-client"), resultInvalidServerToken},
+		{"untrusted signer", newToken(t, untrusted, serverID, "ping-pong-client"), resultInvalidServerToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, _ := startServer(t, ca, tt.serverToken)
+			before := testutil.ToFloat64(pingResults.WithLabelValues(tt.result, "200"))
+
+			startClient(t, ca, url)
+
+			waitFor(t, "the server to be rejected", func() bool {
+				return testutil.ToFloat64(pingResults.WithLabelValues(tt.result, "200")) > before
+			})
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+var (
+	pingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ping_duration_seconds",
+		Help:    "The duration of pings, by result",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"result"})
+	pingResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ping_results_total",
+		Help: "The total number of pings, by result and response status code",
+	}, []string{"result", "code"})
+
+	jwtSVIDFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_svid_fetches_total",
+		Help: "The total number of JWT-SVID fetches from the workload API, by result",
+	}, []string{"result"})
+	jwtSVIDNotAfter = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jwt_svid_not_after",
+		Help: "The timestamp when the current JWT-SVID expires",
+	})
+)
+
+// Ping results, used as the result label of ping metrics.
+const (
+	resultSuccess              = "success"
+	resultNon200               = "non_200"
+	resultTimeout              = "timeout"
+	resultInvalidServerToken   = "invalid_server_token"
+	resultUnauthorizedServerID = "unauthorized_server_id"
+	resultConnectionError      = "connection_error"
+)
+
+// statusError reports a response with a status code other than 200.
+type statusError struct {
+	code int
+	body []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d: %s", e.code, e.body)
+}
+
+// serverAuthError reports a response whose JWT-SVID failed verification.
+type serverAuthError struct {
+	result string
+	err    error
+}
+
+func (e *serverAuthError) Error() string {
+	return e.err.Error()
+}
+
+func (e *serverAuthError) Unwrap() error {
+	return e.err
+}
+
+// pingResult classifies the outcome of a ping for metrics.
+func pingResult(err error) string {
+	if err == nil {
+		return resultSuccess
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return resultNon200
+	}
+	var authErr *serverAuthError
+	if errors.As(err, &authErr) {
+		return authErr.result
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return resultTimeout
+	}
+	return resultConnectionError
+}
+
+// recordJWTSVIDFetch counts a JWT-SVID fetch and records the SVID's expiry.
+func recordJWTSVIDFetch(svid *jwtsvid.SVID, err error) {
+	if err != nil {
+		jwtSVIDFetches.WithLabelValues("error").Inc()
+		return
+	}
+	jwtSVIDFetches.WithLabelValues("success").Inc()
+	jwtSVIDNotAfter.Set(float64(svid.Expiry.Unix()))
+}
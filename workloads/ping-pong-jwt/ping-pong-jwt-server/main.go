@@ -7,15 +7,21 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/whoami"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
 func main() {
-	if err := run(context.Background(), getEnv()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, getEnv()); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -24,6 +30,9 @@ type Env struct {
 	Address          string
 	SpiffeSocketPath string
 	ClientSPIFFEID   string
+	MetricsEnabled   bool
+	MetricsPort      string
+	Health           health.Config
 }
 
 func mustGetEnv(variable string) string {
@@ -43,11 +52,32 @@ func getEnvWithDefault(variable string, defaultValue string) string {
 	return v
 }
 
+func getEnvBooleanWithDefault(variable string, defaultValue bool) bool {
+	v, ok := os.LookupEnv(variable)
+	if !ok {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Error("Invalid boolean value", "variable", variable, "error", err)
+		return defaultValue
+	}
+	return b
+}
+
 func getEnv() *Env {
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid health configuration", "error", err)
+		os.Exit(1)
+	}
 	return &Env{
 		Address:          getEnvWithDefault("PING_PONG_SERVER_LISTEN_ADDRESS", ":8443"),
 		SpiffeSocketPath: getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", "unix:///spiffe-workload-api/spire-agent.sock"),
 		ClientSPIFFEID:   mustGetEnv("CLIENT_SPIFFE_ID"),
+		MetricsEnabled:   getEnvBooleanWithDefault("METRICS_ENABLED", true),
+		MetricsPort:      getEnvWithDefault("METRICS_PORT", ":8080"),
+		Health:           healthConfig,
 	}
 }
 
@@ -57,6 +87,9 @@ type pingPongServer struct {
 }
 
 func run(ctx context.Context, env *Env) error {
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
+
 	slog.Info("Creating workload client")
 	client, err := workloadapi.New(ctx, workloadapi.WithAddr(env.SpiffeSocketPath))
 	if err != nil {
@@ -68,8 +101,15 @@ func run(ctx context.Context, env *Env) error {
 		wlClient:         client,
 		authorizedClient: spiffeid.RequireFromString(env.ClientSPIFFEID),
 	}
+	// The agent caches JWT-SVIDs, so fetching one per probe is cheap.
+	checker.AddReadinessCheck("jwt-svid", health.JWTSVIDCheck(pps.fetchJWTSVID))
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", pps.handler)
+	mux.Handle("/", metricsWrapper(pps.authenticate(http.HandlerFunc(pps.handler))))
+	mux.Handle(whoami.Path, metricsWrapper(pps.authenticate(http.HandlerFunc(pps.identityHandler))))
+
+	if env.MetricsEnabled {
+		runMetrics(ctx, env)
+	}
 
 	server := &http.Server{
 		Addr:              env.Address,
@@ -78,43 +118,74 @@ func run(ctx context.Context, env *Env) error {
 	}
 
 	slog.Info("Server starting")
-	if err := server.ListenAndServe(); err != nil {
+	checker.MarkStarted()
+	if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
 		return fmt.Errorf("failed to serve: %w", err)
 	}
 
 	return nil
 }
 
-func (s *pingPongServer) handler(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	if len(auth) < 7 || auth[:7] != "Bearer " {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("No token provided by client"))
-		return
-	}
-
-	token := auth[7:]
-	audience := "ping-pong-server"
-	clientSVID, err := s.wlClient.ValidateJWTSVID(r.Context(), token, audience)
-	if err != nil {
-		slog.Error("Invalid client token", "error", err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("Invalid client token provided"))
-		return
-	}
+// authenticate validates the client's JWT-SVID and stores its identity in the
+// request context.
+func (s *pingPongServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || auth[:7] != "Bearer " {
+			tokenValidationFailures.WithLabelValues(reasonMissingToken).Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("No token provided by client"))
+			return
+		}
+
+		token := auth[7:]
+		audience := "ping-pong-server"
+		clientSVID, err := s.wlClient.ValidateJWTSVID(r.Context(), token, audience)
+		if err != nil {
+			slog.Error("Invalid client token", "error", err.Error())
+			tokenValidationFailures.WithLabelValues(validationFailureReason(err)).Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("Invalid client token provided"))
+			return
+		}
+
+		clientId := clientSVID.ID
+		slog.Info("Received request from client", "id", clientId, "path", r.URL.Path)
+		matcher := spiffeid.MatchID(s.authorizedClient)
+		if err := matcher(clientId); err != nil {
+			slog.Info("Rejected unauthorized request", "id", clientId)
+			tokenValidationFailures.WithLabelValues(reasonWrongSubject).Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("Invalid client ID"))
+			return
+		}
+
+		id := &whoami.Identity{
+			PeerID:    clientId.String(),
+			Mechanism: whoami.MechanismJWTSVID,
+			Token: &whoami.Token{
+				Subject:  clientId.String(),
+				Audience: clientSVID.Audience,
+				Expiry:   clientSVID.Expiry,
+			},
+		}
+		if iss, ok := clientSVID.Claims["iss"].(string); ok {
+			id.Token.Issuer = iss
+		}
+		next.ServeHTTP(w, r.WithContext(whoami.NewContext(r.Context(), id)))
+	})
+}
 
-	clientId := clientSVID.ID
-	slog.Info("Received ping from client", "id", clientId)
-	matcher := spiffeid.MatchID(s.authorizedClient)
-	if err := matcher(clientId); err != nil {
-		slog.Info("Rejected unauthorized request", "id", clientId)
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("Invalid client ID"))
-		return
-	}
+// fetchJWTSVID fetches the server's JWT-SVID for the client.
+func (s *pingPongServer) fetchJWTSVID(ctx context.Context) (*jwtsvid.SVID, error) {
+	svid, err := s.wlClient.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "ping-pong-client"})
+	recordJWTSVIDFetch(svid, err)
+	return svid, err
+}
 
+func (s *pingPongServer) handler(w http.ResponseWriter, r *http.Request) {
 	// Send server SVID to client for mutual verification
-	svid, err := s.wlClient.FetchJWTSVID(r.Context(), jwtsvid.Params{Audience: "ping-pong-client"})
+	svid, err := s.fetchJWTSVID(r.Context())
 	if err != nil {
 		slog.Error("Failed to fetch server JWT-SVID", "error", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -123,7 +194,6 @@ func (s *pingPongServer) handler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Authorization", fmt.Sprintf("Bearer %s", svid.Marshal()))
 
-
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte("...pong"))
@@ -132,3 +202,18 @@ func (s *pingPongServer) handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// identityHandler serves the client's identity, adding the server's own SPIFFE
+// ID from its JWT-SVID.
+func (s *pingPongServer) identityHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := whoami.FromContext(r.Context())
+	svid, err := s.fetchJWTSVID(r.Context())
+	if err != nil {
+		slog.Error("Failed to fetch server JWT-SVID", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("Internal server error"))
+		return
+	}
+	id.ServerID = svid.ID.String()
+	whoami.Handler(w, r)
+}
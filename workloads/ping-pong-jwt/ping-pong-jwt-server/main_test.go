@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/whoami"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	serverID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-server")
+	clientID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-client")
+)
+
+// startServer runs the server, issued SVIDs for serverID by ca and authorizing
+// clientID, until the test completes, and returns its URL.
+func startServer(t *testing.T, ca *spiffetest.CA) string {
+	t.Helper()
+	env := &Env{
+		Address:          spiffetest.FreeAddr(t),
+		SpiffeSocketPath: spiffetest.New(t, ca, spiffetest.WithIDs(serverID)).Addr(),
+		ClientSPIFFEID:   clientID.String(),
+		Health:           health.Config{Port: "127.0.0.1:0"},
+	}
+	done := spiffetest.StartWorkload(t, func(ctx context.Context) error { return run(ctx, env) })
+	spiffetest.WaitReady(t, env.Address, done)
+	return "http://" + env.Address
+}
+
+// newToken returns a JWT-SVID for id issued by ca.
+func newToken(t *testing.T, ca *spiffetest.CA, id spiffeid.ID, audience string) string {
+	t.Helper()
+	svid, err := ca.CreateJWTSVID(id, []string{audience}, time.Minute)
+	if err != nil {
+		t.Fatalf("CreateJWTSVID() error = %v", err)
+	}
+	return svid.Marshal()
+}
+
+func get(t *testing.T, url, token string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestPing(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	url := startServer(t, ca)
+
+	resp, body := get(t, url+"/", newToken(t, ca, clientID, "ping-pong-server"))
+	if resp.StatusCode != http.StatusOK || body != "...pong" {
+		t.Fatalf("GET / = %d %q, want 200 %q", resp.StatusCode, body, "...pong")
+	}
+
+	// The server proves its identity with a JWT-SVID for the client.
+	serverToken, ok := strings.CutPrefix(resp.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		t.Fatalf("response has no server token: %q", resp.Header.Get("Authorization"))
+	}
+	svid, err := jwtsvid.ParseAndValidate(serverToken, ca.JWTBundle(), []string{"ping-pong-client"})
+	if err != nil {
+		t.Fatalf("invalid server token: %v", err)
+	}
+	if svid.ID != serverID {
+		t.Errorf("server token ID = %s, want %s", svid.ID, serverID)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	url := startServer(t, ca)
+
+	resp, body := get(t, url+whoami.Path, newToken(t, ca, clientID, "ping-pong-server"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d %q", whoami.Path, resp.StatusCode, body)
+	}
+	var id whoami.Identity
+	if err := json.Unmarshal([]byte(body), &id); err != nil {
+		t.Fatalf("invalid identity %q: %v", body, err)
+	}
+	if id.PeerID != clientID.String() || id.ServerID != serverID.String() || id.Mechanism != whoami.MechanismJWTSVID {
+		t.Errorf("identity = %+v, want peer %s, server %s, mechanism %s", id, clientID, serverID, whoami.MechanismJWTSVID)
+	}
+	if id.Token == nil || id.Token.Subject != clientID.String() {
+		t.Errorf("identity token = %+v, want subject %s", id.Token, clientID)
+	}
+}
+
+func TestRejectsInvalidTokens(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	untrusted := spiffetest.NewCA(t, exampleOrg)
+	url := startServer(t, ca)
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{"missing", "", reasonMissingToken},
+		{"malformed", "not-a-jwt", reasonMalformedToken},
+		{"wrong audience", newToken(t, ca, clientID, "other-server"), reasonWrongAudience},
+		{"untrusted signer", newToken(t, untrusted, clientID, "ping-pong-server"), reasonBadSignature},
+		{"wrong client", newToken(t, ca, spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/other"), "ping-pong-server"), reasonWrongSubject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(tokenValidationFailures.WithLabelValues(tt.reason))
+			resp, body := get(t, url+"/", tt.token)
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("GET / = %d %q, want 401", resp.StatusCode, body)
+			}
+			if resp.Header.Get("Authorization") != "" {
+				t.Error("server sent its token to an unauthenticated client")
+			}
+			if got := testutil.ToFloat64(tokenValidationFailures.WithLabelValues(tt.reason)) - before; got != 1 {
+				t.Errorf("token_validation_failures_total{reason=%q} increased by %v, want 1", tt.reason, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/httpmetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+var (
+	tokenValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_validation_failures_total",
+		Help: "The total number of requests rejected by JWT-SVID validation or authorization, by reason",
+	}, []string{"reason"})
+
+	jwtSVIDFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_svid_fetches_total",
+		Help: "The total number of JWT-SVID fetches from the workload API, by result",
+	}, []string{"result"})
+	jwtSVIDNotAfter = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jwt_svid_not_after",
+		Help: "The timestamp when the most recently fetched JWT-SVID expires",
+	})
+)
+
+// Validation failure reasons, used as the reason label of
+// token_validation_failures_total.
+const (
+	reasonMissingToken   = "missing_token"
+	reasonMalformedToken = "malformed_token"
+	reasonBadSignature   = "bad_signature"
+	reasonExpired        = "expired"
+	reasonWrongAudience  = "wrong_audience"
+	reasonInvalidToken   = "invalid_token"
+	reasonWrongSubject   = "wrong_subject"
+)
+
+// validationFailureReason classifies an error returned by ValidateJWTSVID.
+// The workload API returns validation errors as gRPC status messages, so they
+// can only be told apart by the go-spiffe error text they carry.
+func validationFailureReason(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "token has expired"):
+		return reasonExpired
+	case strings.Contains(msg, "expected audience"):
+		return reasonWrongAudience
+	case strings.Contains(msg, "unable to get claims from token"), strings.Contains(msg, "no JWT authority"):
+		return reasonBadSignature
+	case strings.Contains(msg, "unable to parse JWT token"):
+		return reasonMalformedToken
+	default:
+		return reasonInvalidToken
+	}
+}
+
+// recordJWTSVIDFetch counts a JWT-SVID fetch and records the SVID's expiry.
+func recordJWTSVIDFetch(svid *jwtsvid.SVID, err error) {
+	if err != nil {
+		jwtSVIDFetches.WithLabelValues("error").Inc()
+		return
+	}
+	jwtSVIDFetches.WithLabelValues("success").Inc()
+	jwtSVIDNotAfter.Set(float64(svid.Expiry.Unix()))
+}
+
+// metricsWrapper records the outcome and duration of each request once the
+// handler has written its response.
+func metricsWrapper(next http.Handler) http.Handler {
+	return httpmetrics.Handler("http", next, nil)
+}
+
+// runMetrics serves Prometheus metrics on env.MetricsPort in the background
+// until ctx is cancelled.
+func runMetrics(ctx context.Context, env *Env) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              env.MetricsPort,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("Metrics enabled, starting server", "port", env.MetricsPort)
+		if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
+			slog.Error("Error serving metrics", "error", err)
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -9,10 +10,15 @@ import (
 	"net/url"
 	"os"
 	"time"
+
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
 )
 
 func main() {
-	if err := run(getEnv()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, getEnv()); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -20,6 +26,7 @@ func main() {
 type Env struct {
 	ServerAddress string
 	ServerPort    string
+	Health        health.Config
 }
 
 func getEnvOrPanic(variable string) string {
@@ -31,32 +38,49 @@ func getEnvOrPanic(variable string) string {
 }
 
 func getEnv() *Env {
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
 	return &Env{
 		ServerAddress: getEnvOrPanic("PING_PONG_SERVICE_HOST"),
 		ServerPort:    getEnvOrPanic("PING_PONG_SERVICE_PORT"),
+		Health:        healthConfig,
 	}
 }
 
-func run(env *Env) error {
+func run(ctx context.Context, env *Env) error {
+	// The sidecar holds the workload's identity, so the client is ready as
+	// soon as it starts.
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
+	checker.MarkStarted()
+
 	client := &http.Client{
 		Transport: &http.Transport{},
 	}
 
 	for {
 		slog.Info("ping...")
-		if err := ping(client, env.ServerAddress, env.ServerPort); err != nil {
+		if err := ping(ctx, client, env.ServerAddress, env.ServerPort); err != nil && ctx.Err() == nil {
 			slog.Error("problem reaching server", "error", err)
 		}
-		time.Sleep(5 * time.Second)
+		if !graceful.Sleep(ctx, 5*time.Second) {
+			slog.Info("Client stopped")
+			return nil
+		}
 	}
 }
 
-func ping(client *http.Client, serverAddr, serverPort string) error {
-	r, err := client.Get((&url.URL{
+func ping(ctx context.Context, client *http.Client, serverAddr, serverPort string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, (&url.URL{
 		Scheme: "http",
 		Host:   fmt.Sprintf("%s:%s", serverAddr, serverPort),
-	}).String())
-
+	}).String(), nil)
+	if err != nil {
+		return err
+	}
+	r, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -6,17 +6,29 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/whoami"
 )
 
+// xfccHeader is set by Envoy-based service mesh sidecars, such as Istio's, to
+// describe the client certificate of the mTLS connection they terminated.
+const xfccHeader = "X-Forwarded-Client-Cert"
+
 func main() {
-	if err := run(context.Background(), getEnv()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, getEnv()); err != nil {
 		log.Fatal(err)
 	}
 }
 
 type Env struct {
-	Port string
+	Port   string
+	Health health.Config
 }
 
 func getEnvWithDefault(variable string, defaultValue string) string {
@@ -28,14 +40,26 @@ func getEnvWithDefault(variable string, defaultValue string) string {
 }
 
 func getEnv() *Env {
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 	return &Env{
-		Port: getEnvWithDefault("PORT", ":8443"),
+		Port:   getEnvWithDefault("PORT", ":8443"),
+		Health: healthConfig,
 	}
 }
 
 func run(ctx context.Context, env *Env) error {
+	// The sidecar holds the workload's identity, so the server is ready as
+	// soon as it starts.
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
+	checker.MarkStarted()
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", handler)
+	mux.Handle("/", authenticate(handler))
+	mux.Handle(whoami.Path, authenticate(whoami.Handler))
 
 	server := &http.Server{
 		Addr:              env.Port,
@@ -43,7 +67,7 @@ func run(ctx context.Context, env *Env) error {
 		ReadHeaderTimeout: time.Second * 10,
 	}
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
 		return fmt.Errorf("failed to serve: %w", err)
 	}
 
@@ -59,3 +83,58 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// authenticate stores the client and server identities reported by the mesh
+// sidecar in the request context. The sidecar is responsible for authorizing
+// the client, so requests without the header are not rejected.
+func authenticate(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := &whoami.Identity{Mechanism: whoami.MechanismMesh}
+		if xfcc := r.Header.Get(xfccHeader); xfcc != "" {
+			id.PeerID, id.ServerID = parseXFCC(xfcc)
+		}
+		next(w, r.WithContext(whoami.NewContext(r.Context(), id)))
+	})
+}
+
+// parseXFCC returns the client (URI) and server (By) SPIFFE IDs of the last
+// element of an X-Forwarded-Client-Cert header, which describes the hop
+// closest to this server.
+func parseXFCC(header string) (peer string, server string) {
+	elements := splitQuoted(header, ',')
+	for _, pair := range splitQuoted(elements[len(elements)-1], ';') {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "uri":
+			if peer == "" && strings.HasPrefix(value, "spiffe://") {
+				peer = value
+			}
+		case "by":
+			server = value
+		}
+	}
+	return peer, server
+}
+
+// splitQuoted splits s on sep, ignoring separators inside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
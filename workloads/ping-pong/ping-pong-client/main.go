@@ -1,19 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cofide/cofide-demos/pkg/authz"
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/loadgen"
+	"github.com/cofide/cofide-demos/pkg/svidwatch"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
@@ -56,11 +70,46 @@ var (
 		Name: "svid_uri_san",
 		Help: "The SPIFFE ID URI SAN of the current SVID certificate",
 	}, []string{"spiffe_id"})
+
+	pingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ping_duration_seconds",
+		Help:    "The duration of pings, by result",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"result"})
+
+	pingResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ping_results_total",
+		Help: "The total number of pings, by result and response status code",
+	}, []string{"result", "code"})
+
+	tlsHandshakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tls_handshake_duration_seconds",
+		Help:    "The duration of mTLS handshakes with the server, by result",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"result"})
+
+	rejectedServers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rejected_servers_total",
+		Help: "The total number of TLS handshakes rejected because the server SPIFFE ID is not authorized, by server SPIFFE ID",
+	}, []string{"spiffe_id"})
+)
+
+// Ping results, used as the result label of ping metrics.
+const (
+	resultSuccess              = "success"
+	resultNon200               = "non_200"
+	resultTimeout              = "timeout"
+	resultUnauthorizedSPIFFEID = "unauthorized_spiffe_id"
+	resultUnauthorizedServer   = "unauthorized_server"
+	resultTLSHandshakeFailure  = "tls_handshake_failure"
+	resultConnectionError      = "connection_error"
 )
 
 func main() {
 	clientStartTime.Set(float64(time.Now().Unix()))
-	if err := run(context.Background(), getEnv()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, getEnv()); err != nil {
 		slog.Error("Error running client", "error", err)
 		os.Exit(1)
 	}
@@ -72,6 +121,13 @@ type Env struct {
 	MetricsPort      string
 	MetricsEnabled   bool
 	SpiffeSocketPath string
+	// ServerSPIFFEIDs and ServerTrustDomain are comma-separated lists of the
+	// SPIFFE IDs and trust domains of the servers the client will talk to
+	ServerSPIFFEIDs   string
+	ServerTrustDomain string
+	Load              loadgen.Config
+	Health            health.Config
+	Rotation          svidwatch.Config
 }
 
 func getEnvWithDefault(variable string, defaultValue string) string {
@@ -97,12 +153,32 @@ func getEnvIntWithDefault(variable string, defaultValue int) int {
 }
 
 func getEnv() *Env {
+	load, err := loadgen.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid load generation configuration", "error", err)
+		os.Exit(1)
+	}
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid health configuration", "error", err)
+		os.Exit(1)
+	}
+	rotation, err := svidwatch.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid SVID rotation configuration", "error", err)
+		os.Exit(1)
+	}
 	return &Env{
-		ServerAddress:    getEnvWithDefault("PING_PONG_SERVICE_HOST", "ping-pong-server.demo"),
-		ServerPort:       getEnvIntWithDefault("PING_PONG_SERVICE_PORT", 8443),
-		MetricsPort:      getEnvWithDefault("METRICS_PORT", ":8080"),
-		SpiffeSocketPath: getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", "unix:///spiffe-workload-api/spire-agent.sock"),
-		MetricsEnabled:   getEnvBooleanWithDefault("METRICS_ENABLED", true),
+		ServerAddress:     getEnvWithDefault("PING_PONG_SERVICE_HOST", "ping-pong-server.demo"),
+		ServerPort:        getEnvIntWithDefault("PING_PONG_SERVICE_PORT", 8443),
+		MetricsPort:       getEnvWithDefault("METRICS_PORT", ":8080"),
+		SpiffeSocketPath:  getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", "unix:///spiffe-workload-api/spire-agent.sock"),
+		MetricsEnabled:    getEnvBooleanWithDefault("METRICS_ENABLED", true),
+		ServerSPIFFEIDs:   getEnvWithDefault("SERVER_SPIFFE_IDS", ""),
+		ServerTrustDomain: getEnvWithDefault("SERVER_TRUST_DOMAIN", ""),
+		Load:              load,
+		Health:            healthConfig,
+		Rotation:          rotation,
 	}
 }
 
@@ -123,12 +199,23 @@ func run(ctx context.Context, env *Env) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
+
 	// Create X509Source with a separate context for initialization
 	initCtx, initCancel := context.WithTimeout(ctx, 30*time.Second)
 	defer initCancel()
 
 	slog.Info("Waiting for X.509 SVID")
-	source, err := workloadapi.NewX509Source(initCtx, workloadapi.WithClientOptions(workloadapi.WithAddr(env.SpiffeSocketPath)))
+	// The X509Source and the trust bundle watchdog share a workload API client.
+	wlClient, err := workloadapi.New(ctx, workloadapi.WithAddr(env.SpiffeSocketPath))
+	if err != nil {
+		return fmt.Errorf("unable to create workload API client: %w", err)
+	}
+	defer func() {
+		_ = wlClient.Close()
+	}()
+	source, err := workloadapi.NewX509Source(initCtx, workloadapi.WithClient(wlClient))
 	if err != nil {
 		return fmt.Errorf("unable to obtain SVID: %w", err)
 	}
@@ -136,39 +223,32 @@ func run(ctx context.Context, env *Env) error {
 		_ = source.Close()
 	}()
 	slog.Info("Retrieved X.509 SVID")
+	checker.AddReadinessCheck("x509-svid", health.X509SVIDCheck(source, env.Health.SVIDExpiryMargin))
+
+	updates := health.NewSVIDUpdates(source, env.Rotation.RotationThreshold)
+	checker.AddLivenessCheck("svid-updates", updates.Check)
+	watchdog := svidwatch.NewWatchdog(env.Rotation, source)
+	if env.Rotation.FailReadiness {
+		checker.AddReadinessCheck("svid-rotation", watchdog.Check)
+	}
+	go watchdog.WatchBundles(ctx, wlClient)
+	runSVIDUpdateWatcher(ctx, source, updates, watchdog)
 
 	if env.MetricsEnabled {
 		// Expose metrics endpoint
-		http.Handle("/metrics", promhttp.Handler())
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		// Expose the trust bundle debug endpoint alongside the metrics
+		mux.HandleFunc(svidwatch.BundlesPath, watchdog.BundlesHandler)
+		server := &http.Server{
+			Addr:              env.MetricsPort,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
 		go func() {
 			slog.Info("Metrics enabled, starting server", "port", env.MetricsPort)
-			if err := http.ListenAndServe(env.MetricsPort, nil); err != nil {
-				slog.Error("Error starting metrics server", "error", err)
-			}
-		}()
-
-		// Monitor SVID updates
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-source.Updated():
-					lastX509SourceUpdate.Set(float64(time.Now().Unix()))
-
-					svid, err := source.GetX509SVID()
-					if err != nil {
-						slog.Error("Error getting X509SVID", "error", err)
-						continue
-					}
-					if len(svid.Certificates) > 0 {
-						notAfter := svid.Certificates[0].NotAfter
-						svidNotAfter.Set(float64(notAfter.Unix()))
-					}
-					// Set the SPIFFE ID URI SAN metric
-					svidURISAN.WithLabelValues(svid.ID.String()).Set(1)
-					svidUpdates.Inc()
-				}
+			if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
+				slog.Error("Error serving metrics", "error", err)
 			}
 		}()
 
@@ -180,49 +260,247 @@ func run(ctx context.Context, env *Env) error {
 		}
 	}
 
-	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeAny())
+	// Only talk to servers with the expected SPIFFE IDs
+	trustDomainPatterns, err := authz.TrustDomainPatterns(authz.SplitList(env.ServerTrustDomain))
+	if err != nil {
+		return fmt.Errorf("failed to parse server trust domains: %w", err)
+	}
+	serverPolicy, err := authz.NewPolicy(append(authz.SplitList(env.ServerSPIFFEIDs), trustDomainPatterns...))
+	if err != nil {
+		return fmt.Errorf("failed to parse server SPIFFE IDs: %w", err)
+	}
+	authorizer := tlsconfig.AuthorizeAny()
+	if serverPolicy.Empty() {
+		slog.Warn("SERVER_SPIFFE_IDS and SERVER_TRUST_DOMAIN are unset, authorizing any server SPIFFE ID")
+	} else {
+		slog.Info("Allowed server SPIFFE IDs", "policy", serverPolicy.String())
+		authorizer = countRejectedServers(tlsconfig.AdaptMatcher(serverPolicy.Match))
+	}
+	tlsConfig := tlsconfig.MTLSClientConfig(source, source, watchdog.Authorizer(authorizer))
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	// Bound each request so that a hung server is recorded as a timeout
+	// rather than stalling the ping loop.
 	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}
+	checker.MarkStarted()
+
+	if env.Load.Enabled {
+		env.Load.ConfigureTransport(transport)
+		loadgen.Run(ctx, env.Load, func(ctx context.Context, payload []byte) error {
+			_, err := ping(ctx, client, env.ServerAddress, env.ServerPort, payload)
+			return err
+		}).Log()
+		return nil
 	}
 
 	slog.Info("Client starting")
 
 	for {
 		slog.Info("ping...")
-		requestsTotal.Inc()
-		if err := ping(client, env.ServerAddress, env.ServerPort); err != nil {
-			pingErrors.Inc()
+		body, err := ping(ctx, client, env.ServerAddress, env.ServerPort, nil)
+		switch {
+		case ctx.Err() != nil:
+			// The request was abandoned because the client is shutting down.
+		case err != nil:
 			slog.Error("problem reaching server", "error", err)
-		} else {
-			successfulConnections.Inc()
+		default:
+			slog.Info(string(body))
+		}
+		if !graceful.Sleep(ctx, 5*time.Second) {
+			slog.Info("Client stopped")
+			return nil
+		}
+	}
+}
+
+// runSVIDUpdateWatcher records SVID updates in metrics and in updates, whose
+// liveness check detects the stream of updates stalling, until ctx is
+// cancelled. On every update and tick it has watchdog check whether the SVID
+// is overdue for rotation.
+func runSVIDUpdateWatcher(ctx context.Context, source *workloadapi.X509Source, updates *health.SVIDUpdates, watchdog *svidwatch.Watchdog) {
+	go func() {
+		ticker := time.NewTicker(svidwatch.CheckInterval)
+		defer ticker.Stop()
+		for {
+			watchdog.CheckSVID(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-source.Updated():
+				updates.Updated()
+				lastX509SourceUpdate.Set(float64(time.Now().Unix()))
+
+				svid, err := source.GetX509SVID()
+				if err != nil {
+					slog.Error("Error getting X509SVID", "error", err)
+					continue
+				}
+				if len(svid.Certificates) > 0 {
+					notAfter := svid.Certificates[0].NotAfter
+					svidNotAfter.Set(float64(notAfter.Unix()))
+				}
+				// Set the SPIFFE ID URI SAN metric
+				svidURISAN.WithLabelValues(svid.ID.String()).Set(1)
+				svidUpdates.Inc()
+			}
 		}
-		time.Sleep(5 * time.Second)
+	}()
+}
+
+// countRejectedServers wraps authorizer to log and count the servers it
+// rejects by SPIFFE ID. The client aborts the TLS handshake with a rejected
+// server, so no request is sent to it.
+func countRejectedServers(authorizer tlsconfig.Authorizer) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		err := authorizer(id, verifiedChains)
+		if err != nil {
+			rejectedServers.WithLabelValues(id.String()).Inc()
+			slog.Warn("Rejected unauthorized server", "server.id", id.String(), "error", err)
+		}
+		return err
+	}
+}
+
+// ping sends a request to the server and returns the response body, recording
+// the outcome in metrics. The request is a POST carrying payload if it is
+// non-nil, and a GET otherwise.
+func ping(ctx context.Context, client *http.Client, serverAddr string, serverPort int, payload []byte) ([]byte, error) {
+	requestsTotal.Inc()
+	start := time.Now()
+	var handshake handshakeTrace
+	body, status, err := sendPing(httptrace.WithClientTrace(ctx, handshake.clientTrace()), client, serverAddr, serverPort, payload)
+
+	result := pingResult(err, handshake.err())
+	code := ""
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	pingDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	pingResults.WithLabelValues(result, code).Inc()
+	if err != nil {
+		pingErrors.Inc()
+		return nil, err
 	}
+	successfulConnections.Inc()
+	return body, nil
 }
 
-func ping(client *http.Client, serverAddr string, serverPort int) error {
-	r, err := client.Get((&url.URL{
+// sendPing sends a request to the server and returns the response body and
+// status code. The status code is zero if no response was received.
+func sendPing(ctx context.Context, client *http.Client, serverAddr string, serverPort int, payload []byte) ([]byte, int, error) {
+	method := http.MethodGet
+	var body io.Reader
+	if payload != nil {
+		method = http.MethodPost
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, (&url.URL{
 		Scheme: "https",
 		Host:   fmt.Sprintf("%s:%d", serverAddr, serverPort),
-	}).String())
+	}).String(), body)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer func() {
 		_ = r.Body.Close()
 	}()
 
-	body, err := io.ReadAll(r.Body)
+	respBody, err := io.ReadAll(r.Body)
 	if err != nil {
-		return err
+		return nil, r.StatusCode, err
 	}
 	if r.StatusCode != http.StatusOK {
 		// Limit how much of the response we include in the error
-		body = body[:min(len(body), 1024)]
-		return fmt.Errorf("unexpected status code: %d: %s", r.StatusCode, body)
+		respBody = respBody[:min(len(respBody), 1024)]
+		return nil, r.StatusCode, &statusError{code: r.StatusCode, body: respBody}
 	}
-	slog.Info(string(body))
-	return nil
+	return respBody, r.StatusCode, nil
+}
+
+// statusError reports a response with a status code other than 200.
+type statusError struct {
+	code int
+	body []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d: %s", e.code, e.body)
+}
+
+// pingResult classifies the outcome of a ping for metrics. handshakeErr is the
+// error of a TLS handshake made for the ping, if any.
+func pingResult(err, handshakeErr error) string {
+	if err == nil {
+		return resultSuccess
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return resultNon200
+	}
+	// The client rejects a server SPIFFE ID it does not authorize while
+	// verifying the server's certificate.
+	if errors.Is(err, authz.ErrUnauthorized) {
+		return resultUnauthorizedServer
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return resultTimeout
+	}
+	// The server rejects a client SPIFFE ID it does not authorize with a
+	// bad_certificate alert. With TLS 1.3 the client only receives the alert
+	// after its side of the handshake has completed.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		if strings.Contains(opErr.Err.Error(), "bad certificate") {
+			return resultUnauthorizedSPIFFEID
+		}
+		return resultTLSHandshakeFailure
+	}
+	if handshakeErr != nil {
+		return resultTLSHandshakeFailure
+	}
+	return resultConnectionError
+}
+
+// handshakeTrace records the duration and result of TLS handshakes made for a
+// request. Its callbacks may run on the transport's dialing goroutine.
+type handshakeTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	handshakeErr error
+}
+
+func (t *handshakeTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.start = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			result := resultSuccess
+			if err != nil {
+				result = resultTLSHandshakeFailure
+				t.handshakeErr = err
+			}
+			tlsHandshakeDuration.WithLabelValues(result).Observe(time.Since(t.start).Seconds())
+		},
+	}
+}
+
+func (t *handshakeTrace) err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.handshakeErr
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/svidwatch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	clientID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-client")
+)
+
+func newX509Source(t *testing.T, ca *spiffetest.CA, id spiffeid.ID) *workloadapi.X509Source {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	api := spiffetest.New(t, ca, spiffetest.WithIDs(id))
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create X509Source: %v", err)
+	}
+	t.Cleanup(func() { _ = source.Close() })
+	return source
+}
+
+// startServer serves handler over mTLS with an X.509-SVID for id issued by ca,
+// accepting the clients authorized by authorizer, and returns its port.
+func startServer(t *testing.T, ca *spiffetest.CA, id spiffeid.ID, authorizer tlsconfig.Authorizer, handler http.Handler) int {
+	t.Helper()
+	source := newX509Source(t, ca, id)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsconfig.MTLSServerConfig(source, source, authorizer),
+	}
+	go func() { _ = server.ServeTLS(l, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startClient runs the client with env, issued an SVID for clientID by ca,
+// until the test completes.
+func startClient(t *testing.T, ca *spiffetest.CA, env *Env) {
+	t.Helper()
+	env.ServerAddress = "127.0.0.1"
+	env.SpiffeSocketPath = spiffetest.New(t, ca, spiffetest.WithIDs(clientID)).Addr()
+	env.Health = health.Config{Port: "127.0.0.1:0"}
+	env.Rotation = svidwatch.Config{RotationThreshold: 0.8}
+	spiffetest.StartWorkload(t, func(ctx context.Context) error { return run(ctx, env) })
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPingsAuthorizedServer(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	serverID := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-server")
+	pings := make(chan string, 1)
+	port := startServer(t, ca, serverID, tlsconfig.AuthorizeID(clientID), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := spiffeid.FromURI(r.TLS.PeerCertificates[0].URIs[0])
+		select {
+		case pings <- id.String():
+		default:
+		}
+		_, _ = w.Write([]byte("...pong"))
+	}))
+
+	startClient(t, ca, &Env{ServerPort: port, ServerSPIFFEIDs: "spiffe://example.org/ns/demo/*"})
+
+	select {
+	case id := <-pings:
+		if id != clientID.String() {
+			t.Errorf("server saw client %s, want %s", id, clientID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server was not pinged")
+	}
+}
+
+func TestRejectsUnauthorizedServer(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	impostor := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/impostor")
+	pinged := make(chan struct{}, 1)
+	port := startServer(t, ca, impostor, tlsconfig.AuthorizeAny(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		pinged <- struct{}{}
+	}))
+
+	rejectedBefore := testutil.ToFloat64(rejectedServers.WithLabelValues(impostor.String()))
+	resultsBefore := testutil.ToFloat64(pingResults.WithLabelValues(resultUnauthorizedServer, ""))
+	startClient(t, ca, &Env{ServerPort: port, ServerSPIFFEIDs: "spiffe://example.org/ns/demo/sa/ping-pong-server"})
+
+	waitFor(t, "the server to be rejected", func() bool {
+		return testutil.ToFloat64(rejectedServers.WithLabelValues(impostor.String())) > rejectedBefore &&
+			testutil.ToFloat64(pingResults.WithLabelValues(resultUnauthorizedServer, "")) > resultsBefore
+	})
+	select {
+	case <-pinged:
+		t.Error("client sent a request to an unauthorized server")
+	default:
+	}
+}
+
+func TestPingResults(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	serverID := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/results-server")
+	source := newX509Source(t, ca, clientID)
+	newClient := func(timeout time.Duration) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(serverID))},
+			Timeout:   timeout,
+		}
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("...pong")) }
+
+	tests := []struct {
+		name       string
+		authorizer tlsconfig.Authorizer
+		handler    http.HandlerFunc
+		timeout    time.Duration
+		result     string
+		code       int
+	}{
+		{
+			name:       "success",
+			authorizer: tlsconfig.AuthorizeID(clientID),
+			handler:    ok,
+			timeout:    10 * time.Second,
+			result:     resultSuccess,
+			code:       http.StatusOK,
+		},
+		{
+			name:       "non-200",
+			authorizer: tlsconfig.AuthorizeID(clientID),
+			handler:    func(w http.ResponseWriter, r *http.Request) { http.Error(w, "Forbidden", http.StatusForbidden) },
+			timeout:    10 * time.Second,
+			result:     resultNon200,
+			code:       http.StatusForbidden,
+		},
+		{
+			name:       "client rejected by server",
+			authorizer: tlsconfig.AuthorizeID(spiffeid.RequireFromString("spiffe://example.org/someone-else")),
+			handler:    ok,
+			timeout:    10 * time.Second,
+			result:     resultUnauthorizedSPIFFEID,
+		},
+		{
+			name:       "timeout",
+			authorizer: tlsconfig.AuthorizeID(clientID),
+			handler:    func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() },
+			timeout:    100 * time.Millisecond,
+			result:     resultTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := startServer(t, ca, serverID, tt.authorizer, tt.handler)
+			code := ""
+			if tt.code != 0 {
+				code = strconv.Itoa(tt.code)
+			}
+			before := testutil.ToFloat64(pingResults.WithLabelValues(tt.result, code))
+
+			_, err := ping(context.Background(), newClient(tt.timeout), "127.0.0.1", port, nil)
+			if (err == nil) != (tt.result == resultSuccess) {
+				t.Errorf("ping() error = %v", err)
+			}
+			if got := testutil.ToFloat64(pingResults.WithLabelValues(tt.result, code)) - before; got != 1 {
+				t.Errorf("ping_results_total{result=%q,code=%q} increased by %v, want 1", tt.result, code, got)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -10,6 +12,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cofide/cofide-demos/pkg/graceful"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/httpmetrics"
+	"github.com/cofide/cofide-demos/pkg/svidwatch"
+	"github.com/cofide/cofide-demos/pkg/whoami"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -57,12 +64,25 @@ var (
 		Name: "svid_uri_san",
 		Help: "The SPIFFE ID URI SAN of the current SVID certificate",
 	}, []string{"spiffe_id"})
+
+	rejectedPeers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rejected_peers_total",
+		Help: "The total number of TLS handshakes rejected because the client SPIFFE ID is not authorized, by client SPIFFE ID",
+	}, []string{"spiffe_id"})
+
+	tlsHandshakeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tls_handshake_duration_seconds",
+		Help:    "The duration of successful mTLS handshakes with clients",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
 )
 
 func main() {
 	serverStartTime.Set(float64(time.Now().Unix()))
 
-	if err := run(context.Background(), getEnv()); err != nil {
+	ctx, stop := graceful.NotifyContext(context.Background())
+	defer stop()
+	if err := run(ctx, getEnv()); err != nil {
 		slog.Error("Error running server", "error", err)
 		os.Exit(1)
 	}
@@ -76,15 +96,11 @@ type Env struct {
 	// ClientSPIFFEIDs is a collection of allowed SPIFFEIDs of the
 	// clients making inbound requests to this server
 	ClientSPIFFEIDs string
-}
-
-func mustGetEnv(variable string) string {
-	v, ok := os.LookupEnv(variable)
-	if !ok {
-		slog.Error("Unset environment variable", "variable", variable)
-		os.Exit(1)
-	}
-	return v
+	// PolicyFile is the path of an optional policy file authorizing
+	// clients per request, used instead of ClientSPIFFEIDs
+	PolicyFile string
+	Health     health.Config
+	Rotation   svidwatch.Config
 }
 
 func getEnvWithDefault(variable string, defaultValue string) string {
@@ -109,12 +125,25 @@ func getEnvBooleanWithDefault(variable string, defaultValue bool) bool {
 }
 
 func getEnv() *Env {
+	healthConfig, err := health.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid health configuration", "error", err)
+		os.Exit(1)
+	}
+	rotation, err := svidwatch.ConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid SVID rotation configuration", "error", err)
+		os.Exit(1)
+	}
 	return &Env{
 		Port:             getEnvWithDefault("PORT", ":8443"),
 		MetricsPort:      getEnvWithDefault("METRICS_PORT", ":8080"),
 		SpiffeSocketPath: getEnvWithDefault("SPIFFE_ENDPOINT_SOCKET", "unix:///spiffe-workload-api/spire-agent.sock"),
 		MetricsEnabled:   getEnvBooleanWithDefault("METRICS_ENABLED", true),
-		ClientSPIFFEIDs:  mustGetEnv("CLIENT_SPIFFE_IDS"),
+		ClientSPIFFEIDs:  getEnvWithDefault("CLIENT_SPIFFE_IDS", ""),
+		PolicyFile:       getEnvWithDefault("POLICY_FILE", ""),
+		Health:           healthConfig,
+		Rotation:         rotation,
 	}
 }
 
@@ -122,17 +151,19 @@ func run(ctx context.Context, env *Env) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", metricsWrapper(handler))
-
-	runMetrics(env, mux)
+	checker := health.NewChecker()
+	checker.Run(ctx, env.Health.Port)
 
 	slog.Info("Waiting for X.509 SVID")
-	source, err := workloadapi.NewX509Source(ctx,
-		workloadapi.WithClientOptions(
-			workloadapi.WithAddr(env.SpiffeSocketPath),
-		),
-	)
+	// The X509Source and the trust bundle watchdog share a workload API client.
+	wlClient, err := workloadapi.New(ctx, workloadapi.WithAddr(env.SpiffeSocketPath))
+	if err != nil {
+		return fmt.Errorf("unable to create workload API client: %w", err)
+	}
+	defer func() {
+		_ = wlClient.Close()
+	}()
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClient(wlClient))
 	if err != nil {
 		return fmt.Errorf("unable to obtain SVID: %w", err)
 	}
@@ -140,8 +171,22 @@ func run(ctx context.Context, env *Env) error {
 		_ = source.Close()
 	}()
 	slog.Info("Retrieved X.509 SVID")
+	checker.AddReadinessCheck("x509-svid", health.X509SVIDCheck(source, env.Health.SVIDExpiryMargin))
+
+	mux := http.NewServeMux()
+	mux.Handle("/", metricsWrapper(authenticate(source, http.HandlerFunc(handler))))
+	mux.Handle(whoami.Path, metricsWrapper(authenticate(source, http.HandlerFunc(whoami.Handler))))
 
-	runMetricsUpdateWatcher(env, source, ctx)
+	updates := health.NewSVIDUpdates(source, env.Rotation.RotationThreshold)
+	checker.AddLivenessCheck("svid-updates", updates.Check)
+	watchdog := svidwatch.NewWatchdog(env.Rotation, source)
+	if env.Rotation.FailReadiness {
+		checker.AddReadinessCheck("svid-rotation", watchdog.Check)
+	}
+	go watchdog.WatchBundles(ctx, wlClient)
+	runSVIDUpdateWatcher(ctx, source, updates, watchdog)
+
+	runMetrics(ctx, env, mux, watchdog)
 
 	// Set initial X509 info in metrics
 	lastX509SourceUpdate.Set(float64(time.Now().Unix()))
@@ -150,57 +195,106 @@ func run(ctx context.Context, env *Env) error {
 		svidURISAN.WithLabelValues(svid.ID.String()).Set(1)
 	}
 
-	// Only authorize inbound calls from the expected client SPIFFE IDs
-	allowedSPIFFEIDs := strings.Split(env.ClientSPIFFEIDs, ",")
-	clientSPIFFEIDs := make([]spiffeid.ID, 0, len(allowedSPIFFEIDs))
-	for _, allowedSPIFFEID := range allowedSPIFFEIDs {
-		clientSPIFFEID, err := spiffeid.FromString(allowedSPIFFEID)
+	// Only authorize inbound calls from the expected client SPIFFE IDs: with
+	// a policy file, per request so that it can be reloaded and distinguish
+	// routes, and otherwise at the TLS handshake
+	var handler http.Handler = mux
+	var authorizer tlsconfig.Authorizer
+	if env.PolicyFile != "" {
+		if env.ClientSPIFFEIDs != "" {
+			slog.Warn("CLIENT_SPIFFE_IDS is ignored when POLICY_FILE is set")
+		}
+		policy, err := loadPolicyFile(env.PolicyFile)
 		if err != nil {
-			return fmt.Errorf("failed to parse client SPIFFE ID: %w", err)
+			return err
+		}
+		go policy.watch(ctx)
+		handler = policy.authorizeRequests(mux)
+		authorizer = tlsconfig.AuthorizeAny()
+	} else {
+		if env.ClientSPIFFEIDs == "" {
+			return fmt.Errorf("CLIENT_SPIFFE_IDS or POLICY_FILE must be set")
+		}
+		allowedSPIFFEIDs := strings.Split(env.ClientSPIFFEIDs, ",")
+		clientSPIFFEIDs := make([]spiffeid.ID, 0, len(allowedSPIFFEIDs))
+		for _, allowedSPIFFEID := range allowedSPIFFEIDs {
+			clientSPIFFEID, err := spiffeid.FromString(allowedSPIFFEID)
+			if err != nil {
+				return fmt.Errorf("failed to parse client SPIFFE ID: %w", err)
+			}
+			clientSPIFFEIDs = append(clientSPIFFEIDs, clientSPIFFEID)
 		}
-		clientSPIFFEIDs = append(clientSPIFFEIDs, clientSPIFFEID)
+		slog.Info("Allowed client SPIFFE IDs", "spiffe_ids", clientSPIFFEIDs)
+		authorizer = countRejectedPeers(tlsconfig.AuthorizeOneOf(clientSPIFFEIDs...))
 	}
-	slog.Info("Allowed client SPIFFE IDs", "spiffe_ids", clientSPIFFEIDs)
 	tlsConfig := tlsconfig.MTLSServerConfig(
 		source,
 		source,
-		tlsconfig.AuthorizeOneOf(clientSPIFFEIDs...),
+		watchdog.Authorizer(authorizer),
 	)
+	timeHandshakes(tlsConfig)
 	server := &http.Server{
 		Addr:              env.Port,
 		TLSConfig:         tlsConfig,
-		Handler:           mux,
+		Handler:           handler,
 		ReadHeaderTimeout: time.Second * 10,
 	}
 
 	slog.Info("Server starting", "port", env.Port)
+	checker.MarkStarted()
 
-	if err := server.ListenAndServeTLS("", ""); err != nil {
+	serve := func() error { return server.ListenAndServeTLS("", "") }
+	if err := graceful.Serve(ctx, server, serve); err != nil {
 		return fmt.Errorf("failed to serve: %w", err)
 	}
 
 	return nil
 }
 
-func metricsWrapper(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// metricsWrapper records the outcome and duration of each request once the
+// handler has written its response.
+func metricsWrapper(next http.Handler) http.Handler {
+	return httpmetrics.Handler("mtls", next, func(status int) {
 		requestsTotal.Inc()
-		successfulConnections.Inc()
-		next(w, r)
+		if status == http.StatusOK {
+			successfulConnections.Inc()
+		}
+	})
+}
+
+// countRejectedPeers wraps authorizer to count the clients it rejects by
+// SPIFFE ID. Rejected clients fail the TLS handshake, so never reach a handler.
+func countRejectedPeers(authorizer tlsconfig.Authorizer) tlsconfig.Authorizer {
+	return func(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+		err := authorizer(id, verifiedChains)
+		if err != nil {
+			rejectedPeers.WithLabelValues(id.String()).Inc()
+			slog.Warn("Rejected unauthorized client", "client.id", id.String(), "error", err)
+		}
+		return err
+	}
+}
+
+// timeHandshakes records the duration of successful TLS handshakes using
+// config, from the ClientHello until the client certificate is verified.
+func timeHandshakes(config *tls.Config) {
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		start := time.Now()
+		c := config.Clone()
+		c.VerifyConnection = func(tls.ConnectionState) error {
+			tlsHandshakeDuration.Observe(time.Since(start).Seconds())
+			return nil
+		}
+		return c, nil
 	}
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
-	clientID, err := getClientID(r)
-	if err != nil {
-		slog.Warn("Unable to determine client SPIFFE ID", "error", err)
-		http.Error(w, "Unable to determine client SPIFFE ID", http.StatusUnauthorized)
-		return
-	}
-	slog.Info("Received ping", "client.id", clientID.String())
+	id, _ := whoami.FromContext(r.Context())
+	slog.Info("Received ping", "client.id", id.PeerID)
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("...pong"))
+	_, err := w.Write([]byte("...pong"))
 	if err != nil {
 		handlerErrors.Inc()
 		slog.Error("Error writing response", "error", err)
@@ -208,6 +302,28 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authenticate stores the identity of the client, taken from its X.509-SVID,
+// in the request context.
+func authenticate(source *workloadapi.X509Source, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := getClientID(r)
+		if err != nil {
+			slog.Warn("Unable to determine client SPIFFE ID", "error", err)
+			http.Error(w, "Unable to determine client SPIFFE ID", http.StatusUnauthorized)
+			return
+		}
+		id := &whoami.Identity{
+			PeerID:      clientID.String(),
+			Mechanism:   whoami.MechanismMTLS,
+			Certificate: whoami.NewCertificate(r.TLS.PeerCertificates[0]),
+		}
+		if svid, err := source.GetX509SVID(); err == nil {
+			id.ServerID = svid.ID.String()
+		}
+		next.ServeHTTP(w, r.WithContext(whoami.NewContext(r.Context(), id)))
+	})
+}
+
 // getClientID returns the SPIFFE ID of the client.
 func getClientID(r *http.Request) (spiffeid.ID, error) {
 	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
@@ -216,46 +332,62 @@ func getClientID(r *http.Request) (spiffeid.ID, error) {
 	return x509svid.IDFromCert(r.TLS.PeerCertificates[0])
 }
 
-func runMetrics(env *Env, mux *http.ServeMux) {
-	if env.MetricsEnabled {
-		// Expose metrics endpoint in both the mTLS server and a default HTTP server
-		mux.Handle("/metrics", promhttp.Handler())
-		http.Handle("/metrics", promhttp.Handler())
-		slog.Info("Metrics enabled, starting server", "port", env.MetricsPort)
-		go func() {
-			if err := http.ListenAndServe(env.MetricsPort, nil); err != nil {
-				slog.Error("Error starting metrics server", "error", err)
-			}
-		}()
-
+// runMetrics exposes metrics and the trust bundle debug endpoint on both the
+// mTLS server's mux and a plain HTTP server on env.MetricsPort, which is shut
+// down when ctx is cancelled.
+func runMetrics(ctx context.Context, env *Env, mtlsMux *http.ServeMux, watchdog *svidwatch.Watchdog) {
+	if !env.MetricsEnabled {
+		return
+	}
+	mux := http.NewServeMux()
+	for _, m := range []*http.ServeMux{mtlsMux, mux} {
+		m.Handle("/metrics", promhttp.Handler())
+		m.HandleFunc(svidwatch.BundlesPath, watchdog.BundlesHandler)
+	}
+	server := &http.Server{
+		Addr:              env.MetricsPort,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
 	}
+	go func() {
+		slog.Info("Metrics enabled, starting server", "port", env.MetricsPort)
+		if err := graceful.Serve(ctx, server, server.ListenAndServe); err != nil {
+			slog.Error("Error serving metrics", "error", err)
+		}
+	}()
 }
 
-func runMetricsUpdateWatcher(env *Env, source *workloadapi.X509Source, ctx context.Context) {
-	if env.MetricsEnabled {
-		// Monitor SVID updates
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-source.Updated():
-					lastX509SourceUpdate.Set(float64(time.Now().Unix()))
-
-					svid, err := source.GetX509SVID()
-					if err != nil {
-						slog.Error("Error getting X509SVID", "error", err)
-						continue
-					}
-					if len(svid.Certificates) > 0 {
-						notAfter := svid.Certificates[0].NotAfter
-						svidNotAfter.Set(float64(notAfter.Unix()))
-					}
-					// Set the SPIFFE ID URI SAN metric
-					svidURISAN.WithLabelValues(svid.ID.String()).Set(1)
-					svidUpdates.Inc()
+// runSVIDUpdateWatcher records SVID updates in metrics and in updates, whose
+// liveness check detects the stream of updates stalling, until ctx is
+// cancelled. On every update and tick it has watchdog check whether the SVID
+// is overdue for rotation.
+func runSVIDUpdateWatcher(ctx context.Context, source *workloadapi.X509Source, updates *health.SVIDUpdates, watchdog *svidwatch.Watchdog) {
+	go func() {
+		ticker := time.NewTicker(svidwatch.CheckInterval)
+		defer ticker.Stop()
+		for {
+			watchdog.CheckSVID(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-source.Updated():
+				updates.Updated()
+				lastX509SourceUpdate.Set(float64(time.Now().Unix()))
+
+				svid, err := source.GetX509SVID()
+				if err != nil {
+					slog.Error("Error getting X509SVID", "error", err)
+					continue
 				}
+				if len(svid.Certificates) > 0 {
+					notAfter := svid.Certificates[0].NotAfter
+					svidNotAfter.Set(float64(notAfter.Unix()))
+				}
+				// Set the SPIFFE ID URI SAN metric
+				svidURISAN.WithLabelValues(svid.ID.String()).Set(1)
+				svidUpdates.Inc()
 			}
-		}()
-	}
+		}
+	}()
 }
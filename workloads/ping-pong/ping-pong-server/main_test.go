@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cofide/cofide-demos/internal/spiffetest"
+	"github.com/cofide/cofide-demos/pkg/health"
+	"github.com/cofide/cofide-demos/pkg/svidwatch"
+	"github.com/cofide/cofide-demos/pkg/whoami"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+var (
+	exampleOrg = spiffeid.RequireTrustDomainFromString("example.org")
+	serverID   = spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-server")
+)
+
+// startServer runs the server with env, issued an SVID for serverID by ca,
+// until the test completes, and returns its address.
+func startServer(t *testing.T, ca *spiffetest.CA, env *Env) string {
+	t.Helper()
+	env.Port = spiffetest.FreeAddr(t)
+	env.SpiffeSocketPath = spiffetest.New(t, ca, spiffetest.WithIDs(serverID)).Addr()
+	env.Health = health.Config{Port: "127.0.0.1:0"}
+	env.Rotation = svidwatch.Config{RotationThreshold: 0.8}
+	done := spiffetest.StartWorkload(t, func(ctx context.Context) error { return run(ctx, env) })
+	spiffetest.WaitReady(t, env.Port, done)
+	return env.Port
+}
+
+// newClient returns an HTTP client using an X.509-SVID for id issued by ca,
+// which only talks to the server.
+func newClient(t *testing.T, ca *spiffetest.CA, id spiffeid.ID) *http.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	api := spiffetest.New(t, ca, spiffetest.WithIDs(id))
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(api.Addr())))
+	if err != nil {
+		t.Fatalf("failed to create X509Source: %v", err)
+	}
+	t.Cleanup(func() { _ = source.Close() })
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(serverID))},
+		Timeout:   10 * time.Second,
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestPing(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	clientID := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/ping-pong-client")
+	addr := startServer(t, ca, &Env{ClientSPIFFEIDs: clientID.String()})
+	client := newClient(t, ca, clientID)
+
+	if status, body := get(t, client, "https://"+addr+"/"); status != http.StatusOK || body != "...pong" {
+		t.Errorf("GET / = %d %q, want 200 %q", status, body, "...pong")
+	}
+
+	status, body := get(t, client, "https://"+addr+whoami.Path)
+	if status != http.StatusOK {
+		t.Fatalf("GET %s = %d %q", whoami.Path, status, body)
+	}
+	var id whoami.Identity
+	if err := json.Unmarshal([]byte(body), &id); err != nil {
+		t.Fatalf("invalid identity %q: %v", body, err)
+	}
+	if id.PeerID != clientID.String() || id.ServerID != serverID.String() || id.Mechanism != whoami.MechanismMTLS {
+		t.Errorf("identity = %+v, want peer %s, server %s, mechanism %s", id, clientID, serverID, whoami.MechanismMTLS)
+	}
+}
+
+// Each server serves metrics on its own port, so that several can run in one
+// process.
+func TestMetricsServer(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	for range 2 {
+		metricsAddr := spiffetest.FreeAddr(t)
+		startServer(t, ca, &Env{ClientSPIFFEIDs: "spiffe://example.org/ns/demo/sa/ping-pong-client", MetricsEnabled: true, MetricsPort: metricsAddr})
+		for _, path := range []string{"/metrics", svidwatch.BundlesPath} {
+			status, body := get(t, http.DefaultClient, "http://"+metricsAddr+path)
+			if status != http.StatusOK {
+				t.Errorf("GET %s = %d %q, want 200", path, status, body)
+			}
+		}
+	}
+}
+
+func TestRejectsUnauthorizedClient(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	allowed := spiffeid.RequireFromString("spiffe://example.org/allowed")
+	other := spiffeid.RequireFromString("spiffe://example.org/unlisted")
+	addr := startServer(t, ca, &Env{ClientSPIFFEIDs: allowed.String()})
+	before := testutil.ToFloat64(rejectedPeers.WithLabelValues(other.String()))
+
+	if _, err := newClient(t, ca, other).Get("https://" + addr + "/"); err == nil {
+		t.Error("server accepted a client that is not in CLIENT_SPIFFE_IDS")
+	}
+	if got := testutil.ToFloat64(rejectedPeers.WithLabelValues(other.String())) - before; got != 1 {
+		t.Errorf("rejected_peers_total increased by %v, want 1", got)
+	}
+}
+
+func TestCountRejectedPeers(t *testing.T) {
+	allowed := spiffeid.RequireFromString("spiffe://example.org/allowed")
+	other := spiffeid.RequireFromString("spiffe://example.org/rejected")
+	authorizer := countRejectedPeers(tlsconfig.AuthorizeID(allowed))
+	allowedBefore := testutil.ToFloat64(rejectedPeers.WithLabelValues(allowed.String()))
+	otherBefore := testutil.ToFloat64(rejectedPeers.WithLabelValues(other.String()))
+
+	if err := authorizer(allowed, nil); err != nil {
+		t.Errorf("authorizer(%s) error = %v", allowed, err)
+	}
+	if err := authorizer(other, nil); err == nil {
+		t.Errorf("authorizer(%s) accepted a client that is not allowed", other)
+	}
+	if got := testutil.ToFloat64(rejectedPeers.WithLabelValues(allowed.String())) - allowedBefore; got != 0 {
+		t.Errorf("rejected_peers_total{spiffe_id=%q} increased by %v, want 0", allowed, got)
+	}
+	if got := testutil.ToFloat64(rejectedPeers.WithLabelValues(other.String())) - otherBefore; got != 1 {
+		t.Errorf("rejected_peers_total{spiffe_id=%q} increased by %v, want 1", other, got)
+	}
+}
+
+// CLIENT_SPIFFE_IDS lists exact IDs: a trust domain ID only allows that ID, not
+// the members of the trust domain.
+func TestClientSPIFFEIDsMatchExactly(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	addr := startServer(t, ca, &Env{ClientSPIFFEIDs: exampleOrg.IDString()})
+
+	if _, err := newClient(t, ca, spiffeid.RequireFromString("spiffe://example.org/member")).Get("https://" + addr + "/"); err == nil {
+		t.Error("trust domain ID in CLIENT_SPIFFE_IDS authorized a member of the trust domain")
+	}
+}
+
+func TestPolicyFile(t *testing.T) {
+	ca := spiffetest.NewCA(t, exampleOrg)
+	admin := spiffeid.RequireFromString("spiffe://example.org/ns/admin/sa/client")
+	batch := spiffeid.RequireFromString("spiffe://example.org/ns/batch/sa/client")
+	other := spiffeid.RequireFromString("spiffe://example.org/ns/other/sa/client")
+
+	policyPath := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := `rules:
+- method: GET
+  path: /whoami
+  spiffe_ids:
+  - spiffe://example.org/ns/admin/*
+- path: /
+  spiffe_ids:
+  - spiffe://example.org/ns/admin/*
+  - spiffe://example.org/ns/batch/*
+`
+	if err := os.WriteFile(policyPath, []byte(policy), 0o600); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+	addr := startServer(t, ca, &Env{PolicyFile: policyPath})
+
+	tests := []struct {
+		name   string
+		client spiffeid.ID
+		path   string
+		want   int
+	}{
+		{"admin whoami", admin, "/whoami", http.StatusOK},
+		{"batch ping", batch, "/", http.StatusOK},
+		{"batch whoami", batch, "/whoami", http.StatusForbidden},
+		// /whoamiX is not below /whoami, so the / rule applies.
+		{"batch path sharing a prefix", batch, "/whoamiX", http.StatusOK},
+		{"other ping", other, "/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(t, newClient(t, ca, tt.client), "https://"+addr+tt.path)
+			if status != tt.want {
+				t.Fatalf("GET %s = %d %q, want %d", tt.path, status, body, tt.want)
+			}
+			if status != http.StatusForbidden {
+				return
+			}
+			if want := "Forbidden: SPIFFE ID not authorized for GET " + tt.path + "\n"; body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+			if strings.Contains(body, "spiffe://") {
+				t.Errorf("body %q discloses the policy", body)
+			}
+		})
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		rulePath, path string
+		want           bool
+	}{
+		{"", "/anything", true},
+		{"/", "/anything", true},
+		{"/api", "/api", true},
+		{"/api", "/api/users", true},
+		{"/api/", "/api/users", true},
+		{"/api", "/apiadmin", false},
+		{"/api/", "/api", false},
+		{"/whoami", "/whoamiX", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.rulePath, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.rulePath, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParsePolicyRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]string{
+		"no rules":          "rules: []\n",
+		"unknown field":     "rules:\n- path: /\n  spiffe_id: spiffe://example.org/client\n",
+		"relative path":     "rules:\n- path: api\n  spiffe_ids: [spiffe://example.org/client]\n",
+		"bad pattern":       "rules:\n- spiffe_ids: [example.org/client]\n",
+		"bad domain":        "rules:\n- trust_domains: [\"spiffe://\"]\n",
+		"lower case method": "rules:\n- method: get\n  spiffe_ids: [spiffe://example.org/client]\n",
+	}
+	for name, policy := range tests {
+		if _, err := parsePolicy([]byte(policy)); err == nil {
+			t.Errorf("%s: parsePolicy() accepted %q", name, policy)
+		}
+	}
+}
+
+func TestPolicyFileReload(t *testing.T) {
+	client := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/client")
+	policyPath := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy := func(policy string) {
+		t.Helper()
+		if err := os.WriteFile(policyPath, []byte(policy), 0o600); err != nil {
+			t.Fatalf("failed to write policy: %v", err)
+		}
+	}
+	authorize := func(f *policyFile, method string) error {
+		return f.policy.Load().authorize(httptest.NewRequest(method, "/", nil), client)
+	}
+
+	writePolicy("rules:\n- method: GET\n  spiffe_ids: [" + client.String() + "]\n")
+	f, err := loadPolicyFile(policyPath)
+	if err != nil {
+		t.Fatalf("loadPolicyFile() error = %v", err)
+	}
+	if err := authorize(f, http.MethodGet); err != nil {
+		t.Errorf("GET denied: %v", err)
+	}
+	if err := authorize(f, http.MethodPost); err == nil {
+		t.Error("POST allowed by a GET rule")
+	}
+	if err := authorize(f, "get"); err == nil {
+		t.Error("method matched case-insensitively")
+	}
+
+	successes := testutil.ToFloat64(policyReloads.WithLabelValues("success"))
+	writePolicy("rules:\n- method: POST\n  spiffe_ids: [" + client.String() + "]\n")
+	f.reload()
+	if err := authorize(f, http.MethodPost); err != nil {
+		t.Errorf("POST denied after reload: %v", err)
+	}
+	if err := authorize(f, http.MethodGet); err == nil {
+		t.Error("GET still allowed after reload")
+	}
+	if got := testutil.ToFloat64(policyReloads.WithLabelValues("success")) - successes; got != 1 {
+		t.Errorf("policy_reloads_total{result=success} increased by %v, want 1", got)
+	}
+
+	failures := testutil.ToFloat64(policyReloads.WithLabelValues("error"))
+	writePolicy("rules: []\n")
+	f.reload()
+	f.reload()
+	if err := authorize(f, http.MethodPost); err != nil {
+		t.Errorf("POST denied after invalid reload, want the last good policy kept: %v", err)
+	}
+	if got := testutil.ToFloat64(policyReloads.WithLabelValues("error")) - failures; got != 1 {
+		t.Errorf("policy_reloads_total{result=error} increased by %v, want 1", got)
+	}
+}
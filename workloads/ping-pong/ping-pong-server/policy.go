@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cofide/cofide-demos/pkg/authz"
+	"github.com/goccy/go-yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// policyReloadInterval is how often the policy file is checked for changes.
+// Kubernetes updates ConfigMap volumes by swapping a symlink, so the file's
+// contents are compared rather than watched for events.
+const policyReloadInterval = 5 * time.Second
+
+var (
+	deniedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "denied_requests_total",
+		Help: "The total number of requests denied by the policy file, by client SPIFFE ID",
+	}, []string{"spiffe_id"})
+	policyReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "policy_reloads_total",
+		Help: "The total number of changes to the policy file, by result",
+	}, []string{"result"})
+	policyLoadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "policy_load_time",
+		Help: "The timestamp when the policy in use was loaded",
+	})
+)
+
+// policyRule authorizes the clients that may call the requests it matches.
+type policyRule struct {
+	// Method is the HTTP method the rule applies to, which is case-sensitive.
+	// Empty matches any method.
+	Method string `json:"method,omitempty"`
+	// Path is the URL path the rule applies to, along with the paths below
+	// it. Empty matches any path.
+	Path string `json:"path,omitempty"`
+	// SPIFFEIDs are the SPIFFE ID patterns of the clients allowed, parsed by
+	// authz.ParsePatterns.
+	SPIFFEIDs []string `json:"spiffe_ids,omitempty"`
+	// TrustDomains are the trust domains whose members are allowed.
+	TrustDomains []string `json:"trust_domains,omitempty"`
+
+	allowed *authz.Policy
+}
+
+// requestPolicy is an ordered list of rules read from the policy file. The
+// first rule matching a request applies; requests matching no rule are denied.
+type requestPolicy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// parsePolicy parses a YAML or JSON policy file.
+func parsePolicy(data []byte) (*requestPolicy, error) {
+	var policy requestPolicy
+	if err := yaml.UnmarshalWithOptions(data, &policy, yaml.DisallowUnknownField()); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if len(policy.Rules) == 0 {
+		return nil, fmt.Errorf("policy has no rules")
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Method != strings.ToUpper(rule.Method) {
+			return nil, fmt.Errorf("invalid method %q in rule %d: methods are case-sensitive", rule.Method, i)
+		}
+		if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("invalid path %q in rule %d", rule.Path, i)
+		}
+		tdPatterns, err := authz.TrustDomainPatterns(rule.TrustDomains)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		rule.allowed, err = authz.NewPolicy(append(slices.Clone(rule.SPIFFEIDs), tdPatterns...))
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return &policy, nil
+}
+
+// authorize checks the client against the first rule matching r, returning
+// the reason if it is denied.
+func (p *requestPolicy) authorize(r *http.Request, clientID spiffeid.ID) error {
+	i := slices.IndexFunc(p.Rules, func(rule policyRule) bool {
+		return (rule.Method == "" || rule.Method == r.Method) && matchPath(rule.Path, r.URL.Path)
+	})
+	if i < 0 {
+		return fmt.Errorf("no policy rule matches %s %s", r.Method, r.URL.Path)
+	}
+	if err := p.Rules[i].allowed.Match(clientID); err != nil {
+		return fmt.Errorf("%s %s: %w", r.Method, r.URL.Path, err)
+	}
+	return nil
+}
+
+// matchPath reports whether path is rulePath or lies below it, so that a rule
+// for /api matches /api/users but not /apiadmin.
+func matchPath(rulePath, path string) bool {
+	return path == rulePath || strings.HasPrefix(path, strings.TrimSuffix(rulePath, "/")+"/")
+}
+
+// policyFile holds the policy read from a file, reloading it when the file
+// changes. Requests are checked against the policy in use when they arrive.
+type policyFile struct {
+	path    string
+	policy  atomic.Pointer[requestPolicy]
+	content []byte
+}
+
+// loadPolicyFile reads the policy at path.
+func loadPolicyFile(path string) (*policyFile, error) {
+	f := &policyFile{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	if err := f.load(data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *policyFile) load(data []byte) error {
+	policy, err := parsePolicy(data)
+	if err != nil {
+		return err
+	}
+	f.policy.Store(policy)
+	f.content = data
+	policyLoadTime.Set(float64(time.Now().Unix()))
+	slog.Info("Loaded policy file", "path", f.path, "rules", len(policy.Rules))
+	return nil
+}
+
+// watch reloads the policy every policyReloadInterval until ctx is cancelled.
+func (f *policyFile) watch(ctx context.Context) {
+	ticker := time.NewTicker(policyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.reload()
+		}
+	}
+}
+
+// reload loads the policy file if it has changed. An invalid file is logged
+// and the previous policy is kept.
+func (f *policyFile) reload() {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		slog.Error("Error reading policy file", "path", f.path, "error", err)
+		return
+	}
+	if bytes.Equal(data, f.content) {
+		return
+	}
+	if err := f.load(data); err != nil {
+		policyReloads.WithLabelValues("error").Inc()
+		slog.Error("Invalid policy file, keeping the previous policy", "path", f.path, "error", err)
+		// Only report the same invalid file once.
+		f.content = data
+		return
+	}
+	policyReloads.WithLabelValues("success").Inc()
+}
+
+// authorizeRequests rejects requests from clients that the policy in use does
+// not allow with 403. The reason is logged rather than returned, as it lists the
+// patterns that the client failed to match.
+func (f *policyFile) authorizeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := getClientID(r)
+		if err != nil {
+			slog.Warn("Unable to determine client SPIFFE ID", "error", err)
+			http.Error(w, "Unable to determine client SPIFFE ID", http.StatusUnauthorized)
+			return
+		}
+		if err := f.policy.Load().authorize(r, clientID); err != nil {
+			deniedRequests.WithLabelValues(clientID.String()).Inc()
+			slog.Warn("Request denied by policy", "client.id", clientID.String(), "error", err)
+			http.Error(w, fmt.Sprintf("Forbidden: SPIFFE ID not authorized for %s %s", r.Method, r.URL.Path), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}